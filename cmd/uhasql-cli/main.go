@@ -16,6 +16,44 @@ import (
 	"github.com/tidwall/uhatools"
 )
 
+// tlsConfig returns the TLS config for the flags, or nil when TLS is not
+// used. The server is verified using the CA certificate, or the system
+// certificates when it's not provided, unless TLS is insecure. The client
+// certificate is presented to servers that require one.
+func tlsConfig(insecure bool, cacert, cert, key, servername string,
+) (*tls.Config, error) {
+	if !insecure && cacert == "" && cert == "" && key == "" &&
+		servername == "" {
+		return nil, nil
+	}
+	tlscfg := &tls.Config{
+		ServerName:         servername,
+		InsecureSkipVerify: insecure,
+	}
+	if cacert != "" {
+		data, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cacert)
+		}
+		tlscfg.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("flags -cert and -key must be used together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlscfg.Certificates = []tls.Certificate{pair}
+	}
+	return tlscfg, nil
+}
+
 var scriptMultilineMode bool
 var scriptLines string
 var scriptLinesPrefix string
@@ -24,53 +62,28 @@ func main() {
 	var host string
 	var port int
 	var auth string
+	var user string
 	var cacert string
+	var cert string
+	var key string
+	var servername string
 	var tlsinsecure bool
 	flag.StringVar(&host, "h", "127.0.0.1", "host")
 	flag.IntVar(&port, "p", 11001, "port")
 	flag.StringVar(&auth, "a", "", "auth")
+	flag.StringVar(&user, "u", "", "user")
 	flag.BoolVar(&tlsinsecure, "tlsinsecure", false,
 		"Use insecure TLS connection")
-	flag.StringVar(&cacert, "cacert", "", "")
+	flag.StringVar(&cacert, "cacert", "", "CA certificate of the server")
+	flag.StringVar(&cert, "cert", "", "client certificate")
+	flag.StringVar(&key, "key", "", "private key of the client certificate")
+	flag.StringVar(&servername, "servername", "",
+		"server name to verify, defaults to the host")
 	flag.Parse()
-	var tlscfg *tls.Config
-	if tlsinsecure {
-		tlscfg = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-	} else if cacert != "" {
-		var serverName string
-		tlscfg = &tls.Config{
-			InsecureSkipVerify: true,
-			VerifyConnection: func(cs tls.ConnectionState) error {
-				if len(cs.PeerCertificates) > 0 {
-					if len(cs.PeerCertificates[0].DNSNames) > 0 {
-						serverName = cs.PeerCertificates[0].DNSNames[0]
-						return nil
-					}
-				}
-				return errors.New(
-					"tls: cannot verify because no IP SANs could be determined")
-			},
-		}
-		conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", host, port), tlscfg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-			return
-		}
-		conn.Close()
-
-		data, err := ioutil.ReadFile(cacert)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-			return
-		}
-		pool := x509.NewCertPool()
-		pool.AppendCertsFromPEM(data)
-		tlscfg = &tls.Config{
-			ServerName: serverName,
-			RootCAs:    pool,
-		}
+	tlscfg, err := tlsConfig(tlsinsecure, cacert, cert, key, servername)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return
 	}
 	conn, err := uhatools.Dial(fmt.Sprintf("%s:%d", host, port),
 		&uhatools.DialOptions{
@@ -96,6 +109,19 @@ func main() {
 	line := liner.NewLiner()
 	line.SetCtrlCAborts(true)
 
+	if user != "" {
+		password, err := line.PasswordPrompt("password: ")
+		if err != nil {
+			line.Close()
+			return
+		}
+		if _, err := conn.Do("login", user, password); err != nil {
+			line.Close()
+			fmt.Fprintf(os.Stderr, "%s\n", cleanErr(err))
+			return
+		}
+	}
+
 	var histPath string
 	if udir, err := os.UserHomeDir(); err == nil {
 		histPath = filepath.Join(udir, ".uhasql_history")
@@ -252,9 +278,21 @@ func doSysCommand(conn *uhatools.Conn, cmd string) (exit bool) {
 	case ".help":
 		fmt.Printf(".exit                        Exit the process\n")
 		fmt.Printf(".help                        Show this screen\n")
+		fmt.Printf(".plan SQL                    Show the query plan and " +
+			"suggested indexes\n")
 		fmt.Printf(".version                     Show the UhaSQL version\n")
 	case ".exit":
 		return true
+	case ".plan":
+		sql := strings.TrimSpace(cmd[len(args[0]):])
+		for strings.HasSuffix(sql, ";") {
+			sql = strings.TrimSpace(sql[:len(sql)-1])
+		}
+		if sql == "" {
+			fmt.Fprintf(os.Stderr, "Error: .plan requires a statement\n")
+			return false
+		}
+		doPlanCommand(conn, sql)
 	case ".version":
 		vers, err := uhatools.String(conn.Do("version"))
 		if err != nil {
@@ -270,6 +308,86 @@ func doSysCommand(conn *uhatools.Conn, cmd string) (exit bool) {
 	return false
 }
 
+// doPlanCommand draws the query plan of the statement as a tree, in the same
+// way as sqlite3, and flags the full table scans. When there are full table
+// scans, the indexes that are suggested by ADVISE follow the tree.
+func doPlanCommand(conn *uhatools.Conn, sql string) {
+	v, err := conn.Do("$any", "explain query plan "+sql)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", cleanErr(err))
+		return
+	}
+	rss, _ := v.([]interface{})
+	if len(rss) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: .plan requires a single statement\n")
+		return
+	}
+	rows, _ := rss[0].([]interface{})
+	type planRow struct {
+		id     int
+		detail string
+	}
+	children := make(map[int][]planRow)
+	for i := 1; i < len(rows); i++ {
+		cols, _ := uhatools.Strings(rows[i], nil)
+		if len(cols) < 4 {
+			continue
+		}
+		id, _ := strconv.Atoi(cols[0])
+		parent, _ := strconv.Atoi(cols[1])
+		children[parent] = append(children[parent], planRow{id, cols[3]})
+	}
+	var scans bool
+	var draw func(parent int, prefix string)
+	draw = func(parent int, prefix string) {
+		rows := children[parent]
+		for i, row := range rows {
+			branch, indent := "|--", "|  "
+			if i == len(rows)-1 {
+				branch, indent = "`--", "   "
+			}
+			detail := row.detail
+			if fullScan(detail) {
+				detail += "  (full table scan)"
+				scans = true
+			}
+			fmt.Printf("%s%s%s\n", prefix, branch, detail)
+			if row.id != parent {
+				draw(row.id, prefix+indent)
+			}
+		}
+	}
+	fmt.Printf("QUERY PLAN\n")
+	draw(0, "")
+	if !scans || !strings.HasPrefix(strings.ToLower(sql), "select") {
+		return
+	}
+	stmts, err := uhatools.Strings(conn.Do("advise", sql))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", cleanErr(err))
+		return
+	}
+	if len(stmts) > 0 {
+		fmt.Printf("\nSuggested indexes:\n")
+		for _, stmt := range stmts {
+			fmt.Printf("  %s;\n", stmt)
+		}
+	}
+}
+
+// fullScan returns true if the detail of a query plan row is a full scan of
+// a table.
+func fullScan(detail string) bool {
+	if !strings.HasPrefix(detail, "SCAN ") ||
+		strings.Contains(detail, "VIRTUAL TABLE") {
+		return false
+	}
+	name := strings.TrimPrefix(detail[5:], "TABLE ")
+	return !strings.HasPrefix(name, "(") &&
+		!strings.HasPrefix(name, "CONSTANT ROW") &&
+		!strings.HasPrefix(name, "SUBQUERY")
+}
+
 func doProcSetCommand(conn *uhatools.Conn, cmd string) {
 	scriptMultilineMode = false
 	cmd = scriptLinesPrefix + strconv.Quote(cmd[len(scriptLinesPrefix):])
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tidwall/uhaha"
+)
+
+// sqlToken is a token of a sql statement. The kind is 'w' for a word, which
+// is a keyword or an identifier, 'v' for a value, which is a literal or a
+// parameter, and 'o' for an operator or punctuation.
+type sqlToken struct {
+	kind   byte
+	text   string
+	quoted bool // the word is a quoted identifier
+}
+
+// sqlTokens splits the sql into tokens. Comments are removed.
+func sqlTokens(sql string) []sqlToken {
+	var toks []sqlToken
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			e := strings.Index(sql[i+2:], "*/")
+			if e == -1 {
+				return toks
+			}
+			i += e + 4
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			q := c
+			if q == '[' {
+				q = ']'
+			}
+			var text []byte
+			j := i + 1
+			for ; j < len(sql); j++ {
+				if sql[j] == q {
+					if q != ']' && j+1 < len(sql) && sql[j+1] == q {
+						text = append(text, q)
+						j++
+						continue
+					}
+					break
+				}
+				text = append(text, sql[j])
+			}
+			if c == '\'' {
+				toks = append(toks, sqlToken{kind: 'v', text: string(text)})
+			} else {
+				toks = append(toks, sqlToken{kind: 'w', text: string(text),
+					quoted: true})
+			}
+			i = j + 1
+		case isWordByte(c):
+			j := i
+			for j < len(sql) && isWordByte(sql[j]) {
+				j++
+			}
+			kind := byte('w')
+			if c >= '0' && c <= '9' {
+				kind = 'v'
+			}
+			toks = append(toks, sqlToken{kind: kind, text: sql[i:j]})
+			i = j
+		case c == '?' || c == ':' || c == '@':
+			j := i + 1
+			for j < len(sql) && isWordByte(sql[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{kind: 'v', text: sql[i:j]})
+			i = j
+		default:
+			n := 1
+			if i+1 < len(sql) {
+				switch sql[i : i+2] {
+				case "<=", ">=", "==", "!=", "<>", "||", "<<", ">>":
+					n = 2
+				}
+			}
+			toks = append(toks, sqlToken{kind: 'o', text: sql[i : i+n]})
+			i += n
+		}
+	}
+	return toks
+}
+
+func isWordByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '_' || c == '$' || c >= 0x80
+}
+
+// adviseKeywords are the keywords that can't be a table alias or a column.
+var adviseKeywords = map[string]bool{
+	"all": true, "and": true, "as": true, "asc": true, "between": true,
+	"by": true, "case": true, "cross": true, "desc": true, "distinct": true,
+	"else": true, "end": true, "escape": true, "except": true,
+	"exists": true, "from": true, "full": true, "glob": true, "group": true,
+	"having": true, "in": true, "indexed": true, "inner": true,
+	"intersect": true, "is": true, "isnull": true, "join": true,
+	"left": true, "like": true, "limit": true, "match": true,
+	"natural": true, "not": true, "notnull": true, "null": true,
+	"offset": true, "on": true, "or": true, "order": true, "outer": true,
+	"regexp": true, "right": true, "select": true, "then": true,
+	"union": true, "using": true, "values": true, "when": true,
+	"where": true, "window": true, "with": true,
+}
+
+// keyword returns the lowercase keyword of the token, or empty when the token
+// is not a keyword.
+func (tok sqlToken) keyword() string {
+	if tok.kind != 'w' || tok.quoted {
+		return ""
+	}
+	if kw := strings.ToLower(tok.text); adviseKeywords[kw] {
+		return kw
+	}
+	return ""
+}
+
+// ident returns true if the token is an identifier.
+func (tok sqlToken) ident() bool {
+	return tok.kind == 'w' && tok.keyword() == ""
+}
+
+// sqlAliases returns the tables of the aliases in the from clauses, keyed by
+// the lowercase alias.
+func sqlAliases(toks []sqlToken) map[string]string {
+	aliases := make(map[string]string)
+	var from bool
+	for i := 0; i < len(toks); i++ {
+		switch toks[i].keyword() {
+		case "from", "join":
+			from = true
+		case "":
+			if toks[i].kind == 'o' && toks[i].text != "," &&
+				toks[i].text != "." {
+				from = false
+			}
+		default:
+			from = false
+		}
+		if !from || !toks[i].ident() {
+			continue
+		}
+		// A table follows from, join, or a comma, and may be qualified by
+		// the schema.
+		if i == 0 || (toks[i-1].keyword() == "" && toks[i-1].text != ",") {
+			continue
+		}
+		j := i
+		if j+2 < len(toks) && toks[j+1].text == "." && toks[j+2].ident() {
+			j += 2
+		}
+		table := toks[j].text
+		k := j + 1
+		if k < len(toks) && toks[k].keyword() == "as" {
+			k++
+		}
+		if k < len(toks) && toks[k].ident() {
+			aliases[strings.ToLower(toks[k].text)] = table
+			j = k
+		}
+		aliases[strings.ToLower(table)] = table
+		i = j
+	}
+	return aliases
+}
+
+// sqlPredicates returns the columns of the table, which uses the alias, that
+// are compared to a value in the where and on clauses by equality or by a
+// range. The join columns are compared to the column of another table. The
+// order columns are the order by columns, which is empty when any of them is
+// not a column of the table.
+func sqlPredicates(toks []sqlToken, table, alias string, cols map[string]bool,
+) (eq, rng, join, order []string) {
+	// column returns the column at the position of the tokens and the
+	// position after the column. The column is empty when the tokens are not
+	// a column of the table.
+	column := func(i int) (string, int) {
+		if !toks[i].ident() {
+			return "", i + 1
+		}
+		if i+2 < len(toks) && toks[i+1].text == "." {
+			q := toks[i].text
+			if !strings.EqualFold(q, table) && !strings.EqualFold(q, alias) {
+				return "", i + 3
+			}
+			i += 2
+			if !toks[i].ident() {
+				return "", i + 1
+			}
+		}
+		if i+1 < len(toks) && toks[i+1].text == "(" {
+			// A function call
+			return "", i + 1
+		}
+		if !cols[strings.ToLower(toks[i].text)] {
+			return "", i + 1
+		}
+		return strings.ToLower(toks[i].text), i + 1
+	}
+	// operand returns true if the tokens at the position are a column of any
+	// table.
+	operand := func(i int) bool {
+		return i >= 0 && i < len(toks) && toks[i].ident() &&
+			(i+1 == len(toks) || toks[i+1].text != "(")
+	}
+	add := func(list []string, col string) []string {
+		for _, c := range list {
+			if c == col {
+				return list
+			}
+		}
+		return append(list, col)
+	}
+	var clause string
+	var orderOK bool
+	for i := 0; i < len(toks); {
+		switch toks[i].keyword() {
+		case "where", "on":
+			clause = "pred"
+			i++
+			continue
+		case "order":
+			if i+1 < len(toks) && toks[i+1].keyword() == "by" {
+				clause = "order"
+				orderOK = true
+				order = nil
+				i += 2
+				continue
+			}
+		case "select", "from", "join", "group", "having", "limit",
+			"union", "except", "intersect", "window", "using":
+			clause = ""
+		}
+		if toks[i].text == "(" || toks[i].text == ")" {
+			if clause == "order" {
+				orderOK = false
+			}
+			i++
+			continue
+		}
+		start := i
+		col, next := column(i)
+		if col == "" || clause == "" {
+			if clause == "order" && toks[i].kind != 'o' &&
+				toks[i].keyword() != "asc" && toks[i].keyword() != "desc" {
+				orderOK = false
+			}
+			i = next
+			continue
+		}
+		i = next
+		if clause == "order" {
+			order = add(order, col)
+			continue
+		}
+		// The operator either follows the column or comes before it.
+		var op string
+		other := -1
+		if i < len(toks) {
+			op = strings.ToLower(toks[i].text)
+			other = i + 1
+		}
+		switch op {
+		case "=", "==", "<", ">", "<=", ">=", "is", "in", "between":
+		default:
+			if start > 0 {
+				op = strings.ToLower(toks[start-1].text)
+				other = start - 2
+			}
+		}
+		switch op {
+		case "=", "==", "is", "in":
+			if op == "is" && other < len(toks) &&
+				toks[other].keyword() == "not" {
+				continue
+			}
+			if operand(other) && (op == "=" || op == "==") {
+				join = add(join, col)
+			} else {
+				eq = add(eq, col)
+			}
+		case "<", ">", "<=", ">=", "between":
+			if !operand(other) {
+				rng = add(rng, col)
+			}
+		}
+	}
+	if !orderOK {
+		order = nil
+	}
+	return eq, rng, join, order
+}
+
+// planScan returns the table and alias of a full table scan in the detail
+// of a query plan row, or empty when the row is not a full table scan. The
+// table is the alias when the detail does not include the table.
+func planScan(detail string) (table, alias string) {
+	if !strings.HasPrefix(detail, "SCAN ") ||
+		strings.Contains(detail, "VIRTUAL TABLE") {
+		return "", ""
+	}
+	fields := strings.Fields(strings.TrimPrefix(detail[5:], "TABLE "))
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "(") ||
+		fields[0] == "CONSTANT" || fields[0] == "SUBQUERY" {
+		return "", ""
+	}
+	table, alias = fields[0], fields[0]
+	if len(fields) > 2 && fields[1] == "AS" {
+		alias = fields[2]
+	}
+	return table, alias
+}
+
+// ADVISE sql
+// help: suggests indexes for the select statement. The query plan is used to
+// find the tables that are fully scanned, and each suggestion is an index on
+// the columns that the statement compares to values, or that join or order
+// the table, unless the table already has such an index.
+func cmdADVISE(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	sql := strings.TrimSpace(strings.Join(args[1:], " "))
+	stmts, _, err := sqlStatements(sql)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) != 1 || sqlCommand(stmts[0]) != "select" {
+		return nil, errors.New("ADVISE requires a single select statement")
+	}
+	sql = stmts[0]
+	user, err := connUser(m)
+	if err != nil {
+		return nil, err
+	}
+	var db *sqlDatabase
+	if name := conn(m).db; name != "" {
+		rlockDB()
+		defer dbmu.RUnlock()
+		d, err := lookupDB(name)
+		if err != nil {
+			return nil, err
+		}
+		db, err = d.takeReader()
+		if err != nil {
+			return nil, err
+		}
+		defer d.releaseReader(db)
+	} else {
+		db, err = takeReaderDB()
+		if err != nil {
+			return nil, err
+		}
+		defer releaseReaderDB(db)
+		rlockDB()
+		defer dbmu.RUnlock()
+	}
+	var plan []string
+	db.sandbox(user)
+	err = db.exec("explain query plan "+sql, func(row []string) bool {
+		plan = append(plan, row[3])
+		return true
+	})
+	db.endSandbox()
+	if err != nil {
+		return nil, err
+	}
+	var orderTemp bool
+	for _, detail := range plan[1:] {
+		if detail == "USE TEMP B-TREE FOR ORDER BY" {
+			orderTemp = true
+		}
+	}
+	toks := sqlTokens(sql)
+	aliases := sqlAliases(toks)
+	res := []string{}
+	for _, detail := range plan[1:] {
+		table, alias := planScan(detail)
+		if table == "" {
+			continue
+		}
+		if t, ok := aliases[strings.ToLower(table)]; ok {
+			table = t
+		}
+		cols, err := db.tableColumns(table)
+		if err != nil {
+			return nil, err
+		}
+		if len(cols) == 0 {
+			continue
+		}
+		eq, rng, join, order := sqlPredicates(toks, table, alias, cols)
+		var index []string
+		switch {
+		case len(eq) > 0 || len(rng) > 0:
+			index = eq
+			if len(rng) > 0 {
+				index = append(index, rng[0])
+			} else if orderTemp {
+				index = append(index, order...)
+			}
+		case len(join) > 0:
+			index = join
+		case orderTemp:
+			index = order
+		}
+		if len(index) == 0 {
+			continue
+		}
+		exists, err := db.hasIndex(table, index)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		var qcols []string
+		for _, col := range index {
+			qcols = append(qcols, quoteIdent(col))
+		}
+		stmt := "CREATE INDEX " +
+			quoteIdent("idx_"+table+"_"+strings.Join(index, "_")) +
+			" ON " + quoteIdent(table) + " (" + strings.Join(qcols, ", ") +
+			")"
+		for _, s := range res {
+			if s == stmt {
+				stmt = ""
+			}
+		}
+		if stmt != "" {
+			res = append(res, stmt)
+		}
+	}
+	return res, nil
+}
+
+// tableColumns returns the lowercase column names of the table, which is
+// empty when there is no such table.
+func (db *sqlDatabase) tableColumns(table string) (map[string]bool, error) {
+	cols := make(map[string]bool)
+	var header bool
+	err := db.exec("pragma table_info("+quoteIdent(table)+")",
+		func(row []string) bool {
+			if header {
+				cols[strings.ToLower(row[1])] = true
+			}
+			header = true
+			return true
+		})
+	return cols, err
+}
+
+// hasIndex returns true if the table has an index that starts with the
+// columns.
+func (db *sqlDatabase) hasIndex(table string, cols []string) (bool, error) {
+	var names []string
+	err := db.exec("pragma index_list("+quoteIdent(table)+")",
+		func(row []string) bool {
+			names = append(names, row[1])
+			return true
+		})
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names[1:] {
+		var icols []string
+		err := db.exec("pragma index_info("+quoteIdent(name)+")",
+			func(row []string) bool {
+				icols = append(icols, strings.ToLower(row[2]))
+				return true
+			})
+		if err != nil {
+			return false, err
+		}
+		icols = icols[1:]
+		if len(icols) < len(cols) {
+			continue
+		}
+		match := true
+		for i, col := range cols {
+			if icols[i] != col {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// auditQueryLimit is the default number of entries that are returned by
+// AUDIT QUERY.
+const auditQueryLimit = 100
+
+// auditEntry is a write command from a client that is recorded in the audit
+// log once the command is done.
+type auditEntry struct {
+	addr    string // remote address of the client
+	user    string // user of the client, empty for no user
+	command string // such as EXEC or PROC
+	args    string // JSON array of the args, or of the statements for EXEC
+}
+
+// cmdAudit is the entry for the running write command, which is set by
+// cmdEXEC and userCommand. Protected by the dbmu lock.
+var cmdAudit *auditEntry
+
+// auditEnabled is true when the audit log is turned on by AUDIT ON. Protected
+// by the dbmu lock.
+var auditEnabled bool
+
+func (db *sqlDatabase) ensureAuditSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __audit__ (
+			id         INTEGER PRIMARY KEY,
+			ts         INTEGER,
+			idx        INTEGER,
+			addr       TEXT,
+			user       TEXT,
+			command    TEXT,
+			args       TEXT,
+			error      TEXT
+		);
+	`, nil)
+}
+
+// loadAudit loads the audit setting. The dbmu lock must be held.
+func loadAudit() error {
+	on, err := wdb.readMeta("audit")
+	if err != nil {
+		return err
+	}
+	auditEnabled = on == 1
+	return nil
+}
+
+// auditArgs returns the args of a command as a JSON array. The password salt
+// and hash of USER CREATE are not recorded.
+func auditArgs(command string, args []string) string {
+	if command == "USER" && len(args) == 5 &&
+		strings.ToLower(args[0]) == "create" {
+		args = []string{args[0], args[1], "*", "*", args[4]}
+	}
+	data, _ := json.Marshal(args)
+	return string(data)
+}
+
+// writeAudit records the entry of the write command along with its error, if
+// any, in the same transaction as the command. The entry uses the machine
+// time and the applied index, which keeps the audit log identical on every
+// server. AUDIT itself is always recorded.
+func (db *sqlDatabase) writeAudit(cmdErr error) error {
+	e := cmdAudit
+	cmdAudit = nil
+	if e == nil {
+		return nil
+	}
+	return db.recordAudit(e, cmdErr)
+}
+
+// recordAudit records an entry along with its error, if any. It's also used
+// for the writes of a tick, such as the scheduled jobs, which have no address
+// or user.
+func (db *sqlDatabase) recordAudit(e *auditEntry, cmdErr error) error {
+	if !auditEnabled && e.command != "AUDIT" {
+		return nil
+	}
+	var errmsg interface{}
+	if cmdErr != nil {
+		errmsg = cmdErr.Error()
+	}
+	return db.execArgs(`insert into __audit__
+		(ts, idx, addr, user, command, args, error)
+		values (?, ?, ?, ?, ?, ?, ?)`,
+		[]interface{}{machineTime().UnixNano(), int64(applied), e.addr,
+			e.user, e.command, e.args, errmsg}, nil)
+}
+
+// AUDIT ON|OFF
+// help: turns the audit log on or off. Every write from a client, which is
+// each statement, proc, and admin command, is recorded in the __audit__
+// table of the database that it writes to, along with the address and user
+// of the client, the Raft index, and the outcome. The scheduled jobs and the
+// expired rows are also recorded.
+//
+// AUDIT QUERY [USER name] [COMMAND name] [SINCE time] [UNTIL time] [LIMIT n]
+// help: returns the newest entries of the audit log of the database of the
+// connection. The times use the RFC 3339 format.
+func cmdAUDIT(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try AUDIT HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "query":
+		return cmdAUDITQUERY(m, args)
+	case "help":
+		return cmdAUDITHELP(m, args)
+	}
+	return uhaha.FilterArgs(userArgs(m, "$AUDIT", args)), nil
+}
+
+func cmdAUDITQUERY(m uhaha.Machine, args []string) (interface{}, error) {
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	where := []string{"1"}
+	var sqlArgs []interface{}
+	limit := int64(auditQueryLimit)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, errors.New("wrong number of arguments, " +
+				"try AUDIT HELP")
+		}
+		opt, val := strings.ToLower(args[i]), args[i+1]
+		switch opt {
+		case "user", "command":
+			where = append(where, opt+" = ?")
+			if opt == "command" {
+				val = strings.ToUpper(val)
+			}
+			sqlArgs = append(sqlArgs, val)
+		case "since", "until":
+			t, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time '%s'", val)
+			}
+			if opt == "since" {
+				where = append(where, "ts >= ?")
+			} else {
+				where = append(where, "ts < ?")
+			}
+			sqlArgs = append(sqlArgs, t.UnixNano())
+		case "limit":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid limit '%s'", val)
+			}
+			limit = n
+		default:
+			return nil, fmt.Errorf("unknown audit option '%s', "+
+				"try AUDIT HELP", args[i])
+		}
+	}
+	sql := `select id, strftime('%Y-%m-%dT%H:%M:%fZ', ts / 1000000000.0,
+		'unixepoch') as time, idx, addr, user, command, args, error
+		from __audit__ where ` + strings.Join(where, " and ") +
+		` order by id desc limit ?`
+	stmt := append([]interface{}{sql}, append(sqlArgs, limit)...)
+	data, _ := json.Marshal([]interface{}{stmt})
+	return uhaha.FilterArgs(conn(m).options("$QUERY", string(data))), nil
+}
+
+func cmdAUDITHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try AUDIT HELP")
+	}
+	return []string{
+		"AUDIT ON|OFF",
+		"AUDIT QUERY [USER name] [COMMAND name] [SINCE time] [UNTIL time] " +
+			"[LIMIT n]",
+	}, nil
+}
+
+// AUDIT ON     -- records the writes from clients in the __audit__ table
+// AUDIT OFF    -- stops recording
+func cmdAUDITWRITE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try AUDIT HELP")
+	}
+	var on bool
+	switch strings.ToLower(args[1]) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return nil, fmt.Errorf("unknown audit command '%s %s', "+
+			"try AUDIT HELP", args[0], args[1])
+	}
+	var value int64
+	if on {
+		value = 1
+	}
+	err := wdb.execArgs(`replace into __meta__ (name, value)
+		values ('audit', ?)`, []interface{}{value}, nil)
+	if err != nil {
+		return nil, err
+	}
+	auditEnabled = on
+	return redcon.SimpleString("OK"), nil
+}
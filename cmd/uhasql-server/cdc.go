@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/tidwall/uhaha"
+)
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+// extern void uhasqlPreupdate(void *ctx, sqlite3 *db, int op, char *zdb,
+//     char *ztable, sqlite3_int64 key1, sqlite3_int64 key2);
+import "C"
+
+// cdcMaxChanges is the max number of changes kept in the __cdc__ table. It
+// must be the same on every server in the cluster.
+const cdcMaxChanges = 100000
+
+// cdcPageSize is the max number of changes read at a time by a subscriber.
+const cdcPageSize = 1000
+
+// cdcChange is a row change captured by the preupdate hook.
+type cdcChange struct {
+	table    string
+	op       string
+	rowid    int64
+	old      []interface{}
+	new      []interface{}
+	internal bool // only for the checksum, not written to the __cdc__ table
+}
+
+// cdcPending are the changes that are recorded while a write command is
+// running. They are written to the __cdc__ table when the command completes.
+var cdcPending []cdcChange
+
+// checksumTable returns true for the internal tables whose changes are
+// folded into the checksum, which are the ones that are changed by the procs
+// and admin commands. The other internal tables are written after the
+// checksum is folded, or only record what was already folded.
+func checksumTable(name string) bool {
+	switch name {
+	case "__proc__", "__ttl__", "__schedule__", "__refdb__",
+		"__extensions__", "__users__", "__grants__":
+		return true
+	}
+	return false
+}
+
+// internalTable returns true for the tables that are used by UhaSQL.
+func internalTable(name string) bool {
+	switch name {
+	case "__proc__", "__meta__", "__cdc__", "__ttl__", "__schedule__",
+		"__refdb__", "__extensions__", "__users__", "__grants__", "__audit__":
+		return true
+	}
+	return false
+}
+
+func (db *sqlDatabase) ensureCDCSpace() error {
+	err := db.exec(`
+		CREATE TABLE IF NOT EXISTS __cdc__ (
+			id         INTEGER PRIMARY KEY,
+			idx        INTEGER,
+			tbl        TEXT,
+			op         TEXT,
+			row        INTEGER,
+			old        TEXT,
+			new        TEXT
+		);
+	`, nil)
+	if err != nil {
+		return err
+	}
+	C.sqlite3_preupdate_hook(db.db,
+		(*[0]byte)(unsafe.Pointer(C.uhasqlPreupdate)), nil)
+	return nil
+}
+
+//export uhasqlPreupdate
+func uhasqlPreupdate(ctx unsafe.Pointer, db *C.sqlite3, op C.int,
+	zdb, ztable *C.char, key1, key2 C.sqlite3_int64,
+) {
+	if !recording || C.GoString(zdb) != "main" {
+		return
+	}
+	change := cdcChange{table: C.GoString(ztable), rowid: int64(key1)}
+	if internalTable(change.table) {
+		if !checksumTable(change.table) {
+			return
+		}
+		change.internal = true
+	}
+	switch op {
+	case C.SQLITE_INSERT:
+		change.op = "insert"
+		change.rowid = int64(key2)
+		change.new = preupdateValues(db, true)
+	case C.SQLITE_UPDATE:
+		change.op = "update"
+		change.rowid = int64(key2)
+		change.old = preupdateValues(db, false)
+		change.new = preupdateValues(db, true)
+	case C.SQLITE_DELETE:
+		change.op = "delete"
+		change.old = preupdateValues(db, false)
+	default:
+		return
+	}
+	cdcPending = append(cdcPending, change)
+}
+
+// preupdateValues returns the old or new values of the row that is being
+// changed.
+func preupdateValues(db *C.sqlite3, new bool) []interface{} {
+	n := int(C.sqlite3_preupdate_count(db))
+	vals := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		var val *C.sqlite3_value
+		var rc C.int
+		if new {
+			rc = C.sqlite3_preupdate_new(db, C.int(i), &val)
+		} else {
+			rc = C.sqlite3_preupdate_old(db, C.int(i), &val)
+		}
+		if rc != C.SQLITE_OK || val == nil {
+			continue
+		}
+		switch C.sqlite3_value_type(val) {
+		case C.SQLITE_INTEGER:
+			vals[i] = int64(C.sqlite3_value_int64(val))
+		case C.SQLITE_FLOAT:
+			vals[i] = float64(C.sqlite3_value_double(val))
+		case C.SQLITE_TEXT:
+			text := C.sqlite3_value_text(val)
+			vals[i] = C.GoString((*C.char)(unsafe.Pointer(text)))
+		case C.SQLITE_BLOB:
+			blob := C.sqlite3_value_blob(val)
+			data := C.GoBytes(blob, C.sqlite3_value_bytes(val))
+			vals[i] = map[string]string{
+				"blob": base64.StdEncoding.EncodeToString(data),
+			}
+		}
+	}
+	return vals
+}
+
+// cdcFlush writes the recorded changes to the __cdc__ table using the
+// applied index of the command. The oldest changes are removed when the table
+// is too big.
+func (db *sqlDatabase) cdcFlush() error {
+	if len(cdcPending) == 0 {
+		return nil
+	}
+	defer func() { cdcPending = cdcPending[:0] }()
+	columns := make(map[string][]string)
+	for _, change := range cdcPending {
+		if change.internal {
+			continue
+		}
+		names, ok := columns[change.table]
+		if !ok {
+			err := db.execArgs(`select name from pragma_table_info(?)`,
+				[]interface{}{change.table}, func(row []string) bool {
+					names = append(names, row[0])
+					return true
+				})
+			if err != nil {
+				return err
+			}
+			if len(names) > 0 {
+				names = names[1:]
+			}
+			columns[change.table] = names
+		}
+		args := []interface{}{int64(applied), change.table, change.op,
+			change.rowid, cdcValues(names, change.old),
+			cdcValues(names, change.new)}
+		err := db.execArgs(`insert into __cdc__ (idx, tbl, op, row, old, new)
+			values (?, ?, ?, ?, ?, ?)`, args, nil)
+		if err != nil {
+			return err
+		}
+	}
+	var maxID int64
+	err := db.exec(`select max(id) from __cdc__`, func(row []string) bool {
+		maxID, _ = strconv.ParseInt(row[0], 10, 64)
+		return true
+	})
+	if err != nil || maxID <= cdcMaxChanges {
+		return err
+	}
+	cutoff := maxID - cdcMaxChanges
+	err = db.execArgs(`replace into __meta__ (name, value)
+		select 'cdc_trimmed', max(idx) from __cdc__ where id <= ?`,
+		[]interface{}{cutoff}, nil)
+	if err != nil {
+		return err
+	}
+	return db.execArgs(`delete from __cdc__ where id <= ?`,
+		[]interface{}{cutoff}, nil)
+}
+
+// cdcValues returns the row values as a JSON object, or nil if there are no
+// values.
+func cdcValues(names []string, vals []interface{}) interface{} {
+	if vals == nil {
+		return nil
+	}
+	obj := make(map[string]interface{}, len(vals))
+	for i, val := range vals {
+		if i < len(names) {
+			obj[names[i]] = val
+		} else {
+			obj[strconv.Itoa(i)] = val
+		}
+	}
+	data, _ := json.Marshal(obj)
+	return string(data)
+}
+
+// CDC SUBSCRIBE [from-index] [table ...]
+// help: streams the row changes for all tables, or for the provided tables.
+// The changes start at the from-index, which is the applied index of a write.
+// Without a from-index, only new changes are streamed. A client can resume
+// from where it left off by using the index of the last change plus one.
+// The changes are of the database that is selected with USE.
+func cmdCDC(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if strings.ToLower(args[1]) != "subscribe" {
+		return nil, fmt.Errorf("unknown CDC command '%s'", args[1])
+	}
+	// The changes of every table are readable.
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	args = args[2:]
+	var from uint64
+	if len(args) > 0 {
+		if n, err := strconv.ParseUint(args[0], 10, 64); err == nil {
+			from = n
+			args = args[1:]
+		}
+	}
+	tables := make(map[string]bool)
+	for _, table := range args {
+		tables[table] = true
+	}
+	name := conn(m).db
+	db, release, err := cdcReader(name)
+	if err != nil {
+		return nil, err
+	}
+	if from == 0 {
+		from = applied + 1
+	}
+	trimmed, err := db.readMeta("cdc_trimmed")
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if trimmed > 0 && from <= uint64(trimmed) {
+		return nil, fmt.Errorf("changes up to index %d are no longer "+
+			"available", trimmed)
+	}
+	return uhaha.Hijack(func(s uhaha.Service, conn uhaha.HijackedConn) {
+		cdcStream(conn, name, from, tables)
+	}), nil
+}
+
+// cdcReader returns a reader of the named database, or of the default
+// database for an empty name, while holding the dbmu read lock. The release
+// function unlocks and returns the reader.
+func cdcReader(name string) (*sqlDatabase, func(), error) {
+	if name == "" {
+		db, err := takeReaderDB()
+		if err != nil {
+			return nil, nil, err
+		}
+		rlockDB()
+		return db, func() {
+			dbmu.RUnlock()
+			releaseReaderDB(db)
+		}, nil
+	}
+	rlockDB()
+	d, err := lookupDB(name)
+	if err != nil {
+		dbmu.RUnlock()
+		return nil, nil, err
+	}
+	db, err := d.takeReader()
+	if err != nil {
+		dbmu.RUnlock()
+		return nil, nil, err
+	}
+	return db, func() {
+		d.releaseReader(db)
+		dbmu.RUnlock()
+	}, nil
+}
+
+// cdcStream writes the changes of the named database to the connection until
+// the client disconnects.
+func cdcStream(conn uhaha.HijackedConn, name string, from uint64,
+	tables map[string]bool,
+) {
+	defer conn.Close()
+	done := make(chan bool)
+	go func() {
+		// Any command, other than PING, ends the stream.
+		defer close(done)
+		for {
+			args, err := conn.ReadCommand()
+			if err != nil || len(args) == 0 ||
+				strings.ToLower(args[0]) != "ping" {
+				return
+			}
+		}
+	}()
+	conn.WriteAny([]interface{}{"subscribe", int64(from)})
+	var lastID int64
+	for {
+		if err := conn.Flush(); err != nil {
+			return
+		}
+		changes, seen, err := cdcRead(name, from, lastID)
+		if err != nil {
+			conn.WriteAny(err)
+			conn.Flush()
+			return
+		}
+		for _, change := range changes {
+			lastID = change[0].(int64)
+			if len(tables) > 0 && !tables[change[2].(string)] {
+				continue
+			}
+			conn.WriteAny(append([]interface{}{"change"}, change[1:]...))
+		}
+		if len(changes) == cdcPageSize {
+			continue
+		}
+		if err := conn.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		err = waitApplied(seen+1, time.Second)
+		if err != nil && err != errSessionTimeout {
+			return
+		}
+	}
+}
+
+// cdcRead reads the next page of changes of the named database. Also returns
+// the applied index at the time of the read.
+func cdcRead(name string, from uint64, lastID int64) (
+	changes [][]interface{}, seen uint64, err error,
+) {
+	db, release, err := cdcReader(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+	seen = applied
+	var header bool
+	err = db.execArgs(`select id, idx, tbl, op, row, old, new from __cdc__
+		where id > ? and idx >= ? order by id limit ?`,
+		[]interface{}{lastID, int64(from), int64(cdcPageSize)},
+		func(row []string) bool {
+			if !header {
+				header = true
+				return true
+			}
+			id, _ := strconv.ParseInt(row[0], 10, 64)
+			idx, _ := strconv.ParseInt(row[1], 10, 64)
+			rowid, _ := strconv.ParseInt(row[4], 10, 64)
+			var old, new interface{}
+			if row[5] != "" {
+				old = row[5]
+			}
+			if row[6] != "" {
+				new = row[6]
+			}
+			changes = append(changes, []interface{}{id, idx, row[2],
+				row[3], rowid, old, new})
+			return true
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return changes, seen, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/uhaha"
+	"github.com/tidwall/uhatools"
+)
+
+// checksumMaxLen is the number of checksums that are kept in memory.
+const checksumMaxLen = 100
+
+// checksumCheckInterval is how often the checksums of the servers are
+// compared.
+const checksumCheckInterval = time.Second * 10
+
+// checksumTimeout is the max time for getting the checksums of a server.
+const checksumTimeout = time.Second * 5
+
+// checksumIntervalFlag is the number of Raft indexes between checksums,
+// which is provided by the --checksum-interval flag. Zero turns off the
+// checksums.
+var checksumIntervalFlag int
+
+// checksumEntry is the checksum of the databases at an applied index.
+type checksumEntry struct {
+	index uint64
+	sum   uint64
+}
+
+// checksums are the newest checksums of this server, oldest first.
+// Protected by the checksumMu lock.
+var checksumMu sync.Mutex
+var checksums []checksumEntry
+
+// clusterDial has what is needed to connect to this server and the other
+// servers in the cluster. Set when the server is ready.
+var clusterDial struct {
+	addr   string
+	auth   string
+	tlscfg *tls.Config
+}
+
+// foldChecksum folds the error, the row changes, and the schema version of a
+// write into the rolling checksum of the database, which is kept in the
+// __meta__ table. The row changes include the internal tables that are
+// changed by the procs and admin commands, and the schema version covers the
+// DDL. The result of the write is not included, because it has values of the
+// connection, such as the total changes, which restart at zero along with
+// the server. It must be called before the changes are flushed.
+func (db *sqlDatabase) foldChecksum(cmdErr error) error {
+	prev, err := db.readMeta("checksum")
+	if err != nil {
+		return err
+	}
+	var version string
+	err = db.exec("pragma schema_version", func(row []string) bool {
+		version = row[0]
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(prev))
+	h.Write(buf[:])
+	h.Write([]byte(version))
+	if cmdErr != nil {
+		h.Write([]byte(cmdErr.Error()))
+	}
+	for _, change := range cdcPending {
+		data, _ := json.Marshal([]interface{}{change.table, change.op,
+			change.rowid, change.old, change.new})
+		h.Write(data)
+	}
+	return db.execArgs(`replace into __meta__ (name, value)
+		values ('checksum', ?)`, []interface{}{int64(h.Sum64())}, nil)
+}
+
+// recordChecksum records the checksum of every database when the applied
+// index is at a checksum interval. Nothing is recorded while the Raft log is
+// replayed over a database that already has the commands. The dbmu lock must
+// be held.
+func recordChecksum() {
+	if checksumIntervalFlag == 0 || applied%uint64(checksumIntervalFlag) != 0 {
+		return
+	}
+	if applied <= persisted {
+		return
+	}
+	names := make([]string, 0, len(dbs))
+	for name, d := range dbs {
+		if applied <= d.persisted {
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	var buf [8]byte
+	writers := []*sqlDatabase{wdb}
+	for _, name := range names {
+		writers = append(writers, dbs[name].wdb)
+	}
+	for i, w := range writers {
+		sum, err := w.readMeta("checksum")
+		if err != nil {
+			logger.Warningf("checksum: %s", err)
+			return
+		}
+		if i > 0 {
+			h.Write([]byte(names[i-1]))
+		}
+		binary.LittleEndian.PutUint64(buf[:], uint64(sum))
+		h.Write(buf[:])
+	}
+	checksumMu.Lock()
+	checksums = append(checksums, checksumEntry{applied, h.Sum64()})
+	if len(checksums) > checksumMaxLen {
+		checksums = append(checksums[:0],
+			checksums[len(checksums)-checksumMaxLen:]...)
+	}
+	checksumMu.Unlock()
+}
+
+// serverChecksums are the checksums of a server in the cluster.
+type serverChecksums struct {
+	id   string
+	addr string
+	sums map[uint64]string // hex checksum by index
+	err  error
+}
+
+// clusterChecksums returns the checksums of every server in the cluster,
+// including this server.
+func clusterChecksums() ([]*serverChecksums, error) {
+	conn, err := uhaha.RedisDial(clusterDial.addr, clusterDial.auth,
+		clusterDial.tlscfg)
+	if err != nil {
+		return nil, err
+	}
+	list, err := uhatools.Values(conn.Do("raft", "server", "list"))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	var servers []*serverChecksums
+	for _, v := range list {
+		vals, err := uhatools.Strings(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		s := new(serverChecksums)
+		for i := 0; i+1 < len(vals); i += 2 {
+			switch vals[i] {
+			case "id":
+				s.id = vals[i+1]
+			case "address":
+				s.addr = vals[i+1]
+			}
+		}
+		servers = append(servers, s)
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *serverChecksums) {
+			defer wg.Done()
+			s.sums, s.err = serverSums(s.addr)
+		}(s)
+	}
+	wg.Wait()
+	return servers, nil
+}
+
+// serverSums returns the checksums of a server, using CHECKSUM LOCAL.
+func serverSums(addr string) (map[uint64]string, error) {
+	type result struct {
+		sums map[uint64]string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := uhaha.RedisDial(addr, clusterDial.auth,
+			clusterDial.tlscfg)
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		defer conn.Close()
+		vals, err := uhatools.Strings(conn.Do("checksum", "local"))
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		sums := make(map[uint64]string)
+		for i := 0; i+1 < len(vals); i += 2 {
+			index, err := strconv.ParseUint(vals[i], 10, 64)
+			if err != nil {
+				ch <- result{nil, fmt.Errorf("invalid index '%s'", vals[i])}
+				return
+			}
+			sums[index] = vals[i+1]
+		}
+		ch <- result{sums, nil}
+	}()
+	select {
+	case r := <-ch:
+		return r.sums, r.err
+	case <-time.After(checksumTimeout):
+		return nil, errors.New("timeout")
+	}
+}
+
+// compareChecksums returns the newest index that every reachable server has a
+// checksum for, and the checksum of the majority of the servers at that
+// index. The majority is empty when there is none, or when there is no such
+// index.
+func compareChecksums(servers []*serverChecksums) (index uint64,
+	majority string) {
+	var common map[uint64]bool
+	for _, s := range servers {
+		if s.err != nil {
+			continue
+		}
+		if common == nil {
+			common = make(map[uint64]bool)
+			for index := range s.sums {
+				common[index] = true
+			}
+			continue
+		}
+		for index := range common {
+			if _, ok := s.sums[index]; !ok {
+				delete(common, index)
+			}
+		}
+	}
+	for i := range common {
+		if i > index {
+			index = i
+		}
+	}
+	if index == 0 {
+		return 0, ""
+	}
+	counts := make(map[string]int)
+	var best int
+	for _, s := range servers {
+		if s.err == nil {
+			counts[s.sums[index]]++
+			if counts[s.sums[index]] > best {
+				best = counts[s.sums[index]]
+			}
+		}
+	}
+	for sum, n := range counts {
+		if n == best {
+			if majority != "" {
+				// A tie
+				return index, ""
+			}
+			majority = sum
+		}
+	}
+	return index, majority
+}
+
+// watchChecksums compares the checksums of the servers in the cluster, and
+// logs each server whose checksum differs from the majority.
+func watchChecksums() {
+	alerted := make(map[string]uint64)
+	for {
+		time.Sleep(checksumCheckInterval)
+		servers, err := clusterChecksums()
+		if err != nil {
+			continue
+		}
+		index, majority := compareChecksums(servers)
+		if index == 0 {
+			continue
+		}
+		for _, s := range servers {
+			if s.err != nil || s.sums[index] == majority ||
+				alerted[s.id] == index {
+				continue
+			}
+			alerted[s.id] = index
+			if majority == "" {
+				logger.Warningf("REPLICA DIVERGENCE: servers disagree at "+
+					"index %d, server %s has checksum %s", index, s.id,
+					s.sums[index])
+			} else {
+				logger.Warningf("REPLICA DIVERGENCE: server %s has checksum "+
+					"%s at index %d, the majority has %s", s.id,
+					s.sums[index], index, majority)
+			}
+		}
+	}
+}
+
+// CHECKSUM
+// help: compares the checksums of the databases of every server in the
+// cluster at the newest index that they have in common. Returns the index
+// and, for each server, the id, the address, the checksum, whether it
+// diverges from the majority, and the error when the server is unreachable.
+//
+// CHECKSUM LOCAL
+// help: returns the newest checksums of this server, as pairs of the index
+// and the checksum.
+func cmdCHECKSUM(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) == 2 {
+		switch strings.ToLower(args[1]) {
+		case "local":
+			return cmdCHECKSUMLOCAL(m, args)
+		case "help":
+			return []string{"CHECKSUM", "CHECKSUM LOCAL"}, nil
+		}
+		return nil, fmt.Errorf("unknown checksum command '%s %s', "+
+			"try CHECKSUM HELP", args[0], args[1])
+	}
+	if len(args) != 1 {
+		return nil, errors.New("wrong number of arguments, try CHECKSUM HELP")
+	}
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	if checksumIntervalFlag == 0 {
+		return nil, errors.New("checksums are turned off, " +
+			"try --checksum-interval")
+	}
+	servers, err := clusterChecksums()
+	if err != nil {
+		return nil, err
+	}
+	index, majority := compareChecksums(servers)
+	list := []interface{}{}
+	for _, s := range servers {
+		var errmsg string
+		if s.err != nil {
+			errmsg = s.err.Error()
+		}
+		sum := s.sums[index]
+		list = append(list, []interface{}{"id", s.id, "address", s.addr,
+			"checksum", sum,
+			"diverged", s.err == nil && index > 0 && sum != majority,
+			"error", errmsg})
+	}
+	return []interface{}{"index", index, "servers", list}, nil
+}
+
+func cmdCHECKSUMLOCAL(m uhaha.Machine, args []string) (interface{}, error) {
+	checksumMu.Lock()
+	defer checksumMu.Unlock()
+	res := []string{}
+	for _, e := range checksums {
+		res = append(res, strconv.FormatUint(e.index, 10),
+			fmt.Sprintf("%016x", e.sum))
+	}
+	return res, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/uhaha"
+)
+
+// sqlConfig are the Sqlite settings that are provided by the server flags or
+// by a config file.
+type sqlConfig struct {
+	PageSize    int    `json:"page_size"`
+	CacheSize   int    `json:"cache_size"`
+	AutoVacuum  string `json:"auto_vacuum"`
+	MmapSize    int64  `json:"mmap_size"`
+	Synchronous string `json:"synchronous"`
+}
+
+var sqlConf = sqlConfig{
+	PageSize:    4096,
+	CacheSize:   -2000,
+	AutoVacuum:  "full",
+	MmapSize:    0,
+	Synchronous: "off",
+}
+
+var sqlConfPath string
+var sqlConfFlags sqlConfig
+
+func addSQLConfigFlags() {
+	flag.StringVar(&sqlConfPath, "sqlite-config", "", "")
+	flag.IntVar(&sqlConfFlags.PageSize, "page-size", 0, "")
+	flag.IntVar(&sqlConfFlags.CacheSize, "cache-size", 0, "")
+	flag.StringVar(&sqlConfFlags.AutoVacuum, "auto-vacuum", "", "")
+	flag.Int64Var(&sqlConfFlags.MmapSize, "mmap-size", 0, "")
+	flag.StringVar(&sqlConfFlags.Synchronous, "synchronous", "", "")
+}
+
+// loadSQLConfig loads the config file, if provided, and then the flags. Flags
+// take precedence over the config file.
+func loadSQLConfig() error {
+	if sqlConfPath != "" {
+		data, err := ioutil.ReadFile(sqlConfPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &sqlConf); err != nil {
+			return fmt.Errorf("sqlite config: %v", err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "page-size":
+			sqlConf.PageSize = sqlConfFlags.PageSize
+		case "cache-size":
+			sqlConf.CacheSize = sqlConfFlags.CacheSize
+		case "auto-vacuum":
+			sqlConf.AutoVacuum = sqlConfFlags.AutoVacuum
+		case "mmap-size":
+			sqlConf.MmapSize = sqlConfFlags.MmapSize
+		case "synchronous":
+			sqlConf.Synchronous = sqlConfFlags.Synchronous
+		}
+	})
+	sqlConf.AutoVacuum = strings.ToLower(sqlConf.AutoVacuum)
+	sqlConf.Synchronous = strings.ToLower(sqlConf.Synchronous)
+	return sqlConf.validate()
+}
+
+func (conf *sqlConfig) validate() error {
+	if conf.PageSize < 512 || conf.PageSize > 65536 ||
+		conf.PageSize&(conf.PageSize-1) != 0 {
+		return errors.New(
+			"invalid page size, must be a power of two between 512 and 65536")
+	}
+	switch conf.AutoVacuum {
+	case "none", "full", "incremental":
+	default:
+		return fmt.Errorf("invalid auto vacuum mode '%s', "+
+			"must be none, full, or incremental", conf.AutoVacuum)
+	}
+	if conf.MmapSize < 0 {
+		return errors.New("invalid mmap size, must not be negative")
+	}
+	switch conf.Synchronous {
+	case "off", "normal", "full", "extra":
+	default:
+		return fmt.Errorf("invalid synchronous level '%s', "+
+			"must be off, normal, full, or extra", conf.Synchronous)
+	}
+	return nil
+}
+
+// pragmas returns the pragma statements for opening a database. The page size
+// and auto vacuum mode only take effect on a brand new database.
+func (conf *sqlConfig) pragmas(readonly bool) []string {
+	var pragmas []string
+	if !readonly {
+		pragmas = append(pragmas,
+			fmt.Sprintf("PRAGMA page_size=%d", conf.PageSize),
+			fmt.Sprintf("PRAGMA auto_vacuum=%s",
+				strings.ToUpper(conf.AutoVacuum)),
+			"PRAGMA journal_mode=WAL",
+			fmt.Sprintf("PRAGMA synchronous=%s", conf.Synchronous),
+		)
+	}
+	pragmas = append(pragmas,
+		fmt.Sprintf("PRAGMA cache_size=%d", conf.CacheSize),
+		fmt.Sprintf("PRAGMA mmap_size=%d", conf.MmapSize),
+	)
+	return pragmas
+}
+
+// SQLCONFIG
+// help: returns the Sqlite settings for this server.
+func cmdSQLCONFIG(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return []string{
+		"page_size", strconv.Itoa(sqlConf.PageSize),
+		"cache_size", strconv.Itoa(sqlConf.CacheSize),
+		"auto_vacuum", sqlConf.AutoVacuum,
+		"mmap_size", strconv.FormatInt(sqlConf.MmapSize, 10),
+		"synchronous", sqlConf.Synchronous,
+	}, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/uhaha"
+	"github.com/tidwall/uhatools"
+)
+
+// sessionTimeout is the max amount of time that a SESSION read will wait for
+// the server to apply the requested index.
+const sessionTimeout = time.Second * 10
+
+var errSessionTimeout = errors.New("timeout waiting for index to be applied")
+
+func setApplied(index uint64) {
+	appliedMu.Lock()
+	applied = index
+	appliedCond.Broadcast()
+	appliedMu.Unlock()
+}
+
+// waitApplied waits until the server has applied the provided index.
+func waitApplied(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		appliedMu.Lock()
+		appliedCond.Broadcast()
+		appliedMu.Unlock()
+	})
+	defer timer.Stop()
+	appliedMu.Lock()
+	defer appliedMu.Unlock()
+	for applied < index {
+		if !time.Now().Before(deadline) {
+			return errSessionTimeout
+		}
+		appliedCond.Wait()
+	}
+	return nil
+}
+
+// QUERY [LINEARIZABLE|LEADER|STALE|SESSION index] [WITHTYPES] sql
+// QUERY [LINEARIZABLE|LEADER|STALE|SESSION index] [WITHTYPES] JSON statements
+// help: runs read-only statements using the provided consistency level.
+// LINEARIZABLE reads get a read index from the leader, after the leader
+// confirms with a majority of the cluster that it's still the leader, and run
+// on any server once that server has applied the read index. LEADER reads run
+// on the leader, which is the default and the same as sending the statements
+// without QUERY. Followers may also run LEADER reads when the server uses
+// --openreads. STALE reads run on any server, possibly returning stale data.
+// SESSION reads run on any server, but only after that server has applied the
+// provided index, which is the index returned by a previous write. WITHTYPES
+// and JSON are the same as for EXEC.
+func cmdQUERYMODE(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	mode := "leader"
+	var index uint64
+	switch strings.ToLower(args[1]) {
+	case "linearizable", "leader", "stale":
+		mode = strings.ToLower(args[1])
+		args = args[2:]
+	case "session":
+		if len(args) < 3 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		var err error
+		index, err = strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index '%s'", args[2])
+		}
+		mode = "session"
+		args = args[3:]
+	default:
+		args = args[1:]
+	}
+	var withTypes bool
+	if len(args) > 0 && strings.ToLower(args[0]) == "withtypes" {
+		withTypes = true
+		args = args[1:]
+	}
+	sqlJSON, readonly, err := statementArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if !readonly {
+		return nil, errors.New("QUERY only allows read-only statements")
+	}
+	if sqlJSON == "" {
+		return []string{}, nil
+	}
+	return queryWithMode(conn(m), mode, index, sqlJSON, withTypes)
+}
+
+// queryWithMode runs the read-only statements in sqlJSON on the database of
+// the connection, as the user of the connection, using the provided
+// consistency mode. Returns FilterArgs when the read must be routed through
+// the cluster.
+func queryWithMode(ctx *connContext, mode string, index uint64,
+	sqlJSON string, withTypes bool,
+) (interface{}, error) {
+	switch mode {
+	case "linearizable":
+		var err error
+		index, err = readIndex()
+		if err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "session":
+		if err := waitApplied(index, sessionTimeout); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "stale":
+		user, err := authenticate(ctx.user, ctx.token)
+		if err != nil {
+			return nil, err
+		}
+		return sqlExec(ctx.db, sqlJSON, true, false, withTypes, user,
+			ctx.addr)
+	default:
+		args := []string{"$QUERY", sqlJSON}
+		if withTypes {
+			args = append(args, "withtypes")
+		}
+		return uhaha.FilterArgs(ctx.options(args...)), nil
+	}
+}
+
+// readIndexTimeout is the max time for getting the read index from the
+// leader, or the term of a server.
+const readIndexTimeout = time.Second * 5
+
+var errNoLeader = errors.New("no leader")
+
+// localService is the service of this server, which is used for sending
+// commands to the server itself. It's set when the HTTP service starts.
+var localServiceMu sync.Mutex
+var localService uhaha.Service
+
+func setLocalService(s uhaha.Service) {
+	localServiceMu.Lock()
+	localService = s
+	localServiceMu.Unlock()
+}
+
+// localSend sends a command to this server. Reads only run on the leader,
+// even when the server uses --openreads.
+func localSend(args ...string) (interface{}, error) {
+	localServiceMu.Lock()
+	s := localService
+	localServiceMu.Unlock()
+	if s == nil {
+		return nil, errors.New("server is not ready")
+	}
+	opts := &uhaha.SendOptions{DenyOpenReads: true}
+	res, _, err := s.Send(args, opts).Recv()
+	return res, err
+}
+
+// clusterDo sends a command to a server in the cluster, using the auth and
+// TLS of the cluster.
+func clusterDo(addr string, timeout time.Duration, cmd string,
+	args ...interface{},
+) (interface{}, error) {
+	type result struct {
+		res interface{}
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := uhaha.RedisDial(addr, clusterDial.auth,
+			clusterDial.tlscfg)
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		defer conn.Close()
+		res, err := conn.Do(cmd, args...)
+		ch <- result{res, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.res, r.err
+	case <-time.After(timeout):
+		return nil, errors.New("timeout")
+	}
+}
+
+// readIndex returns the read index of a LINEARIZABLE read, which is the
+// applied index that the read must wait for. A follower gets the read index
+// from the leader.
+func readIndex() (uint64, error) {
+	leader, err := isLeader()
+	if err != nil {
+		return 0, err
+	}
+	if leader {
+		return leaderReadIndex()
+	}
+	res, err := localSend("raft", "leader")
+	if err != nil {
+		return 0, err
+	}
+	addr, _ := res.(string)
+	if addr == "" {
+		return 0, errNoLeader
+	}
+	return uhatools.Uint64(clusterDo(addr, readIndexTimeout,
+		"$readindex"))
+}
+
+// leaderReadIndex returns the read index on the leader. The applied index is
+// taken by a read on the leader, which only runs after the leader applied a
+// tick of its own term, so every write that was committed by a previous
+// leader is included. The leader then confirms that a majority of the
+// servers are still in its term. Otherwise there may be a newer leader that
+// committed writes which this server has not applied.
+func leaderReadIndex() (uint64, error) {
+	term, err := localTerm()
+	if err != nil {
+		return 0, err
+	}
+	res, err := localSend("$applied")
+	if err != nil {
+		return 0, err
+	}
+	index, _ := res.(uint64)
+	res, err = localSend("raft", "server", "list")
+	if err != nil {
+		return 0, err
+	}
+	servers, _ := res.([][]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var confirmed int
+	for _, server := range servers {
+		var addr string
+		var leader bool
+		for i := 0; i+1 < len(server); i += 2 {
+			switch server[i] {
+			case "address":
+				addr = server[i+1]
+			case "leader":
+				leader = server[i+1] == "true"
+			}
+		}
+		wg.Add(1)
+		go func(addr string, leader bool) {
+			defer wg.Done()
+			var sterm uint64
+			var err error
+			if leader {
+				// This server
+				sterm, err = localTerm()
+			} else {
+				var vals map[string]string
+				vals, err = uhatools.StringMap(clusterDo(addr,
+					readIndexTimeout, "raft", "info", "term"))
+				if err == nil {
+					sterm, err = strconv.ParseUint(vals["term"], 10, 64)
+				}
+			}
+			if err == nil && sterm == term {
+				mu.Lock()
+				confirmed++
+				mu.Unlock()
+			}
+		}(addr, leader)
+	}
+	wg.Wait()
+	if confirmed <= len(servers)/2 {
+		return 0, errors.New("leadership not confirmed by a majority " +
+			"of the cluster")
+	}
+	return index, nil
+}
+
+// isLeader returns true when this server is the leader.
+func isLeader() (bool, error) {
+	res, err := localSend("raft", "info", "state")
+	if err != nil {
+		return false, err
+	}
+	state, _ := res.([]string)
+	return len(state) == 2 && state[1] == "Leader", nil
+}
+
+// localTerm returns the current Raft term of this server.
+func localTerm() (uint64, error) {
+	res, err := localSend("raft", "info", "term")
+	if err != nil {
+		return 0, err
+	}
+	vals, _ := res.(map[string]string)
+	return strconv.ParseUint(vals["term"], 10, 64)
+}
+
+func cmdREADINDEX(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	leader, err := isLeader()
+	if err != nil {
+		return nil, err
+	}
+	if !leader {
+		// Not forwarded again, which could go back and forth while the
+		// leader changes.
+		return nil, errNoLeader
+	}
+	return leaderReadIndex()
+}
+
+func cmdAPPLIED(m uhaha.Machine, args []string) (interface{}, error) {
+	// READ
+	appliedMu.Lock()
+	defer appliedMu.Unlock()
+	return applied, nil
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// #include "../../sqlite/sqlite.h"
+// static int uhasql_no_ckpt_on_close(sqlite3 *db) {
+//     return sqlite3_db_config(db, SQLITE_DBCONFIG_NO_CKPT_ON_CLOSE, 1,
+//         (int*)0);
+// }
+import "C"
+
+// defaultDBName is the name of the default database, which is the database
+// that is used when a connection has not selected a named database.
+const defaultDBName = "main"
+
+// database is a named database. Each named database is a separate Sqlite file
+// with its own writer and pool of readers. The default database, which also
+// has the procs and the other internal tables, is not a named database and
+// uses wdb, dbPath, and rdbs.
+type database struct {
+	name      string
+	path      string
+	wdb       *sqlDatabase
+	persisted uint64
+	rdbsMu    sync.Mutex
+	rdbs      []*sqlDatabase
+}
+
+// dbs are the named databases. Protected by the dbmu lock.
+var dbs = make(map[string]*database)
+
+// snapshotting is true while the files of a snapshot are being persisted.
+// Protected by the dbmu lock.
+var snapshotting bool
+
+// droppedDBs are the files of the named databases that were dropped while a
+// snapshot was being persisted, keyed by their file in the snapshot. Each
+// file was renamed to a tombstone, which is removed when the snapshot is
+// done.
+var droppedMu sync.Mutex
+var droppedDBs = make(map[string]string)
+
+// dbsDir is the directory of the named database files.
+func dbsDir() string {
+	return filepath.Join(filepath.Dir(dbPath), "dbs")
+}
+
+// validDBName returns true if the name is a valid database name, which is one
+// to 64 lowercase letters, digits, or underscores, not starting with a digit.
+func validDBName(name string) bool {
+	if len(name) == 0 || len(name) > 64 || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupDB returns the named database. The dbmu lock must be held.
+func lookupDB(name string) (*database, error) {
+	d := dbs[name]
+	if d == nil {
+		return nil, fmt.Errorf("no such database: %s", name)
+	}
+	return d, nil
+}
+
+// openNamedDB opens the writer of a named database. Its writes are recorded
+// in its own __cdc__ and __audit__ tables.
+func openNamedDB(name, path string) (*database, error) {
+	wdb, err := openSQLFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, ensure := range []func() error{
+		wdb.ensureMetaSpace, wdb.ensureCDCSpace, wdb.ensureAuditSpace,
+	} {
+		if err := ensure(); err != nil {
+			wdb.close()
+			return nil, err
+		}
+	}
+	index, err := wdb.readMeta("index")
+	if err != nil {
+		wdb.close()
+		return nil, err
+	}
+	if snapshotting {
+		// Keep the file unchanged until the snapshot is done.
+		if err := wdb.autocheckpoint(0); err != nil {
+			wdb.close()
+			return nil, err
+		}
+	}
+	return &database{name: name, path: path, wdb: wdb,
+		persisted: uint64(index)}, nil
+}
+
+// loadDatabases opens all of the named databases. The dbmu lock must be held.
+func loadDatabases() error {
+	if err := os.MkdirAll(dbsDir(), 0777); err != nil {
+		return err
+	}
+	// Tombstones of dropped databases that outlived the server.
+	tombs, _ := filepath.Glob(filepath.Join(dbsDir(), "*.db.dropped-*"))
+	for _, tomb := range tombs {
+		os.Remove(tomb)
+	}
+	names, err := dbFileNames(dbsDir())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(dbsDir(), name+".db")
+		d, err := openNamedDB(name, path)
+		if err != nil {
+			return err
+		}
+		dbs[name] = d
+	}
+	return nil
+}
+
+// dbFileNames returns the names of the database files in a directory.
+func dbFileNames(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".db")
+		if !fi.IsDir() && name != fi.Name() && validDBName(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (d *database) takeReader() (*sqlDatabase, error) {
+	start := time.Now()
+	d.rdbsMu.Lock()
+	if len(d.rdbs) > 0 {
+		db := d.rdbs[len(d.rdbs)-1]
+		d.rdbs = d.rdbs[:len(d.rdbs)-1]
+		d.rdbsMu.Unlock()
+		observeReader(d.name, start, false)
+		return db, nil
+	}
+	d.rdbsMu.Unlock()
+	defer observeReader(d.name, start, true)
+	return openSQLFile(d.path, true)
+}
+
+func (d *database) releaseReader(db *sqlDatabase) {
+	d.rdbsMu.Lock()
+	if len(d.rdbs) < rdbMaxPool && d.wdb.db != nil {
+		d.rdbs = append(d.rdbs, db)
+		d.rdbsMu.Unlock()
+	} else {
+		d.rdbsMu.Unlock()
+		db.close()
+	}
+}
+
+// close closes the writer and the pooled readers. The dbmu lock must be held.
+func (d *database) close() {
+	d.rdbsMu.Lock()
+	for _, db := range d.rdbs {
+		db.close()
+	}
+	d.rdbs = nil
+	d.wdb.close()
+	d.rdbsMu.Unlock()
+}
+
+// connContext is the context of a client connection.
+type connContext struct {
+	addr  string // remote address of the client
+	db    string // database selected by USE, empty for the default database
+	user  string // user selected by LOGIN, empty for no user
+	token string // session token of the user, see userToken
+}
+
+// connOpened creates the context of a connection. A connection with a client
+// certificate starts as the user of the certificate.
+func connOpened(addr string) (context interface{}, accept bool) {
+	ctx := &connContext{addr: addr}
+	ctx.user, ctx.token = takeCertUser(addr)
+	return ctx, true
+}
+
+// conn returns the context of the connection, or an empty context when the
+// command is not from a client connection.
+func conn(m uhaha.Machine) *connContext {
+	if ctx, ok := m.Context().(*connContext); ok {
+		return ctx
+	}
+	return &connContext{}
+}
+
+// commandToken returns a command token for the user of the connection, see
+// commandToken.
+func (ctx *connContext) commandToken() string {
+	return commandToken(ctx.user, ctx.token, time.Now())
+}
+
+// options appends the named database, user, and address options of the
+// connection to the args of the $EXEC and $QUERY commands. Nothing is
+// appended for the default database, for no user, or for no address.
+func (ctx *connContext) options(args ...string) []string {
+	if ctx.db != "" {
+		args = append(args, "db", ctx.db)
+	}
+	if ctx.user != "" {
+		args = append(args, "user", ctx.user, ctx.commandToken())
+	}
+	if ctx.addr != "" {
+		args = append(args, "addr", ctx.addr)
+	}
+	return args
+}
+
+// USE name
+// help: selects the database for the statements that are sent on this
+// connection. The default database is "main".
+func cmdUSE(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) != 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	ctx, ok := m.Context().(*connContext)
+	if !ok {
+		return nil, errors.New("USE is not available for this connection")
+	}
+	name := strings.ToLower(args[1])
+	if name != defaultDBName {
+		rlockDB()
+		_, err := lookupDB(name)
+		dbmu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		name = ""
+	}
+	ctx.db = name
+	return redcon.SimpleString("OK"), nil
+}
+
+// DB CREATE name            -- creates a database
+// DB DROP name              -- deletes a database and all of its data
+// DB LIST                   -- returns the names of all databases
+func cmdDB(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try DB HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "create":
+		return cmdDBCREATE(m, args)
+	case "drop":
+		return cmdDBDROP(m, args)
+	case "list":
+		return cmdDBLIST(m, args)
+	case "help":
+		return cmdDBHELP(m, args)
+	default:
+		return nil, fmt.Errorf("unknown db command '%s %s', try DB HELP",
+			args[0], args[1],
+		)
+	}
+}
+
+func cmdDBCREATE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments, try DB HELP")
+	}
+	name := strings.ToLower(args[2])
+	if !validDBName(name) {
+		return nil, fmt.Errorf("invalid database name '%s'", args[2])
+	}
+	if name == defaultDBName || dbs[name] != nil {
+		return nil, fmt.Errorf("database '%s' already exists", name)
+	}
+	path := filepath.Join(dbsDir(), name+".db")
+	removeDBFiles(path)
+	d, err := openNamedDB(name, path)
+	if err != nil {
+		return nil, err
+	}
+	// Record the index of the create. A restore uses the index to know if
+	// the database is newer than a snapshot.
+	if err := d.wdb.saveState(); err != nil {
+		d.close()
+		removeDBFiles(path)
+		return nil, err
+	}
+	d.persisted = applied
+	dbs[name] = d
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdDBDROP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments, try DB HELP")
+	}
+	name := strings.ToLower(args[2])
+	if name == defaultDBName {
+		return nil, errors.New("the main database cannot be dropped")
+	}
+	d, err := lookupDB(name)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotting {
+		if err := d.dropLater(); err != nil {
+			return nil, err
+		}
+	} else {
+		d.close()
+		removeDBFiles(d.path)
+	}
+	delete(dbs, name)
+	return redcon.SimpleString("OK"), nil
+}
+
+// dropLater closes a database that is dropped while a snapshot is being
+// persisted. The snapshot needs the file as it was, so the writer is closed
+// without a checkpoint and the file is renamed to a tombstone, which is
+// removed when the snapshot is done. The dbmu lock must be held.
+func (d *database) dropLater() error {
+	if rc := C.uhasql_no_ckpt_on_close(d.wdb.db); rc != C.SQLITE_OK {
+		return errors.New(C.GoString(C.sqlite3_errstr(rc)))
+	}
+	d.close()
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	file := "dbs/" + d.name + ".db"
+	if _, ok := droppedDBs[file]; ok {
+		// The database was created after the snapshot.
+		removeDBFiles(d.path)
+		return nil
+	}
+	tomb := fmt.Sprintf("%s.dropped-%d", d.path, applied)
+	if err := os.Rename(d.path, tomb); err != nil {
+		return err
+	}
+	droppedDBs[file] = tomb
+	os.Remove(d.path + "-wal")
+	os.Remove(d.path + "-shm")
+	return nil
+}
+
+// removeDroppedDBs removes the tombstones of the databases that were dropped
+// while a snapshot was being persisted.
+func removeDroppedDBs() {
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	for file, tomb := range droppedDBs {
+		os.Remove(tomb)
+		delete(droppedDBs, file)
+	}
+}
+
+func cmdDBLIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try DB HELP")
+	}
+	var names []string
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{defaultDBName}, names...), nil
+}
+
+func cmdDBHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try DB HELP")
+	}
+	return []string{
+		"DB CREATE name",
+		"DB DROP name",
+		"DB LIST",
+	}, nil
+}
+
+// sqliteHeader is the first 16 bytes of every Sqlite database file. Older
+// snapshots, and the snapshot of an import, are a single Sqlite database file
+// rather than a tar archive.
+const sqliteHeader = "SQLite format 3\x00"
+
+// writeSnapshotFiles writes the default database file and the named database
+// files as a tar archive. The file of a database that has been dropped since
+// the snapshot was taken is read from its tombstone.
+func writeSnapshotFiles(wr io.Writer, names []string) error {
+	tw := tar.NewWriter(wr)
+	files := []string{"sqlite.db"}
+	for _, name := range names {
+		files = append(files, "dbs/"+name+".db")
+	}
+	for _, file := range files {
+		f, err := openSnapshotFile(file)
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Name: file, Mode: 0644, Size: fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, f, fi.Size())
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// openSnapshotFile opens a database file of a snapshot, or its tombstone when
+// the database was dropped. The droppedMu lock is held while the file is
+// opened, so a drop can't rename it in the meantime.
+func openSnapshotFile(file string) (*os.File, error) {
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	path := filepath.Join(filepath.Dir(dbPath), file)
+	if tomb, ok := droppedDBs[file]; ok {
+		path = tomb
+	}
+	return os.Open(path)
+}
+
+// readSnapshotFiles reads the database files from a snapshot into a
+// directory.
+func readSnapshotFiles(rd io.Reader, dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "dbs"), 0777); err != nil {
+		return err
+	}
+	rd, err := decryptSnapshot(bufio.NewReader(rd))
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(rd)
+	head, _ := br.Peek(len(sqliteHeader))
+	if string(head) == sqliteHeader {
+		return writeFile(filepath.Join(dir, "sqlite.db"), br)
+	}
+	tr := tar.NewReader(br)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		file := hdr.Name
+		if file != "sqlite.db" {
+			name := strings.TrimSuffix(strings.TrimPrefix(file, "dbs/"), ".db")
+			if file != "dbs/"+name+".db" || !validDBName(name) {
+				return fmt.Errorf("invalid snapshot file '%s'", file)
+			}
+		}
+		if err := writeFile(filepath.Join(dir, file), tr); err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(path string, rd io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restoreDatabases replaces the named databases with the ones from a
+// snapshot, which are in the dir. A database is only replaced when the
+// current one is older. Current databases that are not in the snapshot are
+// deleted, unless they were created after the snapshot. The remaining Raft
+// log is replayed from the snapshot index, which sorts out the rest. The
+// dbmu lock must be held.
+func restoreDatabases(dir string, index uint64) error {
+	names, err := dbFileNames(dir)
+	if err != nil {
+		return err
+	}
+	snapped := make(map[string]bool)
+	for _, name := range names {
+		snapped[name] = true
+	}
+	for name, d := range dbs {
+		if !snapped[name] && d.persisted <= index {
+			d.close()
+			removeDBFiles(d.path)
+			delete(dbs, name)
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name+".db")
+		sdb, err := openSQLFile(path, false)
+		if err != nil {
+			return err
+		}
+		sindex, err := sdb.readMeta("index")
+		sdb.close()
+		if err != nil {
+			return err
+		}
+		if d := dbs[name]; d != nil {
+			if d.persisted >= uint64(sindex) {
+				continue
+			}
+			d.close()
+			delete(dbs, name)
+		}
+		dpath := filepath.Join(dbsDir(), name+".db")
+		removeDBFiles(dpath)
+		if err := os.Rename(path, dpath); err != nil {
+			return err
+		}
+		d, err := openNamedDB(name, dpath)
+		if err != nil {
+			return err
+		}
+		dbs[name] = d
+	}
+	return nil
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+import "C"
+
+// fileMagic starts the header of each encrypted database file, followed by
+// the key id, the nonce, and the block size. See vfs.go.
+const fileMagic = "UhaSQL encrypted"
+
+// fileHeaderSize is the size of the header of each encrypted file, which is
+// the UHASQL_HEADER_SIZE of vfs.go.
+const fileHeaderSize = 4096
+
+// fileHeaderUsed is the size of the magic, key id, nonce, and block size,
+// which is the UHASQL_HEADER_USED of vfs.go. The rest of the header is zeros.
+const fileHeaderUsed = len(fileMagic) + 20
+
+// blockExtra is the size of the nonce and the tag that follow each sealed
+// block, which is the UHASQL_EXTRA of vfs.go.
+const blockExtra = 12 + 16
+
+// snapshotMagic starts an encrypted snapshot, followed by the key id and a
+// random salt. The rest of the snapshot is a series of chunks, each with a
+// four byte length and the sealed data. The high bit of the length marks the
+// last chunk.
+const snapshotMagic = "UHASQLE1"
+
+// snapshotChunkSize is the max size of the data of each snapshot chunk.
+const snapshotChunkSize = 64 * 1024
+
+// encryptionKey is a key that is provided by --encryption-key or
+// --encryption-key-file. The page and snapshot keys are derived from it.
+type encryptionKey struct {
+	id    [8]byte
+	pages cipher.AEAD
+	snaps []byte
+}
+
+// encryptionKeyFlag and encryptionKeyFileFlag provide the keys.
+var encryptionKeyFlag string
+var encryptionKeyFileFlag string
+
+// encryptionKeys are the keys, the first one is the current key, which is
+// used for new files and snapshots. The others are old keys, which are only
+// used for reading. Empty when encryption is off.
+var encryptionKeys []*encryptionKey
+
+// deriveKey returns an HMAC-SHA256 of the label using the key.
+func deriveKey(key []byte, label string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// parseEncryptionKey parses a hex encoded 32 byte key.
+func parseEncryptionKey(s string) (*encryptionKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption: key must be 64 hex characters")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "uhasql pages"))
+	if err != nil {
+		return nil, err
+	}
+	pages, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &encryptionKey{pages: pages,
+		snaps: deriveKey(key, "uhasql snapshots")}
+	copy(k.id[:], deriveKey(key, "uhasql key id"))
+	return k, nil
+}
+
+// checkEncryptionFlags loads the keys and registers the encrypting VFS.
+// The flag is a comma-separated list of keys and the file has one key on
+// each line. The first key is the current key.
+func checkEncryptionFlags() error {
+	var list []string
+	switch {
+	case encryptionKeyFlag != "" && encryptionKeyFileFlag != "":
+		return errors.New("flag --encryption-key cannot be used with " +
+			"--encryption-key-file flag")
+	case encryptionKeyFlag != "":
+		list = strings.Split(encryptionKeyFlag, ",")
+	case encryptionKeyFileFlag != "":
+		data, err := ioutil.ReadFile(encryptionKeyFileFlag)
+		if err != nil {
+			return fmt.Errorf("encryption: %s", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				list = append(list, line)
+			}
+		}
+		if len(list) == 0 {
+			return errors.New("encryption: no keys in key file")
+		}
+	default:
+		return nil
+	}
+	for _, s := range list {
+		key, err := parseEncryptionKey(s)
+		if err != nil {
+			return err
+		}
+		encryptionKeys = append(encryptionKeys, key)
+	}
+	return registerVFS()
+}
+
+// keyIndex returns the index of the key with the id, or -1 if there is no
+// such key.
+func keyIndex(id []byte) int {
+	for i, key := range encryptionKeys {
+		if bytes.Equal(key.id[:], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fileKeyID returns the key id of an encrypted file. Returns nil when the
+// file is not encrypted or doesn't exist.
+func fileKeyID(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, len(fileMagic)+8)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, nil
+	}
+	if string(head[:len(fileMagic)]) != fileMagic {
+		return nil, nil
+	}
+	return head[len(fileMagic):], nil
+}
+
+// checkEncryption makes sure that a database file can be read using the
+// provided keys.
+func checkEncryption(path string) error {
+	id, err := fileKeyID(path)
+	if err != nil || id == nil {
+		return err
+	}
+	if len(encryptionKeys) == 0 {
+		return fmt.Errorf("encryption: database is encrypted, try "+
+			"--encryption-key or --encryption-key-file: path=%s", path)
+	}
+	if keyIndex(id) == -1 {
+		return fmt.Errorf("encryption: database is encrypted with an "+
+			"unknown key: path=%s", path)
+	}
+	return nil
+}
+
+// uhasqlNewHeader writes the magic, key id, and nonce of a new file. The
+// block size is written by the VFS.
+//
+//export uhasqlNewHeader
+func uhasqlNewHeader(hdr unsafe.Pointer) C.int {
+	b := (*[1 << 30]byte)(hdr)[:fileHeaderUsed:fileHeaderUsed]
+	copy(b, fileMagic)
+	copy(b[len(fileMagic):], encryptionKeys[0].id[:])
+	rand.Read(b[len(fileMagic)+8:])
+	return 0
+}
+
+//export uhasqlReadHeader
+func uhasqlReadHeader(hdr unsafe.Pointer, n C.int) C.int {
+	b := (*[1 << 30]byte)(hdr)[:n:n]
+	if len(b) < fileHeaderUsed || string(b[:len(fileMagic)]) != fileMagic {
+		return -2
+	}
+	return C.int(keyIndex(b[len(fileMagic) : len(fileMagic)+8]))
+}
+
+// uhasqlSeal encrypts the n bytes of the block in buf using a new random
+// nonce. The nonce and the tag are written to the blockExtra bytes that
+// follow the block. Returns -1 when there is no randomness.
+//
+//export uhasqlSeal
+func uhasqlSeal(key C.int, aad unsafe.Pointer, naad C.int,
+	buf unsafe.Pointer, n C.int,
+) C.int {
+	aead := encryptionKeys[key].pages
+	b := (*[1 << 30]byte)(buf)[: n+blockExtra : n+blockExtra]
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return -1
+	}
+	sealed := aead.Seal(b[:0], nonce[:], b[:n],
+		(*[1 << 30]byte)(aad)[:naad:naad])
+	// The tag follows the ciphertext, which is moved after the nonce.
+	var tag [16]byte
+	copy(tag[:], sealed[n:])
+	copy(b[n:], nonce[:])
+	copy(b[n+12:], tag[:])
+	return 0
+}
+
+// uhasqlUnseal decrypts the n bytes of the block in buf, which are followed
+// by the nonce and the tag. Returns -1 when the block is not authentic.
+//
+//export uhasqlUnseal
+func uhasqlUnseal(key C.int, aad unsafe.Pointer, naad C.int,
+	buf unsafe.Pointer, n C.int,
+) C.int {
+	aead := encryptionKeys[key].pages
+	b := (*[1 << 30]byte)(buf)[: n+blockExtra : n+blockExtra]
+	sealed := make([]byte, n+16)
+	copy(sealed, b[:n])
+	copy(sealed[n:], b[n+12:])
+	_, err := aead.Open(b[:0], b[n:n+12], sealed,
+		(*[1 << 30]byte)(aad)[:naad:naad])
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// snapshotAEAD returns the cipher of a snapshot for the salt.
+func snapshotAEAD(key *encryptionKey, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(key.snaps, string(salt)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// snapshotNonce returns the nonce of a chunk, which is the chunk number and
+// whether it's the last chunk.
+func snapshotNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// snapshotWriter encrypts a snapshot using the current key.
+type snapshotWriter struct {
+	wr    io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+// encryptSnapshot returns a writer that encrypts a snapshot when encryption
+// is on. The writer must be closed.
+func encryptSnapshot(wr io.Writer) (io.WriteCloser, error) {
+	if len(encryptionKeys) == 0 {
+		return nopWriteCloser{wr}, nil
+	}
+	key := encryptionKeys[0]
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := snapshotAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	head := append(append([]byte(snapshotMagic), key.id[:]...), salt...)
+	if _, err := wr.Write(head); err != nil {
+		return nil, err
+	}
+	return &snapshotWriter{wr: wr, aead: aead}, nil
+}
+
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == snapshotChunkSize {
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		m := snapshotChunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (w *snapshotWriter) flush(last bool) error {
+	var head [4]byte
+	size := uint32(len(w.buf))
+	if last {
+		size |= 1 << 31
+	}
+	binary.BigEndian.PutUint32(head[:], size)
+	sealed := w.aead.Seal(nil, snapshotNonce(w.chunk, last), w.buf, head[:])
+	w.chunk++
+	w.buf = w.buf[:0]
+	if _, err := w.wr.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.wr.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk.
+func (w *snapshotWriter) Close() error {
+	return w.flush(true)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// snapshotReader decrypts a snapshot.
+type snapshotReader struct {
+	rd    io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+	last  bool
+}
+
+// decryptSnapshot returns a reader that decrypts the snapshot when it's
+// encrypted, otherwise the snapshot is read as is.
+func decryptSnapshot(br *bufio.Reader) (io.Reader, error) {
+	head, _ := br.Peek(len(snapshotMagic))
+	if string(head) != snapshotMagic {
+		return br, nil
+	}
+	head = make([]byte, len(snapshotMagic)+8+16)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	if len(encryptionKeys) == 0 {
+		return nil, errors.New("encryption: snapshot is encrypted, try " +
+			"--encryption-key or --encryption-key-file")
+	}
+	i := keyIndex(head[len(snapshotMagic) : len(snapshotMagic)+8])
+	if i == -1 {
+		return nil, errors.New("encryption: snapshot is encrypted with an " +
+			"unknown key")
+	}
+	aead, err := snapshotAEAD(encryptionKeys[i], head[len(snapshotMagic)+8:])
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotReader{rd: br, aead: aead}, nil
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (r *snapshotReader) next() error {
+	var head [4]byte
+	if _, err := io.ReadFull(r.rd, head[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	last := size&(1<<31) != 0
+	size &^= 1 << 31
+	if size > snapshotChunkSize {
+		return errors.New("encryption: invalid snapshot chunk")
+	}
+	sealed := make([]byte, int(size)+r.aead.Overhead())
+	if _, err := io.ReadFull(r.rd, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	data, err := r.aead.Open(sealed[:0], snapshotNonce(r.chunk, last),
+		sealed, head[:])
+	if err != nil {
+		return errors.New("encryption: snapshot is corrupted")
+	}
+	r.chunk++
+	r.buf, r.last = data, last
+	return nil
+}
+
+// needsRekey returns true when a database file is not encrypted with the
+// current key.
+func needsRekey(path string) (bool, error) {
+	if len(encryptionKeys) == 0 {
+		return false, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false, nil
+	}
+	id, err := fileKeyID(path)
+	if err != nil {
+		return false, err
+	}
+	return id == nil || keyIndex(id) != 0, nil
+}
+
+// rekeyFile copies the database to a new file, which is encrypted with the
+// current key. The copy is page by page, so the rowids don't change.
+func rekeyFile(db *sqlDatabase, path string) error {
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	removeDBFiles(path)
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var dst *C.sqlite3
+	rc := C.sqlite3_open_v2(cpath, &dst,
+		C.SQLITE_OPEN_READWRITE|C.SQLITE_OPEN_CREATE, nil)
+	if rc != C.SQLITE_OK {
+		err := errors.New(C.GoString(C.sqlite3_errmsg(dst)))
+		C.sqlite3_close(dst)
+		return err
+	}
+	cmain := C.CString("main")
+	defer C.free(unsafe.Pointer(cmain))
+	bk := C.sqlite3_backup_init(dst, cmain, db.db, cmain)
+	if bk == nil {
+		err := errors.New(C.GoString(C.sqlite3_errmsg(dst)))
+		C.sqlite3_close(dst)
+		return err
+	}
+	step := C.sqlite3_backup_step(bk, -1)
+	rc = C.sqlite3_backup_finish(bk)
+	var err error
+	if rc != C.SQLITE_OK {
+		err = errors.New(C.GoString(C.sqlite3_errmsg(dst)))
+	} else if step != C.SQLITE_DONE {
+		// Such as SQLITE_BUSY, which is not returned by the finish and
+		// leaves the copy incomplete.
+		err = errors.New(C.GoString(C.sqlite3_errstr(step)))
+	}
+	C.sqlite3_close(dst)
+	if err != nil {
+		removeDBFiles(path)
+	}
+	return err
+}
+
+// replaceDBFile replaces a closed database file with its rekeyed copy.
+func replaceDBFile(path string) error {
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+	return os.Rename(path+".rekey", path)
+}
+
+// rekeyDatabases re-encrypts the database files that are not encrypted with
+// the current key, which are existing files from before encryption was turned
+// on or files that use an old key. Called when a snapshot is taken. The dbmu
+// lock must be held.
+func rekeyDatabases() error {
+	rekey, err := needsRekey(dbPath)
+	if err != nil {
+		return err
+	}
+	if rekey {
+		if err := rekeyFile(wdb, dbPath+".rekey"); err != nil {
+			return err
+		}
+		closeReaderDBs()
+		wdb.close()
+		if err := replaceDBFile(dbPath); err != nil {
+			return err
+		}
+		wdb, err = openSQLDatabase(dbPath, false)
+		if err != nil {
+			return err
+		}
+		attachedRefDBs = nil
+		if err := loadRefDBs(); err != nil {
+			return err
+		}
+		logger.Printf("database encrypted: path=%s", dbPath)
+	}
+	for name, d := range dbs {
+		rekey, err := needsRekey(d.path)
+		if err != nil {
+			return err
+		}
+		if !rekey {
+			continue
+		}
+		if err := rekeyFile(d.wdb, d.path+".rekey"); err != nil {
+			return err
+		}
+		d.close()
+		if err := replaceDBFile(d.path); err != nil {
+			return err
+		}
+		nd, err := openNamedDB(name, d.path)
+		if err != nil {
+			return err
+		}
+		dbs[name] = nd
+		logger.Printf("database encrypted: path=%s", d.path)
+	}
+	return nil
+}
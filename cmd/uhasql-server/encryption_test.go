@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testVFSOnce sync.Once
+
+// setTestKeys sets the encryption keys, the first one is the current key.
+// The VFS is registered on the first call. Every database must be closed
+// before the keys are changed.
+func setTestKeys(t *testing.T, hexKeys ...string) []*encryptionKey {
+	testVFSOnce.Do(func() {
+		if err := registerVFS(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	encryptionKeys = nil
+	for _, s := range hexKeys {
+		key, err := parseEncryptionKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptionKeys = append(encryptionKeys, key)
+	}
+	t.Cleanup(func() { encryptionKeys = nil })
+	return encryptionKeys
+}
+
+var testKey1 = strings.Repeat("1a", 32)
+var testKey2 = strings.Repeat("2b", 32)
+
+// testSecret is written to the test databases, and must never be found in
+// an encrypted file.
+const testSecret = "very secret value"
+
+func openTestDB(t *testing.T, path string) *sqlDatabase {
+	db, err := openSQLFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testExec(t *testing.T, db *sqlDatabase, sql string) {
+	if err := db.exec(sql, nil); err != nil {
+		t.Fatalf("%s: %s", sql, err)
+	}
+}
+
+// testValue returns the first value of a query.
+func testValue(db *sqlDatabase, sql string) (string, error) {
+	var val string
+	var header bool
+	err := db.exec(sql, func(row []string) bool {
+		if header {
+			val = row[0]
+			return false
+		}
+		header = true
+		return true
+	})
+	return val, err
+}
+
+func expectValue(t *testing.T, db *sqlDatabase, sql, want string) {
+	val, err := testValue(db, sql)
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err)
+	}
+	if val != want {
+		t.Fatalf("%s: expected %q, got %q", sql, want, val)
+	}
+}
+
+// createTestDB creates a database with a table of 500 rows, which spans
+// many pages.
+func createTestDB(t *testing.T, path string) {
+	db := openTestDB(t, path)
+	testExec(t, db, `create table t (id integer primary key, v text, b blob)`)
+	testExec(t, db, `with recursive n(i) as (select 1 union all
+		select i + 1 from n where i < 500)
+		insert into t (v, b) select '`+testSecret+`', randomblob(i * 3)
+		from n`)
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectEncrypted fails when a file doesn't have the header of the key, or
+// when it has the secret in plaintext.
+func expectEncrypted(t *testing.T, path string, key *encryptionKey) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(fileMagic)) {
+		t.Fatalf("%s: expected the header of an encrypted file", path)
+	}
+	id := data[len(fileMagic) : len(fileMagic)+8]
+	if !bytes.Equal(id, key.id[:]) {
+		t.Fatalf("%s: expected key id %x, got %x", path, key.id, id)
+	}
+	if bytes.Contains(data, []byte(testSecret)) {
+		t.Fatalf("%s: found plaintext", path)
+	}
+}
+
+// blockRange returns the start and end of a sealed block in an encrypted
+// file that isn't a WAL file.
+func blockRange(t *testing.T, data []byte, blk int) (int, int) {
+	if len(data) < fileHeaderUsed {
+		t.Fatal("file is too short")
+	}
+	bsize := int(binary.BigEndian.Uint32(data[32:36]))
+	start := fileHeaderSize + blk*(bsize+blockExtra)
+	end := start + bsize + blockExtra
+	if end > len(data) {
+		t.Fatalf("file has no block %d", blk)
+	}
+	return start, end
+}
+
+// expectUnreadable fails when the database can be read.
+func expectUnreadable(t *testing.T, path string) {
+	db, err := openSQLFile(path, false)
+	if err != nil {
+		return
+	}
+	defer db.close()
+	// A page that can't be read is reported by the integrity check.
+	if val, err := testValue(db, "pragma integrity_check"); err != nil ||
+		val != "ok" {
+		return
+	}
+	if _, err := testValue(db, "select sum(length(b)) from t"); err != nil {
+		return
+	}
+	t.Fatalf("%s: expected an error", path)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	keys := setTestKeys(t, testKey1)
+	path := filepath.Join(t.TempDir(), "data.db")
+	db := openTestDB(t, path)
+	if err := db.autocheckpoint(0); err != nil {
+		t.Fatal(err)
+	}
+	testExec(t, db, `create table t (id integer primary key, v text, b blob)`)
+	testExec(t, db, `insert into t (v, b) select '`+testSecret+`',
+		randomblob(100) from (select 1 union all select 2)`)
+	testExec(t, db, `update t set v = v || '!' where id = 1`)
+
+	// The changes are only in the WAL file.
+	expectEncrypted(t, path+"-wal", keys[0])
+	if walFrames(path+"-wal", 4096) == 0 {
+		t.Fatal("expected frames in the WAL file")
+	}
+	reader, err := openSQLFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, reader, "select v from t where id = 1", testSecret+"!")
+	reader.close()
+
+	if err := db.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+	expectEncrypted(t, path, keys[0])
+	db = openTestDB(t, path)
+	defer db.close()
+	expectValue(t, db, "select count(*) from t", "2")
+	expectValue(t, db, "select v from t where id = 1", testSecret+"!")
+	expectValue(t, db, "pragma integrity_check", "ok")
+}
+
+func TestEncryptedTamper(t *testing.T) {
+	setTestKeys(t, testKey1)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.db")
+	createTestDB(t, path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed byte of the ciphertext, the nonce, or the tag.
+	start, end := blockRange(t, data, 1)
+	for i, off := range []int{start + 10, end - blockExtra + 1, end - 1} {
+		bad := append([]byte(nil), data...)
+		bad[off] ^= 1
+		badPath := filepath.Join(dir, "bad"+string(rune('0'+i))+".db")
+		if err := ioutil.WriteFile(badPath, bad, 0666); err != nil {
+			t.Fatal(err)
+		}
+		expectUnreadable(t, badPath)
+	}
+
+	// A block of zeros is not a hole, so it fails to decrypt rather than
+	// being read as a page of zeros.
+	bad := append([]byte(nil), data...)
+	start, end = blockRange(t, data, 3)
+	for i := start; i < end; i++ {
+		bad[i] = 0
+	}
+	badPath := filepath.Join(dir, "zeros.db")
+	if err := ioutil.WriteFile(badPath, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, badPath)
+	defer db.close()
+	_, err = testValue(db, "select sum(length(b)) from t")
+	if err == nil || !strings.Contains(err.Error(), "disk I/O error") {
+		t.Fatalf("expected a disk I/O error, got %v", err)
+	}
+}
+
+func TestEncryptedMovedBlock(t *testing.T) {
+	setTestKeys(t, testKey1)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.db")
+	otherPath := filepath.Join(dir, "other.db")
+	createTestDB(t, path)
+	createTestDB(t, otherPath)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ioutil.ReadFile(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two blocks that are swapped within the file.
+	bad := append([]byte(nil), data...)
+	start1, end1 := blockRange(t, data, 1)
+	start2, end2 := blockRange(t, data, 2)
+	copy(bad[start1:end1], data[start2:end2])
+	copy(bad[start2:end2], data[start1:end1])
+	badPath := filepath.Join(dir, "swapped.db")
+	if err := ioutil.WriteFile(badPath, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	expectUnreadable(t, badPath)
+
+	// A block from another file with the same key, at the same position.
+	bad = append([]byte(nil), data...)
+	ostart, oend := blockRange(t, other, 1)
+	copy(bad[start1:end1], other[ostart:oend])
+	badPath = filepath.Join(dir, "moved.db")
+	if err := ioutil.WriteFile(badPath, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	expectUnreadable(t, badPath)
+}
+
+func TestEncryptedShortLastBlock(t *testing.T) {
+	keys := setTestKeys(t, testKey1)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.db")
+	createTestDB(t, path)
+	db := openTestDB(t, path)
+	testExec(t, db, "pragma journal_mode=delete")
+	testExec(t, db, "pragma cache_size=1")
+	testExec(t, db, "begin")
+	testExec(t, db, "delete from t where id > 10")
+
+	// The rollback journal, which has records that are not a multiple of the
+	// block size, is copied while the transaction is open. Opening the copy
+	// rolls back the hot journal.
+	jsize := fileSize(path+"-journal") - fileHeaderSize
+	if jsize <= 0 || jsize%(4096+blockExtra) == 0 {
+		t.Fatalf("expected a short last block, journal size %d", jsize)
+	}
+	expectEncrypted(t, path+"-journal", keys[0])
+	copyPath := filepath.Join(dir, "copy.db")
+	if err := copyFile(copyPath, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(copyPath+"-journal", path+"-journal"); err != nil {
+		t.Fatal(err)
+	}
+	testExec(t, db, "rollback")
+	db.close()
+
+	db = openTestDB(t, copyPath)
+	defer db.close()
+	expectValue(t, db, "select count(*) from t", "500")
+	expectValue(t, db, "pragma integrity_check", "ok")
+}
+
+func TestRekeyFromPlaintext(t *testing.T) {
+	keys := setTestKeys(t, testKey1)
+	path := filepath.Join(t.TempDir(), "data.db")
+
+	// A plain file, which is created without the encrypting VFS.
+	createTestDB(t, "file:"+path+"?vfs=unix")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(testSecret)) {
+		t.Fatal("expected a plain file")
+	}
+	rekeyTestDB(t, path)
+	expectEncrypted(t, path, keys[0])
+}
+
+func TestRekeyFromOldKey(t *testing.T) {
+	setTestKeys(t, testKey1)
+	path := filepath.Join(t.TempDir(), "data.db")
+	createTestDB(t, path)
+	keys := setTestKeys(t, testKey2, testKey1)
+	if err := checkEncryption(path); err != nil {
+		t.Fatal(err)
+	}
+	rekeyTestDB(t, path)
+	expectEncrypted(t, path, keys[0])
+
+	// The old key is no longer needed.
+	setTestKeys(t, testKey2)
+	db := openTestDB(t, path)
+	defer db.close()
+	expectValue(t, db, "select count(*) from t", "500")
+
+	// The file can't be read without its key.
+	setTestKeys(t, testKey1)
+	if err := checkEncryption(path); err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+}
+
+// rekeyTestDB rekeys a database that needs it, in the way of
+// rekeyDatabases, and checks the rows of the new file.
+func rekeyTestDB(t *testing.T, path string) {
+	rekey, err := needsRekey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rekey {
+		t.Fatal("expected the file to need a rekey")
+	}
+	db := openTestDB(t, path)
+	if err := rekeyFile(db, path+".rekey"); err != nil {
+		t.Fatal(err)
+	}
+	db.close()
+	if err := replaceDBFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if rekey, err := needsRekey(path); err != nil || rekey {
+		t.Fatalf("expected no rekey, got %v %v", rekey, err)
+	}
+	db = openTestDB(t, path)
+	defer db.close()
+	expectValue(t, db, "select count(*) from t", "500")
+	expectValue(t, db, "select count(*) from t where v = '"+testSecret+"'",
+		"500")
+	expectValue(t, db, "pragma integrity_check", "ok")
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	// Longer than two chunks, so the last chunk is short.
+	data := bytes.Repeat([]byte(testSecret), snapshotChunkSize/4)
+
+	snapshot := func() []byte {
+		var buf bytes.Buffer
+		wr, err := encryptSnapshot(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wr.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := wr.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	restore := func(snap []byte) ([]byte, error) {
+		rd, err := decryptSnapshot(bufio.NewReader(bytes.NewReader(snap)))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(rd)
+	}
+
+	// Without encryption, the snapshot is kept as is.
+	encryptionKeys = nil
+	plain := snapshot()
+	if !bytes.Equal(plain, data) {
+		t.Fatal("expected a plain snapshot")
+	}
+	out, err := restore(plain)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("plain snapshot: %v", err)
+	}
+
+	setTestKeys(t, testKey1)
+	snap := snapshot()
+	if !bytes.HasPrefix(snap, []byte(snapshotMagic)) ||
+		bytes.Contains(snap, []byte(testSecret)) {
+		t.Fatal("expected an encrypted snapshot")
+	}
+	out, err = restore(snap)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("encrypted snapshot: %v", err)
+	}
+
+	// A snapshot of an old key.
+	setTestKeys(t, testKey2, testKey1)
+	out, err = restore(snap)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("old key: %v", err)
+	}
+
+	// Changed, truncated, and unknown snapshots.
+	bad := append([]byte(nil), snap...)
+	bad[len(bad)/2] ^= 1
+	if _, err := restore(bad); err == nil {
+		t.Fatal("expected an error for a changed snapshot")
+	}
+	last := len(snapshotMagic) + 8 + 16 + 4 + snapshotChunkSize + 16
+	if _, err := restore(snap[:last]); err == nil {
+		t.Fatal("expected an error for a truncated snapshot")
+	}
+	setTestKeys(t, testKey2)
+	if _, err := restore(snap); err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+	encryptionKeys = nil
+	if _, err := restore(snap); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+// static int uhasql_enable_load_extension(sqlite3 *db, int onoff) {
+//     return sqlite3_db_config(db, SQLITE_DBCONFIG_ENABLE_LOAD_EXTENSION,
+//         onoff, (int*)0);
+// }
+import "C"
+
+// extension is a Sqlite extension that is allowed by the --extensions flag.
+type extension struct {
+	path   string
+	sha256 string
+}
+
+// extensionsFlag is the comma-separated list of extension files.
+var extensionsFlag string
+
+// extensions are loaded, in order, into every database connection.
+var extensions []extension
+
+// checkExtensionFlags reads the checksums of the extension files.
+func checkExtensionFlags() error {
+	if extensionsFlag == "" {
+		return nil
+	}
+	for _, path := range strings.Split(extensionsFlag, ",") {
+		path, err := filepath.Abs(strings.TrimSpace(path))
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return fmt.Errorf("extension: %s", err)
+		}
+		extensions = append(extensions, extension{path: path, sha256: sum})
+	}
+	return nil
+}
+
+// loadExtensions loads the allowed extensions. Only the C interface is
+// enabled while loading, the load_extension() SQL function is never allowed.
+func (db *sqlDatabase) loadExtensions() error {
+	if len(extensions) == 0 {
+		return nil
+	}
+	C.uhasql_enable_load_extension(db.db, 1)
+	defer C.uhasql_enable_load_extension(db.db, 0)
+	for _, ext := range extensions {
+		cpath := C.CString(ext.path)
+		var cerr *C.char
+		rc := C.sqlite3_load_extension(db.db, cpath, nil, &cerr)
+		C.free(unsafe.Pointer(cpath))
+		if rc != C.SQLITE_OK {
+			msg := C.GoString(cerr)
+			C.sqlite3_free(unsafe.Pointer(cerr))
+			return fmt.Errorf("extension: %s", msg)
+		}
+	}
+	return nil
+}
+
+func (db *sqlDatabase) ensureExtensionSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __extensions__ (
+			pos        INTEGER PRIMARY KEY,
+			sha256     TEXT
+		);
+	`, nil)
+}
+
+// pinnedExtensions returns the checksums of the extensions that are pinned
+// for the cluster.
+func (db *sqlDatabase) pinnedExtensions() ([]string, error) {
+	var sums []string
+	err := db.exec(`select sha256 from __extensions__ order by pos`,
+		func(row []string) bool {
+			sums = append(sums, row[0])
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return sums[1:], nil
+}
+
+// extensionsMatch returns true if the extensions of this server have the
+// provided checksums.
+func extensionsMatch(sums []string) bool {
+	if len(sums) != len(extensions) {
+		return false
+	}
+	for i, ext := range extensions {
+		if ext.sha256 != sums[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// errExtensionsMismatch is the local fault of a server with extensions that
+// do not match the extensions that are pinned for the cluster.
+var errExtensionsMismatch = errors.New("extensions do not match the " +
+	"pinned extensions of the cluster")
+
+// checkPinnedExtensions records a local fault when the extensions of this
+// server do not match the extensions that are pinned for the cluster, which
+// refuses reads. The dbmu lock must be held.
+func checkPinnedExtensions() error {
+	sums, err := wdb.pinnedExtensions()
+	if err != nil {
+		return err
+	}
+	if len(sums) == 0 && len(extensions) > 0 {
+		logger.Warningf("extensions are not pinned, try EXTENSIONS PIN")
+	}
+	var fault error
+	if len(sums) > 0 && !extensionsMatch(sums) {
+		fault = errExtensionsMismatch
+	}
+	setLocalFault("extensions", fault)
+	return nil
+}
+
+// pinMAC returns the proof that the checksums of a $EXTENSIONS command were
+// checked by EXTENSIONS PIN, which is keyed by the cluster secret.
+func pinMAC(sums []string) string {
+	mac := hmac.New(sha256.New, clusterSecret)
+	mac.Write([]byte("extensions pin"))
+	for _, sum := range sums {
+		mac.Write([]byte{0})
+		mac.Write([]byte(sum))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// EXTENSIONS [LIST|PIN]
+// help: returns the extensions of this server with the sha256 checksum of
+// each, and whether they match the extensions that are pinned for the
+// cluster. PIN records the extensions of this server, which must be the
+// leader, as the extensions of the cluster. A server that does not have the
+// same extensions refuses reads, which prevents it from returning results
+// that differ from the other servers.
+func cmdEXTENSIONS(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) > 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if len(args) == 2 && strings.ToLower(args[1]) == "pin" {
+		if err := connAdmin(m); err != nil {
+			return nil, err
+		}
+		// The files may have changed since the server started.
+		var sums []string
+		for _, ext := range extensions {
+			sum, err := fileSHA256(ext.path)
+			if err != nil {
+				return nil, fmt.Errorf("extension: %s", err)
+			}
+			if sum != ext.sha256 {
+				return nil, fmt.Errorf("extension: '%s' changed since "+
+					"the server started", ext.path)
+			}
+			sums = append(sums, sum)
+		}
+		fargs := append([]string{args[0], pinMAC(sums)}, sums...)
+		return uhaha.FilterArgs(userArgs(m, "$EXTENSIONS", fargs)), nil
+	}
+	if len(args) == 2 && strings.ToLower(args[1]) != "list" {
+		return nil, fmt.Errorf("unknown extensions command '%s'", args[1])
+	}
+	db, err := takeReaderDB()
+	if err != nil {
+		return nil, err
+	}
+	rlockDB()
+	sums, err := db.pinnedExtensions()
+	dbmu.RUnlock()
+	releaseReaderDB(db)
+	if err != nil {
+		return nil, err
+	}
+	list := []interface{}{}
+	for _, ext := range extensions {
+		list = append(list, []interface{}{"path", ext.path,
+			"sha256", ext.sha256})
+	}
+	return []interface{}{"extensions", list,
+		"pinned", extensionsMatch(sums)}, nil
+}
+
+// cmdPINEXTENSIONS pins the checksums that were checked by EXTENSIONS PIN,
+// which are rejected when they come from anywhere else.
+func cmdPINEXTENSIONS(m uhaha.Machine, args []string) (interface{}, error) {
+	// WRITE
+	if len(args) < 2 || !hmac.Equal([]byte(args[1]),
+		[]byte(pinMAC(args[2:]))) {
+		return nil, errors.New("invalid extensions, try EXTENSIONS PIN")
+	}
+	sums := args[2:]
+	if err := wdb.exec(`delete from __extensions__`, nil); err != nil {
+		return nil, err
+	}
+	for i, sum := range sums {
+		err := wdb.execArgs(`insert into __extensions__ (pos, sha256)
+			values (?, ?)`, []interface{}{int64(i), sum}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPinnedExtensions(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/uhaha"
+)
+
+// httpMaxBody is the max size of a request body.
+const httpMaxBody = 64 * 1024 * 1024
+
+// tlsEnabled is true when the server uses TLS. It's used for building the
+// leader redirect urls.
+var tlsEnabled bool
+
+// httpService provides an HTTP/JSON service that shares the same network
+// port as the Redis service.
+func httpService() (
+	sniff func(rd io.Reader) bool,
+	acceptor func(s uhaha.Service, ln net.Listener),
+) {
+	return httpSniff, func(s uhaha.Service, ln net.Listener) {
+		setLocalService(s)
+		srv := &http.Server{Handler: &httpHandler{s: s},
+			ConnContext: httpConnContext}
+		s.Log().Fatal(srv.Serve(ln))
+	}
+}
+
+// httpSniff returns true when the connection starts with an HTTP method.
+func httpSniff(rd io.Reader) bool {
+	var buf [4]byte
+	if _, err := io.ReadFull(rd, buf[:]); err != nil {
+		return false
+	}
+	switch string(buf[:]) {
+	case "GET ", "HEAD", "POST", "PUT ", "DELE", "OPTI", "PATC":
+		return true
+	}
+	return false
+}
+
+type httpHandler struct {
+	s uhaha.Service
+}
+
+// httpClient is used as the SendOptions.From for a single request, which
+// ensures that a read follows the writes from the same request.
+type httpClient struct {
+	opts uhaha.SendOptions
+	ctx  *connContext
+}
+
+type httpStatusError struct {
+	status int
+	err    error
+}
+
+func (err *httpStatusError) Error() string {
+	return err.err.Error()
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, token, err := h.auth(r)
+	if err != nil {
+		httpWriteError(w, r, &httpStatusError{http.StatusUnauthorized, err})
+		return
+	}
+	if cl, ok := r.Context().Value(certLoginKey{}).(certLogin); ok &&
+		user == "" {
+		user, token = cl.user, cl.token
+	}
+	context, accept := h.s.Opened(r.RemoteAddr)
+	if !accept {
+		httpWriteError(w, r, &httpStatusError{http.StatusForbidden,
+			errors.New("connection not accepted")})
+		return
+	}
+	defer h.s.Closed(context, r.RemoteAddr)
+	client := new(httpClient)
+	client.opts.From = client
+	client.opts.Context = context
+	client.ctx, _ = context.(*connContext)
+	if client.ctx == nil {
+		client.ctx = &connContext{addr: r.RemoteAddr}
+	}
+	client.ctx.user, client.ctx.token = user, token
+	r.Body = http.MaxBytesReader(w, r.Body, httpMaxBody)
+
+	var res interface{}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "query" && r.Method == http.MethodPost:
+		res, err = h.query(client, r)
+	case path == "exec" && r.Method == http.MethodPost:
+		res, err = h.exec(client, r)
+	case parts[0] == "proc":
+		res, err = h.proc(client, r, parts[1:])
+	default:
+		err = &httpStatusError{http.StatusNotFound, errors.New("not found")}
+	}
+	if err != nil {
+		httpWriteError(w, r, err)
+		return
+	}
+	httpWriteJSON(w, http.StatusOK, res)
+}
+
+// auth authenticates the request. Basic auth with the name of a user logs in
+// as that user. Otherwise the request must have the auth of the server, and
+// it has no user.
+func (h *httpHandler) auth(r *http.Request) (user, token string, err error) {
+	if name, password, ok := r.BasicAuth(); ok && userExists(name) {
+		token, err := login(name, password)
+		return name, token, err
+	}
+	return "", "", h.s.Auth(httpAuth(r))
+}
+
+// httpAuth returns the auth token from either a bearer token or the password
+// of basic auth.
+func httpAuth(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return auth[7:]
+	}
+	if strings.HasPrefix(auth, "Basic ") {
+		data, err := base64.StdEncoding.DecodeString(auth[6:])
+		if err == nil {
+			if i := strings.IndexByte(string(data), ':'); i != -1 {
+				return string(data[i+1:])
+			}
+		}
+	}
+	return ""
+}
+
+// send sends the command to the service, following any FilterArgs.
+func (h *httpHandler) send(client *httpClient, args []string,
+) (interface{}, error) {
+	for {
+		res, _, err := h.s.Send(args, &client.opts).Recv()
+		if err != nil {
+			return nil, err
+		}
+		fargs, ok := res.(uhaha.FilterArgs)
+		if !ok {
+			return res, nil
+		}
+		args = fargs
+	}
+}
+
+// POST /query
+// {"statements": [...], "consistency": "leader", "index": 0}
+// Each statement is either a sql string, or an array with the sql string
+// followed by the bound parameters.
+func (h *httpHandler) query(client *httpClient, r *http.Request,
+) (interface{}, error) {
+	var req struct {
+		Statements  []json.RawMessage `json:"statements"`
+		Consistency string            `json:"consistency"`
+		Index       uint64            `json:"index"`
+	}
+	if err := httpReadJSON(r, &req); err != nil {
+		return nil, err
+	}
+	sqlJSON, readonly, err := httpStatements(req.Statements)
+	if err != nil {
+		return nil, err
+	}
+	if !readonly {
+		return nil, &httpStatusError{http.StatusBadRequest,
+			errors.New("query only allows read-only statements")}
+	}
+	mode := strings.ToLower(req.Consistency)
+	switch mode {
+	case "":
+		mode = "leader"
+	case "linearizable", "leader", "stale", "session":
+	default:
+		return nil, &httpStatusError{http.StatusBadRequest,
+			fmt.Errorf("invalid consistency '%s'", req.Consistency)}
+	}
+	res, err := queryWithMode(client.ctx, mode, req.Index, sqlJSON, false)
+	if err != nil {
+		return nil, err
+	}
+	if args, ok := res.(uhaha.FilterArgs); ok {
+		res, err = h.send(client, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return httpResults(res), nil
+}
+
+// POST /exec
+// {"statements": [...], "info": false}
+func (h *httpHandler) exec(client *httpClient, r *http.Request,
+) (interface{}, error) {
+	var req struct {
+		Statements []json.RawMessage `json:"statements"`
+		Info       bool              `json:"info"`
+	}
+	if err := httpReadJSON(r, &req); err != nil {
+		return nil, err
+	}
+	sqlJSON, _, err := httpStatements(req.Statements)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"$EXEC", sqlJSON}
+	if req.Info {
+		args = append(args, "withinfo")
+	}
+	res, err := h.send(client, client.ctx.options(args...))
+	if err != nil {
+		return nil, err
+	}
+	return httpResults(res), nil
+}
+
+// GET    /proc              -- returns the names of all procs
+// GET    /proc/name         -- gets a proc
+// PUT    /proc/name         -- sets a proc, {"script": "..."}
+// DELETE /proc/name         -- deletes a proc
+// POST   /proc/name/exec    -- executes a proc, {"args": [...]}
+func (h *httpHandler) proc(client *httpClient, r *http.Request,
+	parts []string,
+) (interface{}, error) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		res, err := h.send(client, []string{"PROC", "LIST"})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"procs": res}, nil
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		res, err := h.send(client, []string{"PROC", "GET", parts[0]})
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			return nil, &httpStatusError{http.StatusNotFound,
+				errors.New("proc not found")}
+		}
+		return map[string]interface{}{"name": parts[0], "script": res}, nil
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var req struct {
+			Script string `json:"script"`
+		}
+		if err := httpReadJSON(r, &req); err != nil {
+			return nil, err
+		}
+		_, err := h.send(client, []string{"PROC", "SET", parts[0], req.Script})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"ok": true}, nil
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		_, err := h.send(client, []string{"PROC", "DEL", parts[0]})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"ok": true}, nil
+	case len(parts) == 2 && parts[1] == "exec" && r.Method == http.MethodPost:
+		var req struct {
+			Args []string `json:"args"`
+		}
+		if err := httpReadJSON(r, &req); err != nil {
+			return nil, err
+		}
+		args := append([]string{"PROC", "EXEC", parts[0]}, req.Args...)
+		res, err := h.send(client, args)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": res}, nil
+	}
+	return nil, &httpStatusError{http.StatusNotFound, errors.New("not found")}
+}
+
+// httpStatements validates the request statements and converts them into the
+// JSON format used by the $EXEC and $QUERY commands.
+func httpStatements(stmts []json.RawMessage) (sqlJSON string, readonly bool,
+	err error,
+) {
+	sqlJSON, readonly, err = jsonStatements(stmts)
+	if err != nil {
+		return "", false, &httpStatusError{http.StatusBadRequest, err}
+	}
+	return sqlJSON, readonly, nil
+}
+
+// httpResults converts the resultsets from sqlExec into JSON objects.
+func httpResults(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		if len(v) == 4 && v[0] == "applied" {
+			// with info
+			return map[string]interface{}{
+				"applied": v[1],
+				"results": httpResults(v[3]),
+			}
+		}
+		results := make([]interface{}, len(v))
+		for i, rs := range v {
+			results[i] = httpResult(rs)
+		}
+		return map[string]interface{}{"results": results}
+	case []string:
+		return map[string]interface{}{"results": []interface{}{}}
+	}
+	return v
+}
+
+func httpResult(v interface{}) interface{} {
+	switch v := v.(type) {
+	case [][]string:
+		res := map[string]interface{}{
+			"columns": []string{},
+			"rows":    [][]string{},
+		}
+		if len(v) > 0 {
+			res["columns"] = v[0]
+			res["rows"] = v[1:]
+		}
+		return res
+	case []interface{}:
+		// with info: "rows", rows, "changes", n, ...
+		res := make(map[string]interface{})
+		for i := 0; i+1 < len(v); i += 2 {
+			key, _ := v[i].(string)
+			if key == "rows" {
+				for k, v := range httpResult(v[i+1]).(map[string]interface{}) {
+					res[k] = v
+				}
+			} else {
+				res[key] = v[i+1]
+			}
+		}
+		return res
+	}
+	return v
+}
+
+func httpReadJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &httpStatusError{http.StatusBadRequest,
+			fmt.Errorf("invalid json: %v", err)}
+	}
+	return nil
+}
+
+func httpWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// httpWriteError writes the error as JSON. Errors from a follower that point
+// to the leader are returned as a 307 redirect.
+func httpWriteError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	msg := err.Error()
+	var leader string
+	if strings.HasPrefix(msg, "MOVED ") {
+		if parts := strings.Split(msg, " "); len(parts) == 3 {
+			leader = parts[2]
+		}
+	} else if strings.HasPrefix(msg, "TRY ") {
+		leader = msg[4:]
+	}
+	switch {
+	case leader != "":
+		scheme := "http"
+		if tlsEnabled {
+			scheme = "https"
+		}
+		w.Header().Set("Location", scheme+"://"+leader+r.URL.RequestURI())
+		status = http.StatusTemporaryRedirect
+	case strings.HasPrefix(msg, "CLUSTERDOWN "):
+		status = http.StatusServiceUnavailable
+	case err == uhaha.ErrUnknownCommand:
+		status = http.StatusNotFound
+	default:
+		if err, ok := err.(*httpStatusError); ok {
+			status = err.status
+		}
+	}
+	httpWriteJSON(w, status, map[string]interface{}{"error": msg})
+}
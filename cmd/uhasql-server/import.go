@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+)
+
+// importPath is the existing SQLite database that is provided by the
+// --import-sqlite flag.
+var importPath string
+
+// importReady is true when the import should seed the initial state of the
+// node. This only happens when the node starts with an empty data directory.
+var importReady bool
+
+// dataDirEmpty returns true when the data directory does not have a Raft log
+// or any snapshots, which means that the node is brand new.
+func dataDirEmpty(dir string) bool {
+	for _, name := range []string{"store", "snapshots"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// importSQLite seeds the initial state of a brand new single node cluster
+// from an existing SQLite database. The database is stored in the Raft
+// snapshot store as the very first snapshot, which is then loaded by Raft at
+// startup using the standard restore(). Followers that join later will
+// receive the data from the leader as a snapshot instead of statement by
+// statement.
+func importSQLite(dir, addr string) error {
+	path := filepath.Join(dir, "import.db")
+	removeDBFiles(path)
+	defer removeDBFiles(path)
+	if err := copyFile(path, importPath); err != nil {
+		return err
+	}
+	// Opening the database will validate the file, create the __proc__ table
+	// if it's missing, and convert it to WAL mode.
+	db, err := openSQLDatabase(path, false)
+	if err != nil {
+		return err
+	}
+	if err := db.checkpoint(); err != nil {
+		db.close()
+		return err
+	}
+	if err := db.close(); err != nil {
+		return err
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, 3, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	_, trans := raft.NewInmemTransport("")
+	var config raft.Configuration
+	config.Servers = []raft.Server{{
+		Suffrage: raft.Voter,
+		ID:       raft.ServerID(filepath.Base(dir)),
+		Address:  raft.ServerAddress(addr),
+	}}
+	sink, err := snaps.Create(1, 1, 1, config, 1, trans)
+	if err != nil {
+		return err
+	}
+	if err := writeImportSnapshot(sink, path); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// writeImportSnapshot writes the database file using the same format as a
+// Uhaha snapshot, which is a gzipped 32 byte header followed by the data that
+// is written by snap.Persist.
+func writeImportSnapshot(wr io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(wr)
+	var head [32]byte
+	copy(head[:], "SNAP0001")
+	if _, err := gw.Write(head[:]); err != nil {
+		return err
+	}
+	ew, err := encryptSnapshot(gw)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, f); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func removeDBFiles(path string) {
+	os.Remove(path)
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+}
+
+func copyFile(dst, src string) error {
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fsrc.Close()
+	fdst, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fdst, fsrc); err != nil {
+		fdst.Close()
+		return err
+	}
+	return fdst.Close()
+}
+
+// checkImportFlags makes sure that --import-sqlite is not used with flags
+// that would also provide the initial state of the node.
+func checkImportFlags() error {
+	if importPath == "" {
+		return nil
+	}
+	if f := flag.Lookup("j"); f != nil && f.Value.String() != "" {
+		return errors.New("flag --import-sqlite cannot be used with -j flag")
+	}
+	if f := flag.Lookup("restore"); f != nil && f.Value.String() != "" {
+		return errors.New(
+			"flag --import-sqlite cannot be used with --restore flag")
+	}
+	if _, err := os.Stat(importPath); err != nil {
+		return err
+	}
+	return nil
+}
+
+// advertiseAddr returns the address that Raft uses to identify this server.
+func advertiseAddr(addr string) string {
+	if f := flag.Lookup("advertise"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	return addr
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/uhaha"
+)
+
+// #include "../../sqlite/sqlite.h"
+import "C"
+
+// SQLINFO
+// help: returns the statistics of this server and of each of its databases,
+// which are the page count, page size, freelist count, WAL frames, schema
+// version, row estimate of each table, pooled readers, and the memory used by
+// prepared statements and the page cache hits and misses of the writer. The
+// faults are the problems with the files of this server, such as extensions
+// that don't match the pinned extensions.
+func cmdSQLINFO(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	rdbsMu.Lock()
+	pooled := len(rdbs)
+	rdbsMu.Unlock()
+	rdb, err := takeReaderDB()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseReaderDB(rdb)
+	rlockDB()
+	defer dbmu.RUnlock()
+	var procs int64
+	err = rdb.exec("select count(*) from __proc__", func(row []string) bool {
+		procs, _ = strconv.ParseInt(row[0], 10, 64)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, err := rdb.info(defaultDBName, dbPath, wdb, pooled)
+	if err != nil {
+		return nil, err
+	}
+	databases := []interface{}{info}
+	var names []string
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := dbs[name]
+		d.rdbsMu.Lock()
+		pooled := len(d.rdbs)
+		d.rdbsMu.Unlock()
+		db, err := d.takeReader()
+		if err != nil {
+			return nil, err
+		}
+		info, err := db.info(name, d.path, d.wdb, pooled)
+		d.releaseReader(db)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, info)
+	}
+	metricsMu.Lock()
+	var snapTime string
+	if !snapshotTime.IsZero() {
+		snapTime = snapshotTime.UTC().Format(time.RFC3339)
+	}
+	snapIndex := snapshotIndex
+	metricsMu.Unlock()
+	appliedMu.Lock()
+	index := applied
+	appliedMu.Unlock()
+	return []interface{}{
+		"version", buildVersion,
+		"git_sha", buildGitSHA,
+		"sqlite_version", C.GoString(C.sqlite3_libversion()),
+		"applied_index", index,
+		"last_snapshot_time", snapTime,
+		"last_snapshot_index", snapIndex,
+		"procs", procs,
+		"faults", localFaultList(),
+		"databases", databases,
+	}, nil
+}
+
+// walFrames returns the number of frames in a WAL file. Each frame is a 24
+// byte header and a page, following the 32 byte header of the file. An
+// encrypted WAL file also starts with the header of the encryption, and each
+// page is followed by its nonce and tag. See vfs.go.
+func walFrames(path string, pageSize int64) int64 {
+	size := fileSize(path)
+	if pageSize == 0 {
+		return 0
+	}
+	frame := 24 + pageSize
+	if id, _ := fileKeyID(path); id != nil {
+		size -= fileHeaderSize
+		frame += blockExtra
+	}
+	if size <= 32 {
+		return 0
+	}
+	return (size - 32) / frame
+}
+
+// info returns the statistics of a database, using a reader of the database.
+// The writer provides the statement and page cache statistics. The pooled
+// readers are the readers that are not in use.
+func (db *sqlDatabase) info(name, path string, w *sqlDatabase, pooled int,
+) ([]interface{}, error) {
+	pragmas := []string{"page_count", "page_size", "freelist_count",
+		"schema_version"}
+	vals := make(map[string]int64)
+	for _, pragma := range pragmas {
+		var header bool
+		err := db.exec("pragma "+pragma, func(row []string) bool {
+			if header {
+				vals[pragma], _ = strconv.ParseInt(row[0], 10, 64)
+			}
+			header = true
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	frames := walFrames(path+"-wal", vals["page_size"])
+	tables, err := db.rowEstimates()
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		"name", name,
+		"page_count", vals["page_count"],
+		"page_size", vals["page_size"],
+		"freelist_count", vals["freelist_count"],
+		"wal_frames", frames,
+		"schema_version", vals["schema_version"],
+		"pooled_readers", pooled,
+		"max_readers", rdbMaxPool,
+		"stmt_memory", w.status(C.SQLITE_DBSTATUS_STMT_USED),
+		"cache_memory", w.status(C.SQLITE_DBSTATUS_CACHE_USED),
+		"cache_hits", w.status(C.SQLITE_DBSTATUS_CACHE_HIT),
+		"cache_misses", w.status(C.SQLITE_DBSTATUS_CACHE_MISS),
+		"tables", tables,
+	}, nil
+}
+
+// status returns the current value of a Sqlite status of the connection.
+func (db *sqlDatabase) status(op C.int) int64 {
+	var cur, hi C.int
+	C.sqlite3_db_status(db.db, op, &cur, &hi, 0)
+	return int64(cur)
+}
+
+// rowEstimates returns the name and estimated number of rows of each table,
+// other than the internal tables. The estimate is from the sqlite_stat1 table
+// when the table was analyzed, otherwise it's the largest rowid. It's nil
+// for a table without a rowid that was not analyzed.
+func (db *sqlDatabase) rowEstimates() ([]interface{}, error) {
+	var names []string
+	var stat1, header bool
+	err := db.exec(`select name from sqlite_master where type = 'table'
+		order by name`, func(row []string) bool {
+		switch {
+		case !header:
+			header = true
+		case row[0] == "sqlite_stat1":
+			stat1 = true
+		case strings.HasPrefix(row[0], "sqlite_"), internalTable(row[0]):
+		default:
+			names = append(names, row[0])
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]int64)
+	if stat1 {
+		header = false
+		err := db.exec(`select tbl, stat from sqlite_stat1`,
+			func(row []string) bool {
+				stat := strings.Fields(row[1])
+				if header && len(stat) > 0 {
+					n, err := strconv.ParseInt(stat[0], 10, 64)
+					if err == nil {
+						stats[row[0]] = n
+					}
+				}
+				header = true
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	tables := []interface{}{}
+	for _, name := range names {
+		var rows interface{}
+		if n, ok := stats[name]; ok {
+			rows = n
+		} else {
+			var header bool
+			db.exec("select max(rowid) from "+quoteIdent(name),
+				func(row []string) bool {
+					if header {
+						n, _ := strconv.ParseInt(row[0], 10, 64)
+						rows = n
+					}
+					header = true
+					return true
+				})
+		}
+		tables = append(tables, []interface{}{"name", name, "rows", rows})
+	}
+	return tables, nil
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/robertkrimen/otto"
@@ -18,6 +24,7 @@ import (
 	"github.com/tidwall/uhaha"
 )
 
+// #cgo CFLAGS: -DSQLITE_ENABLE_PREUPDATE_HOOK
 // #cgo LDFLAGS: -L../../sqlite -lsqlite -ldl
 // #include "../../sqlite/sqlite.h"
 // #include <stdint.h>
@@ -33,39 +40,289 @@ var buildGitSHA string
 
 var dbmu sync.RWMutex
 var dbPath string
+var dataDir string
 var wdb *sqlDatabase
+var logger uhaha.Logger
+
+// applied is the index of the last tick or write command that was applied to
+// the database. It's identical on every server in the cluster. It's only
+// changed using setApplied, and other goroutines must hold the appliedMu lock
+// to read it.
+var applied uint64
+var appliedMu sync.Mutex
+var appliedCond = sync.NewCond(&appliedMu)
+
+// persisted is the applied index that was recorded in the database file when
+// the server started. Commands up to this index are already in the database
+// and are skipped while the Raft log is replayed.
+var persisted uint64
 
 var errTooMuchInput = errors.New("too much input")
 
+const usage = `
+UhaSQL options:
+  --import-sqlite path : seed a brand new single-node cluster with an existing
+                         SQLite database. The database is replicated to the
+                         other nodes as a snapshot. This operation is ignored
+                         when a data directory already exists. Cannot be used
+                         with -j or --restore flags.
+  --pgwire             : accept PostgreSQL wire protocol connections on the
+                         same port. When the server uses TLS, clients must
+                         use direct TLS negotiation.
+  --extensions paths   : comma-separated list of Sqlite extension files that
+                         are loaded into every database connection. Every
+                         server must use the same extensions.
+  --encryption-key keys: comma-separated list of hex encoded 32 byte keys
+                         that encrypt the database files and snapshots. The
+                         first key is the current key, the others are old
+                         keys. Every server must use the same keys.
+  --encryption-key-file path
+                       : file with the encryption keys, one on each line.
+                         Cannot be used with --encryption-key.
+  --tls-client-ca path : require client certificates that are signed by the
+                         CA certificate. The common name of a certificate is
+                         the user of the connection. Requires --tls-cert.
+  --slowlog-threshold ms
+                       : log each statement that takes longer than the
+                         milliseconds, and keep it for SLOWLOG GET. Zero
+                         turns off the slow log.  (default: 0)
+  --slowlog-max-len n  : number of slow log entries that are kept
+                         (default: 128)
+  --checksum-interval n: number of Raft indexes between the checksums of the
+                         databases, which are compared with the other
+                         servers to detect replicas that diverge. Zero turns
+                         off the checksums.  (default: 1000)
+
+SQLite options:
+  --sqlite-config path : JSON file with any of the following settings, using
+                         the same names with underscores. Flags take
+                         precedence over the file.
+  --page-size n        : database page size  (default: 4096)
+  --cache-size n       : page cache size, negative is KiB  (default: -2000)
+  --auto-vacuum mode   : auto vacuum mode  (default: full) [none,full,
+                         incremental]
+  --mmap-size n        : max bytes for memory-mapped I/O  (default: 0)
+  --synchronous level  : synchronous level  (default: off) [off,normal,full,
+                         extra]
+                         The page size and auto vacuum mode are only used
+                         when the database is created.
+`
+
 func main() {
 	var conf uhaha.Config
 	conf.Name = "uhasql-server"
 	conf.Version = strings.Replace(buildVersion, "v", "", -1)
 	conf.GitSHA = buildGitSHA
+	conf.Flag.Usage = func(s string) string {
+		return s + usage
+	}
+	conf.Flag.PreParse = func() {
+		flag.StringVar(&importPath, "import-sqlite", "", "")
+		flag.BoolVar(&pgEnabled, "pgwire", false, "")
+		flag.StringVar(&extensionsFlag, "extensions", "", "")
+		flag.StringVar(&encryptionKeyFlag, "encryption-key", "", "")
+		flag.StringVar(&encryptionKeyFileFlag, "encryption-key-file", "", "")
+		flag.StringVar(&tlsClientCAFlag, "tls-client-ca", "", "")
+		flag.IntVar(&slowlogThresholdFlag, "slowlog-threshold", 0, "")
+		flag.IntVar(&slowlogMaxLenFlag, "slowlog-max-len", 128, "")
+		flag.IntVar(&checksumIntervalFlag, "checksum-interval", 1000, "")
+		addSQLConfigFlags()
+	}
+	conf.Flag.PostParse = func() {
+		if err := checkImportFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if err := loadSQLConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if err := checkExtensionFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if err := checkEncryptionFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if err := checkTLSFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		setClusterSecret()
+		if checksumIntervalFlag < 0 {
+			fmt.Fprintf(os.Stderr, "invalid --checksum-interval, "+
+				"must not be negative\n")
+			os.Exit(1)
+		}
+		if err := checkSlowlogFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+	conf.LogReady = func(log uhaha.Logger) {
+		logger = log
+	}
 	conf.DataDirReady = func(dir string) {
-		os.RemoveAll(filepath.Join(dir, "db"))
-		os.Mkdir(filepath.Join(dir, "db"), 0777)
+		dataDir = dir
+		empty := dataDirEmpty(dir)
+		if importPath != "" {
+			if empty {
+				importReady = true
+			} else {
+				logger.Warningf("import ignored: "+
+					"data directory already exists: path=%s", dir)
+			}
+		}
+		if empty {
+			// Brand new node. Remove any leftover database.
+			os.RemoveAll(filepath.Join(dir, "db"))
+		}
+		os.MkdirAll(filepath.Join(dir, "db"), 0777)
 		dbPath = filepath.Join(dir, "db", "sqlite.db")
+		must(nil, checkEncryption(dbPath))
 		wdb = must(openSQLDatabase(dbPath, false)).(*sqlDatabase)
+		persisted = uint64(must(wdb.readMeta("index")).(int64))
+		must(nil, loadDatabases())
+		if err := loadRefDBs(); err != nil {
+			logger.Warningf("reference databases: %s", err)
+		}
+		must(nil, checkPinnedExtensions())
+		must(nil, loadUsers())
+		must(nil, loadAudit())
+		if persisted > 0 {
+			logger.Printf("database loaded: index=%d", persisted)
+		}
 	}
+	conf.ServerReady = func(addr, auth string, tlscfg *tls.Config) {
+		tlsEnabled = tlscfg != nil
+		if tlsEnabled && pgEnabled {
+			// Allows for PostgreSQL clients to use direct TLS negotiation,
+			// which requires the "postgresql" protocol. HTTP clients usually
+			// provide protocols too.
+			tlscfg.NextProtos = append(tlscfg.NextProtos,
+				"http/1.1", "postgresql")
+		}
+		if tlsEnabled {
+			requireClientCerts(tlscfg)
+		}
+		clusterDial.addr = advertiseAddr(addr)
+		clusterDial.auth = auth
+		clusterDial.tlscfg = tlscfg
+		if checksumIntervalFlag > 0 {
+			go watchChecksums()
+		}
+		if importReady {
+			logger.Printf("importing sqlite: path=%s", importPath)
+			must(nil, importSQLite(dataDir, advertiseAddr(addr)))
+			logger.Printf("import successful")
+		}
+	}
+	conf.ConnOpened = connOpened
 	conf.Tick = tick
 	conf.Snapshot = snapshot
 	conf.Restore = restore
 
-	// Do not call $EXEC, $QUERY, or $ANY directly.
-	conf.AddWriteCommand("$EXEC", cmdEXEC)
-	conf.AddReadCommand("$QUERY", cmdQUERY)
+	// Do not call $EXEC, $QUERY, $ANY, or the other $ commands directly.
+	conf.AddWriteCommand("$EXEC",
+		measureCommand("write", dbWriteCommand(cmdEXEC)))
+	conf.AddReadCommand("$QUERY", measureCommand("read", cmdQUERY))
 	conf.AddIntermediateCommand("$ANY", cmdANY)
-	conf.AddWriteCommand("PROC", cmdPROC)
+	conf.AddIntermediateCommand("PROC", cmdPROCREAD)
+	conf.AddWriteCommand("$PROC", writeCommand(userCommand(cmdPROC)))
+	conf.AddIntermediateCommand("TTL", userForward("$TTL"))
+	conf.AddWriteCommand("$TTL", writeCommand(adminCommand(cmdTTL)))
+	conf.AddIntermediateCommand("SCHEDULE", userForward("$SCHEDULE"))
+	conf.AddWriteCommand("$SCHEDULE",
+		writeCommand(adminCommand(cmdSCHEDULE)))
+	conf.AddIntermediateCommand("DB", userForward("$DB"))
+	conf.AddWriteCommand("$DB", writeCommand(adminCommand(cmdDB)))
+	conf.AddIntermediateCommand("USE", cmdUSE)
+	conf.AddIntermediateCommand("REFDB", cmdREFDB)
+	conf.AddWriteCommand("$REFDB",
+		refdbWriteCommand(adminCommand(cmdREFDBWRITE)))
+	conf.AddIntermediateCommand("EXTENSIONS", cmdEXTENSIONS)
+	conf.AddWriteCommand("$EXTENSIONS",
+		writeCommand(adminCommand(cmdPINEXTENSIONS)))
+	conf.AddIntermediateCommand("LOGIN", cmdLOGIN)
+	conf.AddIntermediateCommand("USER", cmdUSER)
+	conf.AddWriteCommand("$USER",
+		usersWriteCommand(adminCommand(cmdUSERWRITE)))
+	conf.AddIntermediateCommand("AUDIT", cmdAUDIT)
+	conf.AddWriteCommand("$AUDIT", writeCommand(adminCommand(cmdAUDITWRITE)))
+	conf.AddIntermediateCommand("SQLCONFIG", cmdSQLCONFIG)
+	conf.AddIntermediateCommand("SLOWLOG", cmdSLOWLOG)
+	conf.AddIntermediateCommand("ADVISE", cmdADVISE)
+	conf.AddIntermediateCommand("SQLINFO", cmdSQLINFO)
+	conf.AddIntermediateCommand("CHECKSUM", cmdCHECKSUM)
+	conf.AddIntermediateCommand("QUERY", cmdQUERYMODE)
+	conf.AddIntermediateCommand("EXEC", cmdEXECUTE)
+	conf.AddIntermediateCommand("CDC", cmdCDC)
+	conf.AddIntermediateCommand("SUBSCRIBE", cmdSUBSCRIBE)
+	conf.AddReadCommand("$APPLIED", cmdAPPLIED)
+	conf.AddIntermediateCommand("$READINDEX", cmdREADINDEX)
 	conf.AddCatchallCommand(cmdANY)
+	conf.AddService(metricsService())
+	conf.AddService(httpService())
+	conf.AddService(pgService())
 	uhaha.Main(conf)
 }
 
 func tick(m uhaha.Machine) {
+	lockDB()
+	defer dbmu.Unlock()
+	setApplied(applied + 1)
 	var info uhaha.RawMachineInfo
 	uhaha.ReadRawMachineInfo(m, &info)
 	C.uhaha_seed = C.int64_t(info.Seed)
 	C.uhaha_ts = C.int64_t(info.TS)
+	if applied <= persisted {
+		// The tick is already in the database.
+		return
+	}
+	if err := tickWrite(wdb.ttlSweep); err != nil {
+		logger.Warningf("ttl sweep: %s", err)
+	}
+	if err := tickWrite(wdb.runSchedules); err != nil {
+		logger.Warningf("schedule: %s", err)
+	}
+	recordChecksum()
+}
+
+// tickWrite runs a write from a tick. Like writeCommand, the write runs inside
+// of a transaction that records the applied index. The transaction is only
+// committed when fn returns true, otherwise it's rolled back.
+func tickWrite(fn func() (bool, error)) error {
+	if err := wdb.exec("begin", nil); err != nil {
+		return err
+	}
+	C.sqlite3_set_last_insert_rowid(wdb.db, 0)
+	beginRecording()
+	changed, err := fn()
+	recording = false
+	if err != nil || !changed {
+		rollbackWrites(writeMark{})
+		wdb.exec("rollback", nil)
+		return err
+	}
+	if err := wdb.foldChecksum(nil); err != nil {
+		wdb.exec("rollback", nil)
+		return err
+	}
+	if err := wdb.cdcFlush(); err != nil {
+		wdb.exec("rollback", nil)
+		return err
+	}
+	if err := wdb.saveState(); err != nil {
+		wdb.exec("rollback", nil)
+		return err
+	}
+	if err := wdb.exec("end", nil); err != nil {
+		rollbackWrites(writeMark{})
+		return err
+	}
+	publishPending()
+	return nil
 }
 
 func cmdANY(m uhaha.Machine, args []string) (interface{}, error) {
@@ -77,10 +334,138 @@ func cmdANY(m uhaha.Machine, args []string) (interface{}, error) {
 		}
 	}
 	sql := strings.TrimSpace(strings.Join(args, " "))
+	stmts, readonly, err := sqlStatements(sql)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) == 0 {
+		return []string{}, nil
+	}
+	data, _ := json.Marshal(stmts)
+	if readonly {
+		args = []string{"$QUERY", string(data)}
+	} else {
+		args = []string{"$EXEC", string(data)}
+	}
+	return uhaha.FilterArgs(conn(m).options(args...)), nil
+}
+
+// EXEC [WITHINFO] [WITHTYPES] sql
+// EXEC [WITHINFO] [WITHTYPES] JSON statements
+// help: executes the statements as a write, even when all of the statements
+// are read-only. With WITHINFO the response includes the applied index of
+// the write, which counts the ticks and writes that were applied by the
+// cluster and is not the Raft log index, and the changes, total changes, and
+// last insert rowid for each statement. With WITHTYPES each resultset
+// includes the declared column types. With JSON the statements are a JSON
+// array, where each statement is either a sql string, or an array with a sql
+// string followed by the bound parameters.
+func cmdEXECUTE(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	args = args[1:]
+	var opts []string
+	for len(args) > 0 {
+		opt := strings.ToLower(args[0])
+		if opt != "withinfo" && opt != "withtypes" {
+			break
+		}
+		opts = append(opts, opt)
+		args = args[1:]
+	}
+	sqlJSON, _, err := statementArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if sqlJSON == "" {
+		return []string{}, nil
+	}
+	args = append([]string{"$EXEC", sqlJSON}, opts...)
+	return uhaha.FilterArgs(conn(m).options(args...)), nil
+}
+
+// statementArgs returns the statements of the EXEC and QUERY commands in the
+// JSON format used by the $EXEC and $QUERY commands, or empty for no
+// statements. The args are either sql, or the JSON keyword followed by the
+// statements in the JSON format. Returns readonly=true if all statements only
+// read data.
+func statementArgs(args []string) (sqlJSON string, readonly bool,
+	err error,
+) {
+	if len(args) == 2 && strings.ToLower(args[0]) == "json" {
+		var stmts []json.RawMessage
+		if err := json.Unmarshal([]byte(args[1]), &stmts); err != nil {
+			return "", false, errors.New("invalid json statements")
+		}
+		return jsonStatements(stmts)
+	}
+	sql := strings.TrimSpace(strings.Join(args, " "))
+	stmts, readonly, err := sqlStatements(sql)
+	if err != nil || len(stmts) == 0 {
+		return "", readonly, err
+	}
+	data, _ := json.Marshal(stmts)
+	return string(data), readonly, nil
+}
 
-	readonly := true
-	var err error
-	stmts := []string{}
+// jsonStatements checks the statements in the JSON format and converts them
+// into the JSON format used by the $EXEC and $QUERY commands. Each statement
+// is either a sql string, or an array with a sql string followed by the bound
+// parameters. Returns readonly=true if all statements only read data.
+func jsonStatements(stmts []json.RawMessage) (sqlJSON string, readonly bool,
+	err error,
+) {
+	readonly = true
+	var all []interface{}
+	for _, stmt := range stmts {
+		var sql string
+		var params []json.RawMessage
+		if json.Unmarshal(stmt, &sql) != nil {
+			if err := json.Unmarshal(stmt, &params); err != nil ||
+				len(params) == 0 || json.Unmarshal(params[0], &sql) != nil {
+				return "", false, errors.New("invalid statement, expected " +
+					"a string or an array with a string followed by " +
+					"parameters")
+			}
+		}
+		sqls, ro, err := sqlStatements(sql)
+		if err != nil {
+			return "", false, err
+		}
+		readonly = readonly && ro
+		if params == nil {
+			for _, sql := range sqls {
+				all = append(all, sql)
+			}
+			continue
+		}
+		if len(sqls) != 1 {
+			return "", false, errors.New("statements with parameters must " +
+				"contain exactly one statement")
+		}
+		vals := []interface{}{sqls[0]}
+		for _, param := range params[1:] {
+			vals = append(vals, param)
+		}
+		all = append(all, vals)
+	}
+	if len(all) == 0 {
+		return "", false, errors.New("no statements")
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), readonly, nil
+}
+
+// sqlStatements splits the sql into statements and checks that each statement
+// is allowed. Returns readonly=true if all statements only read data.
+func sqlStatements(sql string) (stmts []string, readonly bool, err error) {
+	readonly = true
+	stmts = []string{}
 	sqlForEachStatement(sql, func(sql string) bool {
 		cmd := sqlCommand(sql)
 		switch cmd {
@@ -98,25 +483,65 @@ func cmdANY(m uhaha.Machine, args []string) (interface{}, error) {
 		return true
 	})
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	if len(stmts) == 0 {
-		return []string{}, nil
+	return stmts, readonly, nil
+}
+
+// writeCommand wraps a write command. The command runs inside of a
+// transaction that also records the applied index and the machine time and
+// random state in the __meta__ table. This allows for a restarted server to
+// keep its database and resume from the recorded index, rather than rebuilding
+// the database from the entire Raft log.
+func writeCommand(fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		lockDB()
+		defer dbmu.Unlock()
+		setApplied(applied + 1)
+		return applyWrite(wdb, &persisted, fn, m, args)
 	}
-	data, _ := json.Marshal(stmts)
-	if readonly {
-		args = []string{"$QUERY", string(data)}
-	} else {
-		args = []string{"$EXEC", string(data)}
+}
+
+// dbWriteCommand wraps the $EXEC command, which may write to a named
+// database. The database name is provided by the options that follow the sql.
+func dbWriteCommand(
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		lockDB()
+		defer dbmu.Unlock()
+		setApplied(applied + 1)
+		_, _, name := execOptions(args[2:])
+		if name == "" {
+			return applyWrite(wdb, &persisted, fn, m, args)
+		}
+		d, err := lookupDB(name)
+		if err != nil {
+			return nil, err
+		}
+		return applyWrite(d.wdb, &d.persisted, fn, m, args)
 	}
-	return uhaha.FilterArgs(args), nil
 }
 
-func cmdEXEC(m uhaha.Machine, args []string) (interface{}, error) {
-	// WRITE
+// applyWrite runs a write command on a database writer. The persisted index
+// is the applied index that was recorded in the database file. The dbmu lock
+// must be held.
+func applyWrite(w *sqlDatabase, persisted *uint64,
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+	m uhaha.Machine, args []string,
+) (interface{}, error) {
+	if applied <= *persisted {
+		// The command is already in the database.
+		if applied == *persisted {
+			return nil, w.loadMachineInfo(m)
+		}
+		return nil, nil
+	}
+	defer recordChecksum()
+
 	// Take special care to keep the the machine random and time state
 	// updated for write commands.
-
 	var info uhaha.RawMachineInfo
 	uhaha.ReadRawMachineInfo(m, &info)
 	defer func() {
@@ -124,122 +549,448 @@ func cmdEXEC(m uhaha.Machine, args []string) (interface{}, error) {
 		info.Seed = int64(C.uhaha_seed)
 		uhaha.WriteRawMachineInfo(m, &info)
 	}()
-	return sqlExec(args[1], false)
+
+	if err := w.exec("begin", nil); err != nil {
+		return nil, err
+	}
+	// The last insert rowid of the connection is not the same on every
+	// server, such as after a restart.
+	C.sqlite3_set_last_insert_rowid(w.db, 0)
+	beginRecording()
+	res, err := fn(m, args)
+	recording = false
+	if w.autocommit() {
+		// The transaction was rolled back by the command.
+		rollbackWrites(writeMark{})
+		if err := w.exec("begin", nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.writeAudit(err); err != nil {
+		w.exec("rollback", nil)
+		return nil, err
+	}
+	if err := w.foldChecksum(err); err != nil {
+		w.exec("rollback", nil)
+		return nil, err
+	}
+	if err := w.cdcFlush(); err != nil {
+		w.exec("rollback", nil)
+		return nil, err
+	}
+	if err := w.saveState(); err != nil {
+		w.exec("rollback", nil)
+		return nil, err
+	}
+	if err := w.exec("end", nil); err != nil {
+		rollbackWrites(writeMark{})
+		return nil, err
+	}
+	publishPending()
+	return res, err
+}
+
+// recording is true while a write command is running. The row changes and
+// notifications from the command are recorded and are kept only when the
+// command commits. Protected by the dbmu lock.
+var recording bool
+
+// writeMark is a position in the recorded changes and notifications.
+type writeMark struct {
+	changes int
+	notes   int
+}
+
+func beginRecording() {
+	cdcPending = cdcPending[:0]
+	notePending = notePending[:0]
+	recording = true
+}
+
+func markWrites() writeMark {
+	return writeMark{changes: len(cdcPending), notes: len(notePending)}
+}
+
+// rollbackWrites discards the changes and notifications that were recorded
+// after the mark, which is used when a statement or transaction is rolled
+// back.
+func rollbackWrites(mark writeMark) {
+	if mark.changes < len(cdcPending) {
+		cdcPending = cdcPending[:mark.changes]
+	}
+	if mark.notes < len(notePending) {
+		notePending = notePending[:mark.notes]
+	}
+}
+
+func cmdEXEC(m uhaha.Machine, args []string) (interface{}, error) {
+	// WRITE
+	withInfo, withTypes, name := execOptions(args[2:])
+	uname, token, addr := execConn(args[2:])
+	cmdAudit = &auditEntry{addr: addr, user: uname, command: "EXEC",
+		args: args[1]}
+	user, err := commandUser(uname, token, machineTime())
+	if err != nil {
+		return nil, err
+	}
+	return sqlExec(name, args[1], false, withInfo, withTypes, user, addr)
 }
 
 func cmdQUERY(m uhaha.Machine, args []string) (interface{}, error) {
 	// READ
-	return sqlExec(args[1], true)
+	_, withTypes, name := execOptions(args[2:])
+	uname, token, addr := execConn(args[2:])
+	// Reads are not stored in the log, so the token is checked against the
+	// time of this server.
+	user, err := commandUser(uname, token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return sqlExec(name, args[1], true, false, withTypes, user, addr)
 }
 
-func sqlExec(sqlJSON string, readonly bool) (interface{}, error) {
+// execOptions returns the options that follow the sql of the $EXEC and
+// $QUERY commands. The name is the named database that is provided with the
+// "db name" option, or empty for the default database.
+func execOptions(opts []string) (withInfo, withTypes bool, name string) {
+	for i := 0; i < len(opts); i++ {
+		switch opts[i] {
+		case "withinfo":
+			withInfo = true
+		case "withtypes":
+			withTypes = true
+		case "db":
+			if i+1 < len(opts) {
+				name = opts[i+1]
+				i++
+			}
+		case "user":
+			i += 2
+		case "addr":
+			i++
+		}
+	}
+	return withInfo, withTypes, name
+}
+
+// execConn returns the user name and command token from the "user name token"
+// option, and the address from the "addr address" option, of the $EXEC and
+// $QUERY commands. The name is empty when the option is missing, which is the
+// anonymous user.
+func execConn(opts []string) (user, token, addr string) {
+	for i := 0; i < len(opts); i++ {
+		switch opts[i] {
+		case "db":
+			i++
+		case "user":
+			if i+2 < len(opts) {
+				user, token = opts[i+1], opts[i+2]
+			}
+			i += 2
+		case "addr":
+			if i+1 < len(opts) {
+				addr = opts[i+1]
+			}
+			i++
+		}
+	}
+	return user, token, addr
+}
+
+// sqlExec executes each statement in the sqlJSON array. Returns a resultset
+// for each statement. When withInfo is true, the changes, total changes, and
+// last insert rowid are included with each resultset, and the applied index
+// of the command is included with the response. When withTypes is true, the
+// second row of each resultset is the declared column types and the values
+// keep their Sqlite types, with nil for NULL. The name is the named database,
+// or empty for the default database. The statements are authorized for the
+// user. The address of the client is used by the slow log.
+func sqlExec(name, sqlJSON string, readonly, withInfo, withTypes bool,
+	user *userInfo, addr string,
+) (interface{}, error) {
 	var sqls []string
+	var sqlArgs [][]interface{}
 	var res []interface{}
 	gjson.Parse(sqlJSON).ForEach(func(_, val gjson.Result) bool {
-		sqls = append(sqls, val.String())
+		if vals := val.Array(); val.IsArray() && len(vals) > 0 {
+			// A statement with bound parameters: [sql, arg...]
+			sqls = append(sqls, vals[0].String())
+			sqlArgs = append(sqlArgs, jsonArgs(vals[1:]))
+		} else {
+			sqls = append(sqls, val.String())
+			sqlArgs = append(sqlArgs, nil)
+		}
 		return true
 	})
-	var db *sqlDatabase
 	if readonly {
+		// The results may be wrong when the extensions don't match.
+		if err := localFault("extensions"); err != nil {
+			return nil, err
+		}
+	}
+	var db *sqlDatabase
+	if readonly && name != "" {
+		rlockDB()
+		defer dbmu.RUnlock()
+		d, err := lookupDB(name)
+		if err != nil {
+			return nil, err
+		}
+		db, err = d.takeReader()
+		if err != nil {
+			return nil, err
+		}
+		defer d.releaseReader(db)
+		C.uhaha_begin_reader()
+		defer C.uhaha_end_reader()
+	} else if readonly {
 		var err error
 		db, err = takeReaderDB()
 		if err != nil {
 			return nil, err
 		}
 		defer releaseReaderDB(db)
-		dbmu.RLock()
+		rlockDB()
 		C.uhaha_begin_reader()
 		defer func() {
 			C.uhaha_end_reader()
 			dbmu.RUnlock()
 		}()
+	} else if name != "" {
+		// The dbmu lock is held by dbWriteCommand.
+		d, err := lookupDB(name)
+		if err != nil {
+			return nil, err
+		}
+		db = d.wdb
 	} else {
-		dbmu.Lock()
-		defer dbmu.Unlock()
+		// The dbmu lock is held by writeCommand.
 		db = wdb
 	}
+	db.sandbox(user)
+	defer db.endSandbox()
+	var tx *sqlTx
 	if len(sqls) > 1 {
-		if err := db.exec("begin", nil); err != nil {
+		var err error
+		tx, err = db.begin()
+		if err != nil {
 			return nil, err
 		}
 	}
-	for _, sql := range sqls {
-		var rows [][]string
-		err := db.exec(sql, func(row []string) bool {
-			rows = append(rows, row)
-			return true
-		})
+	mode := "write"
+	if readonly {
+		mode = "read"
+	}
+	for i, sql := range sqls {
+		var rows interface{}
+		var nrows int
+		var err error
+		start := slowStart()
+		if withTypes {
+			var vrows [][]interface{}
+			vrows, err = db.execValues(sql, sqlArgs[i])
+			// The first two rows are the column names and types.
+			rows, nrows = vrows, len(vrows)-2
+		} else {
+			var srows [][]string
+			err = db.execArgs(sql, sqlArgs[i], func(row []string) bool {
+				srows = append(srows, row)
+				return true
+			})
+			// The first row is the column names.
+			rows, nrows = srows, len(srows)-1
+		}
+		if nrows < 0 {
+			nrows = 0
+		}
+		logSlow(start, sql, nrows, mode, addr)
 		if err != nil {
-			if len(sqls) > 1 {
-				if err := db.exec("rollback", nil); err != nil {
+			if tx != nil {
+				if err := tx.rollback(); err != nil {
 					return nil, err
 				}
 			}
 			return nil, err
 		}
-		res = append(res, rows)
+		if withInfo {
+			res = append(res, []interface{}{
+				"rows", rows,
+				"changes", db.changes(),
+				"total_changes", db.totalChanges(),
+				"last_insert_rowid", db.lastInsertRowID(),
+			})
+		} else {
+			res = append(res, rows)
+		}
 	}
-	if len(sqls) > 1 {
-		if err := db.exec("end", nil); err != nil {
+	if tx != nil {
+		if err := tx.commit(); err != nil {
 			return nil, err
 		}
 	}
+	if withInfo {
+		return []interface{}{"applied", int64(applied), "results", res}, nil
+	}
 	return res, nil
 }
 
-type snap struct{}
+// jsonArgs converts JSON values into statement parameters.
+func jsonArgs(vals []gjson.Result) []interface{} {
+	args := make([]interface{}, len(vals))
+	for i, val := range vals {
+		switch val.Type {
+		case gjson.Null:
+			args[i] = nil
+		case gjson.False:
+			args[i] = int64(0)
+		case gjson.True:
+			args[i] = int64(1)
+		case gjson.Number:
+			if n, err := strconv.ParseInt(val.Raw, 10, 64); err == nil {
+				args[i] = n
+			} else {
+				args[i] = val.Float()
+			}
+		case gjson.String:
+			args[i] = val.String()
+		case gjson.JSON:
+			// A blob is an object with a base64 "blob" value.
+			blob := val.Get("blob")
+			data, err := base64.StdEncoding.DecodeString(blob.String())
+			if val.IsObject() && blob.Type == gjson.String && err == nil {
+				args[i] = data
+			} else {
+				args[i] = val.Raw
+			}
+		default:
+			args[i] = val.Raw
+		}
+	}
+	return args
+}
+
+// snap is a snapshot of the default database and the named databases.
+type snap struct {
+	names []string
+	index uint64 // applied index of the snapshot
+}
 
 func (s *snap) Done(path string) {
-	dbmu.Lock()
+	lockDB()
 	defer dbmu.Unlock()
+	snapshotting = false
+	removeDroppedDBs()
 	must(nil, wdb.checkpoint())
 	must(nil, wdb.autocheckpoint(1000))
+	for _, d := range dbs {
+		must(nil, d.wdb.checkpoint())
+		must(nil, d.wdb.autocheckpoint(1000))
+	}
 }
 
 func (s *snap) Persist(wr io.Writer) error {
-	f, err := os.Open(dbPath)
+	start := time.Now()
+	cw := &countWriter{wr: wr}
+	ew, err := encryptSnapshot(cw)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(wr, f)
-	return err
+	if err := writeSnapshotFiles(ew, s.names); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	observeSnapshot(start, cw.n, s.index)
+	return nil
 }
 
 func snapshot(_ interface{}) (uhaha.Snapshot, error) {
-	dbmu.Lock()
+	lockDB()
 	defer dbmu.Unlock()
-	if err := wdb.autocheckpoint(0); err != nil {
+	// Ticks may have moved the applied index since the last write.
+	if err := wdb.saveState(); err != nil {
 		return nil, err
 	}
-	if err := wdb.checkpoint(); err != nil {
+	if err := rekeyDatabases(); err != nil {
 		return nil, err
 	}
-	return &snap{}, nil
+	// The database files must not change until the snapshot is done.
+	s := &snap{index: applied}
+	writers := []*sqlDatabase{wdb}
+	for name, d := range dbs {
+		s.names = append(s.names, name)
+		writers = append(writers, d.wdb)
+	}
+	for _, w := range writers {
+		if err := w.autocheckpoint(0); err != nil {
+			return nil, err
+		}
+		if err := w.checkpoint(); err != nil {
+			return nil, err
+		}
+	}
+	snapshotting = true
+	return s, nil
 }
 
 func restore(rd io.Reader) (interface{}, error) {
-	dbmu.Lock()
+	lockDB()
 	defer dbmu.Unlock()
-	if err := wdb.close(); err != nil {
+	// Write the snapshot to a temporary directory first, each database only
+	// replaces the current database when the current database is older.
+	dir := filepath.Join(filepath.Dir(dbPath), "restore")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := readSnapshotFiles(rd, dir); err != nil {
 		return nil, err
 	}
-	if err := os.RemoveAll(filepath.Dir(dbPath)); err != nil {
+	path := filepath.Join(dir, "sqlite.db")
+	sdb, err := openSQLDatabase(path, false)
+	if err != nil {
 		return nil, err
 	}
-	if err := os.Mkdir(filepath.Dir(dbPath), 0777); err != nil {
+	index, err := sdb.readMeta("index")
+	sdb.close()
+	if err != nil {
 		return nil, err
 	}
-	f, err := os.Create(dbPath)
-	if err != nil {
+	if persisted > 0 && uint64(index) <= persisted {
+		// The current database already has everything that is in the
+		// snapshot. Keep it, the remaining log will be replayed from the
+		// snapshot index.
+		setApplied(uint64(index))
+		return nil, restoreDatabases(filepath.Join(dir, "dbs"),
+			uint64(index))
+	}
+	closeReaderDBs()
+	if err := wdb.close(); err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	if _, err := io.Copy(f, rd); err != nil {
+	removeDBFiles(dbPath)
+	if err := os.Rename(path, dbPath); err != nil {
 		return nil, err
 	}
 	wdb, err = openSQLDatabase(dbPath, false)
-	return nil, err
+	if err != nil {
+		return nil, err
+	}
+	setApplied(uint64(index))
+	persisted = uint64(index)
+	attachedRefDBs = nil
+	if err := loadRefDBs(); err != nil {
+		return nil, err
+	}
+	if err := checkPinnedExtensions(); err != nil {
+		return nil, err
+	}
+	if err := loadUsers(); err != nil {
+		return nil, err
+	}
+	if err := loadAudit(); err != nil {
+		return nil, err
+	}
+	return nil, restoreDatabases(filepath.Join(dir, "dbs"), uint64(index))
 }
 
 func must(v interface{}, err error) interface{} {
@@ -249,8 +1000,54 @@ func must(v interface{}, err error) interface{} {
 	return v
 }
 
+// localFaults are the problems with the files of this server that the
+// replicated state depends on, such as extensions that don't match the
+// pinned extensions, keyed by what has the problem.
+var localFaultsMu sync.Mutex
+var localFaults = make(map[string]error)
+
+// setLocalFault records a problem with the files of this server, or clears
+// it when err is nil. Such a problem is never fatal, not even while the Raft
+// log is applied. Every server applies the same entries, so an entry that
+// stops a server stops it again when the log is replayed, and an entry that
+// names a bad file would stop the whole cluster.
+func setLocalFault(what string, err error) {
+	localFaultsMu.Lock()
+	defer localFaultsMu.Unlock()
+	if err == nil {
+		delete(localFaults, what)
+		return
+	}
+	if prev := localFaults[what]; prev == nil ||
+		prev.Error() != err.Error() {
+		logger.Warningf("%s: %s", what, err)
+	}
+	localFaults[what] = err
+}
+
+// localFault returns the problem that was recorded for what, if any.
+func localFault(what string) error {
+	localFaultsMu.Lock()
+	defer localFaultsMu.Unlock()
+	return localFaults[what]
+}
+
+// localFaultList returns the recorded problems, sorted by what has them.
+func localFaultList() []string {
+	localFaultsMu.Lock()
+	defer localFaultsMu.Unlock()
+	list := []string{}
+	for what, err := range localFaults {
+		list = append(list, what+": "+err.Error())
+	}
+	sort.Strings(list)
+	return list
+}
+
 type sqlDatabase struct {
-	db *C.sqlite3
+	db       *C.sqlite3
+	readonly bool
+	refs     int // version of the attached reference databases
 }
 
 func (db *sqlDatabase) close() error {
@@ -263,86 +1060,252 @@ func (db *sqlDatabase) close() error {
 }
 
 func openSQLDatabase(path string, readonly bool) (*sqlDatabase, error) {
-	db := new(sqlDatabase)
+	db, err := openSQLFile(path, readonly)
+	if err != nil {
+		return nil, err
+	}
+	if readonly {
+		if err := db.attachRefDBs(); err != nil {
+			db.close()
+			return nil, err
+		}
+		return db, nil
+	}
+	for _, ensure := range []func() error{
+		db.ensureProcSpace, db.ensureMetaSpace, db.ensureCDCSpace,
+		db.ensureTTLSpace, db.ensureScheduleSpace, db.ensureRefDBSpace,
+		db.ensureExtensionSpace, db.ensureUserSpace, db.ensureAuditSpace,
+	} {
+		if err := ensure(); err != nil {
+			db.close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// openSQLFile opens a database file without creating any of the internal
+// tables. The authorizer is installed, so the statements of every database,
+// including the named databases, can be sandboxed.
+func openSQLFile(path string, readonly bool) (*sqlDatabase, error) {
+	db := &sqlDatabase{readonly: readonly}
 	cstr := C.CString(path)
 	var rc C.int
+	// URI filenames are used to attach the reference databases.
 	if readonly {
-		rc = C.sqlite3_open_v2(cstr, &db.db, C.SQLITE_OPEN_READONLY, nil)
+		rc = C.sqlite3_open_v2(cstr, &db.db,
+			C.SQLITE_OPEN_READONLY|C.SQLITE_OPEN_URI, nil)
 	} else {
-		rc = C.sqlite3_open(cstr, &db.db)
+		rc = C.sqlite3_open_v2(cstr, &db.db, C.SQLITE_OPEN_READWRITE|
+			C.SQLITE_OPEN_CREATE|C.SQLITE_OPEN_URI, nil)
 	}
 	C.free(unsafe.Pointer(cstr))
 	if rc != C.SQLITE_OK {
 		return nil, errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
 	}
-	if !readonly {
-		if err := db.exec("PRAGMA auto_vacuum=FULL", nil); err != nil {
+	for _, pragma := range sqlConf.pragmas(readonly) {
+		if err := db.exec(pragma, nil); err != nil {
 			db.close()
 			return nil, err
 		}
-		if err := db.exec("PRAGMA journal_mode=WAL", nil); err != nil {
-			db.close()
-			return nil, err
+	}
+	if err := db.loadExtensions(); err != nil {
+		db.close()
+		return nil, err
+	}
+	if err := db.enableAuthorizer(); err != nil {
+		db.close()
+		return nil, err
+	}
+	if err := db.createNotifyFunc(); err != nil {
+		db.close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *sqlDatabase) exec(sql string, iter func(row []string) bool) error {
+	return db.execArgs(sql, nil, iter)
+}
+
+// execArgs executes a single statement using the provided args as the bound
+// parameters. Each arg must be nil, int64, float64, string, or []byte. The
+// first row passed to the iterator is the column names.
+func (db *sqlDatabase) execArgs(sql string, args []interface{},
+	iter func(row []string) bool,
+) error {
+	if iter == nil {
+		return db.execStmt(sql, args, nil)
+	}
+	return db.execStmt(sql, args, func(stmt *C.sqlite3_stmt, header bool,
+	) bool {
+		ncols := int(C.sqlite3_column_count(stmt))
+		row := make([]string, ncols)
+		for i := 0; i < ncols; i++ {
+			if header {
+				row[i] = C.GoString(C.sqlite3_column_name(stmt, C.int(i)))
+			} else {
+				text := C.sqlite3_column_text(stmt, C.int(i))
+				row[i] = C.GoString((*C.char)(unsafe.Pointer(text)))
+			}
 		}
-		if err := db.exec("PRAGMA synchronous=off", nil); err != nil {
-			db.close()
-			return nil, err
+		return iter(row)
+	})
+}
+
+// execValues executes the statement using the bound args and returns the
+// rows. The first row is the column names, the second is the declared column
+// types, and the others are the values using int64, float64, string, []byte,
+// or nil for NULL.
+func (db *sqlDatabase) execValues(sql string, args []interface{},
+) ([][]interface{}, error) {
+	var rows [][]interface{}
+	err := db.execStmt(sql, args, func(stmt *C.sqlite3_stmt, header bool,
+	) bool {
+		ncols := int(C.sqlite3_column_count(stmt))
+		if header {
+			names := make([]interface{}, ncols)
+			types := make([]interface{}, ncols)
+			for i := 0; i < ncols; i++ {
+				names[i] = C.GoString(C.sqlite3_column_name(stmt, C.int(i)))
+				types[i] = C.GoString(C.sqlite3_column_decltype(stmt,
+					C.int(i)))
+			}
+			rows = append(rows, names, types)
+			return true
 		}
-		if err := db.ensureProcSpace(); err != nil {
-			db.close()
-			return nil, err
+		row := make([]interface{}, ncols)
+		for i := 0; i < ncols; i++ {
+			switch C.sqlite3_column_type(stmt, C.int(i)) {
+			case C.SQLITE_INTEGER:
+				row[i] = int64(C.sqlite3_column_int64(stmt, C.int(i)))
+			case C.SQLITE_FLOAT:
+				row[i] = float64(C.sqlite3_column_double(stmt, C.int(i)))
+			case C.SQLITE_TEXT:
+				text := C.sqlite3_column_text(stmt, C.int(i))
+				row[i] = C.GoString((*C.char)(unsafe.Pointer(text)))
+			case C.SQLITE_BLOB:
+				blob := C.sqlite3_column_blob(stmt, C.int(i))
+				n := C.sqlite3_column_bytes(stmt, C.int(i))
+				row[i] = C.GoBytes(blob, n)
+			default:
+				row[i] = nil
+			}
 		}
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
-	return db, nil
+	return rows, nil
 }
 
-func (db *sqlDatabase) exec(sql string, iter func(row []string) bool) error {
+// describe prepares the statement without executing it, and returns the
+// column names, the declared column types, and the number of parameters.
+func (db *sqlDatabase) describe(sql string) (names, types []string,
+	nparams int, err error,
+) {
 	if db.db == nil {
-		return errors.New("database closed")
+		return nil, nil, 0, errors.New("database closed")
 	}
 	var stmt *C.sqlite3_stmt
 	csql := C.CString(sql)
 	rc := C.sqlite3_prepare_v2(db.db, csql, C.int(len(sql)), &stmt, nil)
 	C.free(unsafe.Pointer(csql))
 	if rc != C.SQLITE_OK {
-		return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+		return nil, nil, 0, db.lastError()
 	}
+	defer C.sqlite3_finalize(stmt)
 	ncols := int(C.sqlite3_column_count(stmt))
-	row := make([]string, ncols)
 	for i := 0; i < ncols; i++ {
-		row[i] = C.GoString(C.sqlite3_column_name(stmt, C.int(i)))
+		names = append(names,
+			C.GoString(C.sqlite3_column_name(stmt, C.int(i))))
+		types = append(types,
+			C.GoString(C.sqlite3_column_decltype(stmt, C.int(i))))
 	}
+	return names, types, int(C.sqlite3_bind_parameter_count(stmt)), nil
+}
 
+// execStmt executes a single statement using the provided args as the bound
+// parameters. The iterator is called once with header=true before the
+// statement is stepped, and then for each row.
+func (db *sqlDatabase) execStmt(sql string, args []interface{},
+	iter func(stmt *C.sqlite3_stmt, header bool) bool,
+) error {
+	if db.db == nil {
+		return errors.New("database closed")
+	}
+	var stmt *C.sqlite3_stmt
+	csql := C.CString(sql)
+	rc := C.sqlite3_prepare_v2(db.db, csql, C.int(len(sql)), &stmt, nil)
+	C.free(unsafe.Pointer(csql))
+	if rc != C.SQLITE_OK {
+		return db.lastError()
+	}
+	if len(args) > 0 {
+		// The bound text and blob values are not copied by Sqlite, so they
+		// must stay around until the statement is finalized.
+		var ptrs []unsafe.Pointer
+		defer func() {
+			for _, ptr := range ptrs {
+				C.free(ptr)
+			}
+		}()
+		for i, arg := range args {
+			n := C.int(i + 1)
+			switch v := arg.(type) {
+			case nil:
+				rc = C.sqlite3_bind_null(stmt, n)
+			case int64:
+				rc = C.sqlite3_bind_int64(stmt, n, C.sqlite3_int64(v))
+			case float64:
+				rc = C.sqlite3_bind_double(stmt, n, C.double(v))
+			case string:
+				ptr := C.CString(v)
+				ptrs = append(ptrs, unsafe.Pointer(ptr))
+				rc = C.sqlite3_bind_text(stmt, n, ptr, C.int(len(v)), nil)
+			case []byte:
+				ptr := C.CBytes(v)
+				ptrs = append(ptrs, ptr)
+				rc = C.sqlite3_bind_blob(stmt, n, ptr, C.int(len(v)), nil)
+			default:
+				C.sqlite3_finalize(stmt)
+				return fmt.Errorf("invalid parameter type %T", arg)
+			}
+			if rc != C.SQLITE_OK {
+				err := errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+				C.sqlite3_finalize(stmt)
+				return err
+			}
+		}
+	}
 	var ferr error
-	if iter == nil || iter(row) {
+	mark := markWrites()
+	if iter == nil || iter(stmt, true) {
 		for {
 			rc := C.sqlite3_step(stmt)
 			if rc == C.SQLITE_DONE {
 				break
 			}
 			if rc == C.SQLITE_ROW {
-				row := make([]string, ncols)
-				for i := 0; i < ncols; i++ {
-					text := C.sqlite3_column_text(stmt, C.int(i))
-					row[i] = C.GoString((*C.char)(unsafe.Pointer(text)))
-				}
-				if iter != nil && !iter(row) {
+				if iter != nil && !iter(stmt, false) {
 					break
 				}
 				continue
 			}
 			// failed
-			ferr = errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
-			rc = C.sqlite3_finalize(stmt)
-			if rc != C.SQLITE_OK {
-				return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+			ferr = db.lastError()
+			if !db.readonly {
+				// Sqlite undoes the changes of the failed statement, unless
+				// it uses the OR FAIL conflict clause.
+				rollbackWrites(mark)
 			}
 			break
-
 		}
 	}
 	rc = C.sqlite3_finalize(stmt)
-	if rc != C.SQLITE_OK {
+	if rc != C.SQLITE_OK && ferr == nil {
 		return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
 	}
 	return ferr
@@ -365,6 +1328,109 @@ func (db *sqlDatabase) autocheckpoint(n int) error {
 	return nil
 }
 
+func (db *sqlDatabase) changes() int64 {
+	return int64(C.sqlite3_changes(db.db))
+}
+
+func (db *sqlDatabase) totalChanges() int64 {
+	return int64(C.sqlite3_total_changes(db.db))
+}
+
+func (db *sqlDatabase) lastInsertRowID() int64 {
+	return int64(C.sqlite3_last_insert_rowid(db.db))
+}
+
+func (db *sqlDatabase) autocommit() bool {
+	return C.sqlite3_get_autocommit(db.db) != 0
+}
+
+// sqlTx is a transaction, or a savepoint when the database is already inside
+// of a transaction.
+type sqlTx struct {
+	db        *sqlDatabase
+	savepoint bool
+	mark      writeMark
+}
+
+func (db *sqlDatabase) begin() (*sqlTx, error) {
+	tx := &sqlTx{db: db, savepoint: !db.autocommit(), mark: markWrites()}
+	if tx.savepoint {
+		return tx, db.exec("savepoint tx", nil)
+	}
+	return tx, db.exec("begin", nil)
+}
+
+func (tx *sqlTx) commit() error {
+	if tx.savepoint {
+		return tx.db.exec("release tx", nil)
+	}
+	return tx.db.exec("end", nil)
+}
+
+func (tx *sqlTx) rollback() error {
+	rollbackWrites(tx.mark)
+	if tx.db.autocommit() {
+		// Already rolled back by Sqlite.
+		return nil
+	}
+	if tx.savepoint {
+		if err := tx.db.exec("rollback to tx", nil); err != nil {
+			return err
+		}
+		return tx.db.exec("release tx", nil)
+	}
+	return tx.db.exec("rollback", nil)
+}
+
+func (db *sqlDatabase) ensureMetaSpace() error {
+	err := db.exec(`
+		CREATE TABLE IF NOT EXISTS __meta__ (
+			name       TEXT PRIMARY KEY,
+			value      INTEGER
+		);
+	`, nil)
+	if err != nil {
+		return err
+	}
+	return db.exec(`INSERT OR IGNORE INTO __meta__ (name, value)
+					VALUES ('index', 0), ('ts', 0), ('seed', 0);`, nil)
+}
+
+// readMeta reads an integer value from the __meta__ table.
+func (db *sqlDatabase) readMeta(name string) (int64, error) {
+	var value int64
+	err := db.exec(`select value from __meta__ where name = '`+name+`'`,
+		func(row []string) bool {
+			value, _ = strconv.ParseInt(row[0], 10, 64)
+			return true
+		})
+	return value, err
+}
+
+// saveState records the applied index and the machine time and random state.
+func (db *sqlDatabase) saveState() error {
+	return db.exec(fmt.Sprintf(`REPLACE INTO __meta__ (name, value)
+		VALUES ('index', %d), ('ts', %d), ('seed', %d);`,
+		applied, int64(C.uhaha_ts), int64(C.uhaha_seed)), nil)
+}
+
+// loadMachineInfo loads the machine time and random state that was recorded
+// by saveState.
+func (db *sqlDatabase) loadMachineInfo(m uhaha.Machine) error {
+	ts, err := db.readMeta("ts")
+	if err != nil {
+		return err
+	}
+	seed, err := db.readMeta("seed")
+	if err != nil {
+		return err
+	}
+	C.uhaha_ts = C.int64_t(ts)
+	C.uhaha_seed = C.int64_t(seed)
+	uhaha.WriteRawMachineInfo(m, &uhaha.RawMachineInfo{TS: ts, Seed: seed})
+	return nil
+}
+
 func (db *sqlDatabase) ensureProcSpace() error {
 	err := db.exec(`
 		CREATE TABLE IF NOT EXISTS __proc__ (
@@ -381,20 +1447,37 @@ var rdbsMu sync.Mutex
 var rdbs []*sqlDatabase
 
 func takeReaderDB() (*sqlDatabase, error) {
+	start := time.Now()
 	rdbsMu.Lock()
 	if len(rdbs) > 1 {
 		db := rdbs[len(rdbs)-1]
 		rdbs = rdbs[:len(rdbs)-1]
 		rdbsMu.Unlock()
+		observeReader(defaultDBName, start, false)
 		return db, nil
 	}
 	rdbsMu.Unlock()
+	defer observeReader(defaultDBName, start, true)
 	return openSQLDatabase(dbPath, true)
 }
 
+// closeReaderDBs closes all pooled readers. Used when the database file is
+// replaced.
+func closeReaderDBs() {
+	rdbsMu.Lock()
+	defer rdbsMu.Unlock()
+	for _, db := range rdbs {
+		db.close()
+	}
+	rdbs = nil
+}
+
 func releaseReaderDB(db *sqlDatabase) {
+	refdbsMu.Lock()
+	stale := db.refs != refdbsVersion
+	refdbsMu.Unlock()
 	rdbsMu.Lock()
-	if len(rdbs) < rdbMaxPool {
+	if len(rdbs) < rdbMaxPool && !stale {
 		rdbs = append(rdbs, db)
 		rdbsMu.Unlock()
 	} else {
@@ -497,28 +1580,61 @@ func sqlCommand(sql string) string {
 	return strings.ToLower(sql)
 }
 
+// PROC GET name             -- gets a proc
+// PROC LIST                 -- returns the names of all procs
+// PROC HELP                 -- returns the proc commands
+//
+// These are answered by this server, the other proc commands are sent to the
+// cluster as the user of the connection.
+func cmdPROCREAD(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return uhaha.FilterArgs(userArgs(m, "$PROC", args)), nil
+	}
+	switch strings.ToLower(args[1]) {
+	case "get", "list":
+	case "help":
+		return cmdPROCHELP(m, args)
+	default:
+		return uhaha.FilterArgs(userArgs(m, "$PROC", args)), nil
+	}
+	// Only admins can read the procs.
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	db, err := takeReaderDB()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseReaderDB(db)
+	rlockDB()
+	defer dbmu.RUnlock()
+	if strings.ToLower(args[1]) == "get" {
+		return cmdPROCGET(db, args)
+	}
+	return cmdPROCLIST(db, args)
+}
+
 // PROC EXEC name args       -- executes a proc
 // PROC SET name script      -- sets a proc
-// PROC GET name             -- gets a proc
 // PROC DEL name             -- deletes a proc
-// PROC LIST                 -- returns the names of all procs
 func cmdPROC(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) < 2 {
 		return nil, errors.New("wrong number of arguments, try PROC HELP")
 	}
+	if strings.ToLower(args[1]) != "exec" {
+		// Only admins can change the procs.
+		if err := requireAdmin(); err != nil {
+			return nil, err
+		}
+	}
 	switch strings.ToLower(args[1]) {
 	case "exec":
 		return cmdPROCEXEC(m, args)
 	case "set":
 		return cmdPROCSET(m, args)
-	case "get":
-		return cmdPROCGET(m, args)
 	case "del", "delete":
 		return cmdPROCDEL(m, args)
-	case "help":
-		return cmdPROCHELP(m, args)
-	case "list":
-		return cmdPROCLIST(m, args)
 	default:
 		return nil, fmt.Errorf("unknown proc command '%s %s', try PROC HELP",
 			args[0], args[1],
@@ -526,11 +1642,18 @@ func cmdPROC(m uhaha.Machine, args []string) (interface{}, error) {
 	}
 }
 
-func cmdPROCEXEC(m uhaha.Machine, args []string) (interface{}, error) {
+func cmdPROCEXEC(m uhaha.Machine, args []string) (res interface{}, err error) {
 	if len(args) < 3 {
 		return nil, errors.New("wrong number of arguments, try PROC HELP")
 	}
 	name := args[2]
+	start := time.Now()
+	defer func() {
+		observe(commandDurations, "proc", start)
+		if err != nil {
+			observeProcFailure(name)
+		}
+	}()
 	var vargs []string
 	var script string
 	if name == "__inline__" {
@@ -543,18 +1666,23 @@ func cmdPROCEXEC(m uhaha.Machine, args []string) (interface{}, error) {
 		vargs = args[3:]
 	}
 	_ = vargs
+	if name == "__inline__" && !isAdmin(cmdUser) {
+		return nil, errNotAdmin
+	}
+	if !allowed(cmdUser, "exec", name) {
+		return nil, fmt.Errorf("permission denied for proc '%s'", name)
+	}
 
-	dbmu.Lock()
-	defer dbmu.Unlock()
 	var commit bool
-	if err := wdb.exec("begin", nil); err != nil {
+	tx, err := wdb.begin()
+	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if commit {
-			wdb.exec("end", nil)
+			tx.commit()
 		} else {
-			wdb.exec("rollback", nil)
+			tx.rollback()
 		}
 	}()
 
@@ -577,7 +1705,7 @@ func cmdPROCEXEC(m uhaha.Machine, args []string) (interface{}, error) {
 		}
 	}
 	var result otto.Value
-	err := func() (err error) {
+	err = func() (err error) {
 		defer func() {
 			if err == nil {
 				if v := recover(); v != nil {
@@ -593,8 +1721,13 @@ func cmdPROCEXEC(m uhaha.Machine, args []string) (interface{}, error) {
 		}()
 		vm := otto.New()
 		vm.Set("exec", execFn)
+		vm.Set("notify", notifyFn)
 		data, _ := json.Marshal(vargs)
 		vm.Eval("this.arguments = " + string(data))
+		// The proc has every privilege, but it can't do what the sandbox
+		// denies.
+		wdb.sandbox(nil)
+		defer wdb.endSandbox()
 		result, err = vm.Run(script)
 		return err
 	}()
@@ -617,10 +1750,17 @@ func execFn(call otto.FunctionCall) otto.Value {
 		panic("exec: statement not a string")
 	}
 	var rows [][]string
-	err := wdb.exec(call.Argument(0).String(), func(row []string) bool {
+	sql := call.Argument(0).String()
+	start := slowStart()
+	err := wdb.exec(sql, func(row []string) bool {
 		rows = append(rows, row)
 		return true
 	})
+	nrows := len(rows) - 1
+	if nrows < 0 {
+		nrows = 0
+	}
+	logSlow(start, sql, nrows, "write", cmdAddr)
 	if err != nil {
 		panic("exec: " + err.Error())
 	}
@@ -645,9 +1785,6 @@ func cmdPROCSET(m uhaha.Machine, args []string) (interface{}, error) {
 	name := strings.Replace(args[2], "'", "''", -1)
 	script := strings.Replace(args[3], "'", "''", -1)
 
-	dbmu.Lock()
-	defer dbmu.Unlock()
-
 	err = wdb.exec(`INSERT INTO __proc__ (name, script)
 					VALUES ('`+name+`', '`+script+`')
 					ON CONFLICT(name)
@@ -658,16 +1795,14 @@ func cmdPROCSET(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleString("OK"), nil
 }
 
-func cmdPROCGET(m uhaha.Machine, args []string) (interface{}, error) {
+func cmdPROCGET(db *sqlDatabase, args []string) (interface{}, error) {
 	if len(args) != 3 {
 		return nil, errors.New("wrong number of arguments, try PROC HELP")
 	}
-	dbmu.Lock()
-	defer dbmu.Unlock()
 	name := strings.Replace(args[2], "'", "''", -1)
 	var count int
 	var script string
-	err := wdb.exec(`select script from __proc__ where name = '`+name+`'`,
+	err := db.exec(`select script from __proc__ where name = '`+name+`'`,
 		func(rows []string) bool {
 			if count == 1 {
 				script = rows[0]
@@ -688,8 +1823,6 @@ func cmdPROCDEL(m uhaha.Machine, args []string) (interface{}, error) {
 	if len(args) != 3 {
 		return nil, errors.New("wrong number of arguments, try PROC HELP")
 	}
-	dbmu.Lock()
-	defer dbmu.Unlock()
 	name := strings.Replace(args[2], "'", "''", -1)
 	err := wdb.exec(`delete from __proc__ where name = '`+name+`'`, nil)
 	if err != nil {
@@ -698,13 +1831,10 @@ func cmdPROCDEL(m uhaha.Machine, args []string) (interface{}, error) {
 	return redcon.SimpleString("OK"), nil
 }
 
-func cmdPROCLIST(m uhaha.Machine, args []string) (interface{}, error) {
+func cmdPROCLIST(db *sqlDatabase, args []string) (interface{}, error) {
 	if len(args) != 2 {
 		return nil, errors.New("wrong number of arguments, try PROC HELP")
 	}
-	dbmu.Lock()
-	defer dbmu.Unlock()
-	db := wdb
 	var list []string
 	err := db.exec("select name from __proc__ order by name",
 		func(row []string) bool {
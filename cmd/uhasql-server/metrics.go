@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/uhaha"
+)
+
+// metricsBuckets are the upper bounds, in seconds, of the histogram buckets.
+var metricsBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10,
+}
+
+// histogram counts observations in the metricsBuckets.
+type histogram struct {
+	counts []uint64 // count for each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(secs float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsBuckets))
+	}
+	for i, le := range metricsBuckets {
+		if secs <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// The metrics of the server. Each is keyed by its label value. Protected by
+// the metricsMu lock.
+var metricsMu sync.Mutex
+var commandDurations = make(map[string]*histogram) // by read, write, proc
+var lockWaits = make(map[string]*histogram)        // by read, write
+var readerWaits = make(map[string]*histogram)      // by database
+var readerOpens = make(map[string]uint64)          // by database
+var procFailures = make(map[string]uint64)         // by proc
+var snapshotCount uint64
+var snapshotDuration float64 // seconds of the last snapshot
+var snapshotSize int64       // bytes of the last snapshot
+var snapshotTime time.Time   // when the last snapshot was persisted
+var snapshotIndex uint64     // applied index of the last snapshot
+
+func observe(m map[string]*histogram, label string, start time.Time) {
+	secs := time.Since(start).Seconds()
+	metricsMu.Lock()
+	h := m[label]
+	if h == nil {
+		h = new(histogram)
+		m[label] = h
+	}
+	h.observe(secs)
+	metricsMu.Unlock()
+}
+
+// measureCommand wraps a command, recording its duration by kind, which is
+// read, write, or proc.
+func measureCommand(kind string,
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		defer observe(commandDurations, kind, time.Now())
+		return fn(m, args)
+	}
+}
+
+// lockDB locks the dbmu lock for writing, recording the wait.
+func lockDB() {
+	start := time.Now()
+	dbmu.Lock()
+	observe(lockWaits, "write", start)
+}
+
+// rlockDB locks the dbmu lock for reading, recording the wait.
+func rlockDB() {
+	start := time.Now()
+	dbmu.RLock()
+	observe(lockWaits, "read", start)
+}
+
+// observeReader records the wait for a reader of a database, and whether
+// the pool was empty and a new reader was opened.
+func observeReader(name string, start time.Time, opened bool) {
+	observe(readerWaits, name, start)
+	if opened {
+		metricsMu.Lock()
+		readerOpens[name]++
+		metricsMu.Unlock()
+	}
+}
+
+func observeProcFailure(name string) {
+	metricsMu.Lock()
+	procFailures[name]++
+	metricsMu.Unlock()
+}
+
+func observeSnapshot(start time.Time, size int64, index uint64) {
+	metricsMu.Lock()
+	snapshotCount++
+	snapshotDuration = time.Since(start).Seconds()
+	snapshotSize = size
+	snapshotTime = time.Now()
+	snapshotIndex = index
+	metricsMu.Unlock()
+}
+
+// countWriter counts the bytes that are written.
+type countWriter struct {
+	wr io.Writer
+	n  int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.wr.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// metricsService provides the Prometheus metrics at GET /metrics. It shares
+// the same network port as the Redis service. Other requests on the same
+// connection are served by the HTTP service.
+func metricsService() (
+	sniff func(rd io.Reader) bool,
+	acceptor func(s uhaha.Service, ln net.Listener),
+) {
+	return metricsSniff, func(s uhaha.Service, ln net.Listener) {
+		srv := &http.Server{Handler: &metricsHandler{httpHandler{s: s}},
+			ConnContext: httpConnContext}
+		s.Log().Fatal(srv.Serve(ln))
+	}
+}
+
+// metricsSniff returns true when the connection starts with a request for
+// the metrics. Each byte is checked as it's read, so a shorter command, such
+// as an inline PING, doesn't wait for more bytes.
+func metricsSniff(rd io.Reader) bool {
+	acceptCert(rd)
+	const prefix = "GET /metrics"
+	var buf [1]byte
+	for i := 0; i < len(prefix); i++ {
+		if _, err := io.ReadFull(rd, buf[:]); err != nil ||
+			buf[0] != prefix[i] {
+			return false
+		}
+	}
+	if _, err := io.ReadFull(rd, buf[:]); err != nil {
+		return false
+	}
+	return buf[0] == ' ' || buf[0] == '?'
+}
+
+type metricsHandler struct {
+	httpHandler
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" || r.Method != http.MethodGet {
+		h.httpHandler.ServeHTTP(w, r)
+		return
+	}
+	if _, _, err := h.auth(r); err != nil {
+		httpWriteError(w, r, &httpStatusError{http.StatusUnauthorized, err})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	bw.Flush()
+}
+
+// dbFile is a database file and its pool of readers.
+type dbFile struct {
+	name string
+	path string
+	pool int
+}
+
+// metricsFiles returns the database files.
+func metricsFiles() []dbFile {
+	rlockDB()
+	defer dbmu.RUnlock()
+	rdbsMu.Lock()
+	files := []dbFile{{name: defaultDBName, path: dbPath, pool: len(rdbs)}}
+	rdbsMu.Unlock()
+	for name, d := range dbs {
+		d.rdbsMu.Lock()
+		files = append(files, dbFile{name: name, path: d.path,
+			pool: len(d.rdbs)})
+		d.rdbsMu.Unlock()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	return files
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func writeMetrics(wr io.Writer) {
+	files := metricsFiles()
+	appliedMu.Lock()
+	index := applied
+	appliedMu.Unlock()
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	writeHistograms(wr, "uhasql_command_duration_seconds",
+		"Duration of the read, write, and proc commands.", "kind",
+		commandDurations)
+	writeHistograms(wr, "uhasql_lock_wait_seconds",
+		"Wait for the database lock.", "lock", lockWaits)
+	writeHistograms(wr, "uhasql_reader_wait_seconds",
+		"Wait for a reader from the pool.", "db", readerWaits)
+	writeCounters(wr, "uhasql_reader_opens_total",
+		"Readers that were opened because the pool was empty.", "db",
+		readerOpens)
+	writeCounters(wr, "uhasql_proc_failures_total",
+		"Proc executions that failed.", "proc", procFailures)
+	writeHeader(wr, "uhasql_reader_pool_size", "Pooled readers.", "gauge")
+	for _, f := range files {
+		fmt.Fprintf(wr, "uhasql_reader_pool_size{db=\"%s\"} %d\n",
+			metricsLabel(f.name), f.pool)
+	}
+	writeHeader(wr, "uhasql_db_size_bytes", "Size of the database file.",
+		"gauge")
+	for _, f := range files {
+		fmt.Fprintf(wr, "uhasql_db_size_bytes{db=\"%s\"} %d\n",
+			metricsLabel(f.name), fileSize(f.path))
+	}
+	writeHeader(wr, "uhasql_wal_size_bytes", "Size of the WAL file.", "gauge")
+	for _, f := range files {
+		fmt.Fprintf(wr, "uhasql_wal_size_bytes{db=\"%s\"} %d\n",
+			metricsLabel(f.name), fileSize(f.path+"-wal"))
+	}
+	writeHeader(wr, "uhasql_snapshots_total", "Snapshots that were persisted.",
+		"counter")
+	fmt.Fprintf(wr, "uhasql_snapshots_total %d\n", snapshotCount)
+	writeHeader(wr, "uhasql_snapshot_duration_seconds",
+		"Duration of the last snapshot.", "gauge")
+	fmt.Fprintf(wr, "uhasql_snapshot_duration_seconds %g\n", snapshotDuration)
+	writeHeader(wr, "uhasql_snapshot_size_bytes", "Size of the last snapshot.",
+		"gauge")
+	fmt.Fprintf(wr, "uhasql_snapshot_size_bytes %d\n", snapshotSize)
+	writeHeader(wr, "uhasql_applied_index", "Last applied index.",
+		"gauge")
+	fmt.Fprintf(wr, "uhasql_applied_index %d\n", index)
+}
+
+func writeHeader(wr io.Writer, name, help, typ string) {
+	fmt.Fprintf(wr, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistograms(wr io.Writer, name, help, label string,
+	m map[string]*histogram,
+) {
+	writeHeader(wr, name, help, "histogram")
+	for _, value := range sortedKeys(m) {
+		h := m[value]
+		lv := label + "=\"" + metricsLabel(value) + "\""
+		var count uint64
+		for i, le := range metricsBuckets {
+			count += h.counts[i]
+			fmt.Fprintf(wr, "%s_bucket{%s,le=\"%g\"} %d\n", name, lv, le,
+				count)
+		}
+		fmt.Fprintf(wr, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, lv, h.count)
+		fmt.Fprintf(wr, "%s_sum{%s} %g\n", name, lv, h.sum)
+		fmt.Fprintf(wr, "%s_count{%s} %d\n", name, lv, h.count)
+	}
+}
+
+func writeCounters(wr io.Writer, name, help, label string,
+	m map[string]uint64,
+) {
+	writeHeader(wr, name, help, "counter")
+	var values []string
+	for value := range m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(wr, "%s{%s=\"%s\"} %d\n", name, label,
+			metricsLabel(value), m[value])
+	}
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metricsLabelReplacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsLabel escapes a label value.
+func metricsLabel(value string) string {
+	return metricsLabelReplacer.Replace(value)
+}
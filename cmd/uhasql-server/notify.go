@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/robertkrimen/otto"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+// extern void uhasqlNotify(sqlite3_context *ctx, int argc,
+//     sqlite3_value **argv);
+import "C"
+
+// noteBufferSize is the max number of messages that can be waiting to be
+// sent to a subscriber. A subscriber that falls behind is disconnected.
+const noteBufferSize = 4096
+
+// note is a notification from the notify() function.
+type note struct {
+	channel string
+	payload string
+}
+
+// notePending are the notifications that are recorded while a write command
+// is running. They are published when the command commits.
+var notePending []note
+
+// cmainSchema is the name of the main schema of a database connection.
+var cmainSchema = C.CString("main")
+
+var errNotifyNotWrite = errors.New("notify() can only be used by writes, " +
+	"try EXEC")
+
+type subscriber struct {
+	ch       chan note
+	channels map[string]bool
+	closed   bool
+}
+
+var subsMu sync.Mutex
+var subs = make(map[string]map[*subscriber]bool)
+
+// createNotifyFunc adds the notify(channel, payload) function.
+func (db *sqlDatabase) createNotifyFunc() error {
+	cname := C.CString("notify")
+	defer C.free(unsafe.Pointer(cname))
+	rc := C.sqlite3_create_function(db.db, cname, 2, C.SQLITE_UTF8, nil,
+		(*[0]byte)(unsafe.Pointer(C.uhasqlNotify)), nil, nil)
+	if rc != C.SQLITE_OK {
+		return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+	}
+	return nil
+}
+
+//export uhasqlNotify
+func uhasqlNotify(ctx *C.sqlite3_context, argc C.int,
+	argv **C.sqlite3_value,
+) {
+	db := C.sqlite3_context_db_handle(ctx)
+	if !recording || C.sqlite3_db_readonly(db, cmainSchema) != 0 {
+		cmsg := C.CString(errNotifyNotWrite.Error())
+		C.sqlite3_result_error(ctx, cmsg, -1)
+		C.free(unsafe.Pointer(cmsg))
+		return
+	}
+	args := (*[2]*C.sqlite3_value)(unsafe.Pointer(argv))
+	var vals [2]string
+	for i := range vals {
+		text := C.sqlite3_value_text(args[i])
+		vals[i] = C.GoString((*C.char)(unsafe.Pointer(text)))
+	}
+	notePending = append(notePending, note{vals[0], vals[1]})
+	C.sqlite3_result_null(ctx)
+}
+
+func notifyFn(call otto.FunctionCall) otto.Value {
+	if !call.Argument(0).IsDefined() {
+		panic("notify: channel not provided")
+	}
+	notePending = append(notePending, note{
+		channel: call.Argument(0).String(),
+		payload: call.Argument(1).String(),
+	})
+	return otto.UndefinedValue()
+}
+
+// publishPending sends the recorded notifications to the subscribers on this
+// server.
+func publishPending() {
+	if len(notePending) == 0 {
+		return
+	}
+	subsMu.Lock()
+	for _, n := range notePending {
+		for sub := range subs[n.channel] {
+			select {
+			case sub.ch <- n:
+			default:
+				// The subscriber is too slow.
+				unsubscribe(sub, nil)
+				sub.closed = true
+				close(sub.ch)
+			}
+		}
+	}
+	subsMu.Unlock()
+	notePending = notePending[:0]
+}
+
+// unsubscribe removes the subscriber from the channels, or from all of its
+// channels when none are provided. The subsMu lock must be held.
+func unsubscribe(sub *subscriber, channels []string) {
+	if channels == nil {
+		for channel := range sub.channels {
+			channels = append(channels, channel)
+		}
+	}
+	for _, channel := range channels {
+		delete(sub.channels, channel)
+		delete(subs[channel], sub)
+		if len(subs[channel]) == 0 {
+			delete(subs, channel)
+		}
+	}
+}
+
+// SUBSCRIBE channel [channel ...]
+// help: receives the notifications that are sent to the channels using the
+// notify() function. The connection stays in subscribe mode, which only
+// allows for the SUBSCRIBE, UNSUBSCRIBE, PING, and QUIT commands.
+func cmdSUBSCRIBE(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	return uhaha.Hijack(func(s uhaha.Service, conn uhaha.HijackedConn) {
+		subscribeStream(conn, args[1:])
+	}), nil
+}
+
+func subscribeStream(conn uhaha.HijackedConn, channels []string) {
+	defer conn.Close()
+	sub := &subscriber{
+		ch:       make(chan note, noteBufferSize),
+		channels: make(map[string]bool),
+	}
+	defer func() {
+		subsMu.Lock()
+		unsubscribe(sub, nil)
+		subsMu.Unlock()
+	}()
+	done := make(chan bool)
+	defer close(done)
+	cmds := make(chan []string)
+	go func() {
+		defer close(cmds)
+		for {
+			args, err := conn.ReadCommand()
+			if err != nil {
+				return
+			}
+			select {
+			case cmds <- args:
+			case <-done:
+				return
+			}
+		}
+	}()
+	args := append([]string{"subscribe"}, channels...)
+	for {
+		if !subscribeCommand(conn, sub, args) {
+			return
+		}
+		if err := conn.Flush(); err != nil {
+			return
+		}
+		args = nil
+		for args == nil {
+			select {
+			case n, ok := <-sub.ch:
+				if !ok {
+					return
+				}
+				conn.WriteAny([]interface{}{"message", n.channel, n.payload})
+				if len(sub.ch) == 0 {
+					if err := conn.Flush(); err != nil {
+						return
+					}
+				}
+			case args = <-cmds:
+				if args == nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// subscribeCommand runs a command from a subscriber. Returns false when the
+// subscriber should be disconnected.
+func subscribeCommand(conn uhaha.HijackedConn, sub *subscriber,
+	args []string,
+) bool {
+	if len(args) == 0 {
+		return true
+	}
+	switch strings.ToLower(args[0]) {
+	case "subscribe":
+		if len(args) < 2 {
+			conn.WriteAny(uhaha.ErrWrongNumArgs)
+			return true
+		}
+		subsMu.Lock()
+		defer subsMu.Unlock()
+		if sub.closed {
+			return false
+		}
+		for _, channel := range args[1:] {
+			sub.channels[channel] = true
+			if subs[channel] == nil {
+				subs[channel] = make(map[*subscriber]bool)
+			}
+			subs[channel][sub] = true
+			conn.WriteAny([]interface{}{"subscribe", channel,
+				len(sub.channels)})
+		}
+	case "unsubscribe":
+		subsMu.Lock()
+		defer subsMu.Unlock()
+		channels := args[1:]
+		if len(channels) == 0 {
+			for channel := range sub.channels {
+				channels = append(channels, channel)
+			}
+		}
+		for _, channel := range channels {
+			unsubscribe(sub, []string{channel})
+			conn.WriteAny([]interface{}{"unsubscribe", channel,
+				len(sub.channels)})
+		}
+	case "ping":
+		conn.WriteAny([]interface{}{"pong", ""})
+	case "quit":
+		conn.WriteAny(redcon.SimpleString("OK"))
+		conn.Flush()
+		return false
+	default:
+		conn.WriteAny(errors.New("only SUBSCRIBE, UNSUBSCRIBE, PING, " +
+			"and QUIT are allowed in this context"))
+	}
+	return true
+}
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/uhaha"
+)
+
+// pgEnabled is true when the server accepts PostgreSQL wire protocol
+// connections, which is set by the --pgwire flag.
+var pgEnabled bool
+
+const (
+	pgProtocolVersion = 196608 // 3.0
+	pgCancelRequest   = 80877102
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgMaxMessage      = 64 * 1024 * 1024
+)
+
+// PostgreSQL type oids
+const (
+	pgBool   = 16
+	pgBytea  = 17
+	pgInt8   = 20
+	pgInt2   = 21
+	pgInt4   = 23
+	pgText   = 25
+	pgFloat4 = 700
+	pgFloat8 = 701
+)
+
+// pgService provides a PostgreSQL wire protocol service that shares the same
+// network port as the Redis service. Both the simple and extended query
+// protocols are supported. Statements are routed just like statements from a
+// Redis connection.
+func pgService() (
+	sniff func(rd io.Reader) bool,
+	acceptor func(s uhaha.Service, ln net.Listener),
+) {
+	return pgSniff, func(s uhaha.Service, ln net.Listener) {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				s.Log().Fatal(err)
+			}
+			go pgServe(s, conn)
+		}
+	}
+}
+
+// pgSniff returns true when the connection starts with a PostgreSQL startup
+// message.
+func pgSniff(rd io.Reader) bool {
+	if !pgEnabled {
+		return false
+	}
+	// The startup message begins with its length, which is always small
+	// enough for the first byte to be zero. A Redis command never starts with
+	// a zero.
+	var buf [8]byte
+	if _, err := io.ReadFull(rd, buf[:1]); err != nil || buf[0] != 0 {
+		return false
+	}
+	if _, err := io.ReadFull(rd, buf[1:]); err != nil {
+		return false
+	}
+	switch binary.BigEndian.Uint32(buf[4:]) {
+	case pgProtocolVersion, pgCancelRequest, pgSSLRequest, pgGSSENCRequest:
+		return true
+	}
+	return false
+}
+
+type pgConn struct {
+	s       uhaha.Service
+	conn    net.Conn
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	opts    uhaha.SendOptions
+	ctx     *connContext
+	user    string // user from the startup message, when it's logged in
+	token   string
+	stmts   map[string]*pgStmt
+	portals map[string]*pgPortal
+}
+
+// pgStmt is a prepared statement from a Parse message.
+type pgStmt struct {
+	sql       string   // sql using ?NNN parameters, empty for no statement
+	readonly  bool     // statement only reads data
+	nparams   int      // number of parameters
+	paramOIDs []uint32 // parameter types provided by the client
+	names     []string // column names
+	oids      []uint32 // column types
+}
+
+// pgPortal is a statement with bound parameters from a Bind message.
+type pgPortal struct {
+	stmt    *pgStmt
+	params  []interface{}
+	formats []int16
+}
+
+// pgResult is a resultset from an executed statement.
+type pgResult struct {
+	sql     string
+	names   []string
+	types   []string
+	rows    [][]interface{}
+	changes int64
+}
+
+// pgError is an error with a SQLSTATE code.
+type pgError struct {
+	code string
+	msg  string
+}
+
+func (err *pgError) Error() string {
+	return err.msg
+}
+
+func pgServe(s uhaha.Service, conn net.Conn) {
+	defer conn.Close()
+	defer forgetCert(conn.RemoteAddr().String())
+	c := &pgConn{
+		s:       s,
+		conn:    conn,
+		rd:      bufio.NewReader(conn),
+		wr:      bufio.NewWriter(conn),
+		stmts:   make(map[string]*pgStmt),
+		portals: make(map[string]*pgPortal),
+	}
+	c.opts.From = c
+	if err := c.startup(); err != nil {
+		c.writeError(err)
+		c.wr.Flush()
+		return
+	}
+	addr := conn.RemoteAddr().String()
+	context, accept := s.Opened(addr)
+	if !accept {
+		c.writeError(&pgError{"08004", "connection not accepted"})
+		c.wr.Flush()
+		return
+	}
+	defer s.Closed(context, addr)
+	c.opts.Context = context
+	c.ctx, _ = context.(*connContext)
+	if c.ctx == nil {
+		c.ctx = &connContext{addr: addr}
+	}
+	if c.user != "" {
+		c.ctx.user, c.ctx.token = c.user, c.token
+	}
+
+	var key [8]byte
+	rand.Read(key[:])
+	c.write('R', pgInt32(nil, 0)) // AuthenticationOk
+	for _, param := range [][2]string{
+		{"server_version", "13.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		c.write('S', pgString(pgString(nil, param[0]), param[1]))
+	}
+	c.write('K', key[:])
+	c.ready()
+
+	var failed bool
+	for {
+		if c.rd.Buffered() == 0 {
+			if err := c.wr.Flush(); err != nil {
+				return
+			}
+		}
+		typ, msg, err := c.read()
+		if err != nil {
+			return
+		}
+		if failed && typ != 'S' && typ != 'X' {
+			// Messages are ignored after an error in the extended protocol
+			// until the next Sync.
+			continue
+		}
+		switch typ {
+		case 'Q':
+			rd := pgReader{b: msg}
+			if err := c.query(rd.string()); err != nil {
+				c.writeError(err)
+			}
+			c.ready()
+			continue
+		case 'P':
+			err = c.parse(msg)
+		case 'B':
+			err = c.bind(msg)
+		case 'D':
+			err = c.describe(msg)
+		case 'E':
+			err = c.execute(msg)
+		case 'C':
+			err = c.close(msg)
+		case 'S':
+			failed = false
+			c.ready()
+		case 'H':
+			err = c.wr.Flush()
+		case 'X':
+			return
+		default:
+			err = &pgError{"08P01",
+				fmt.Sprintf("unsupported message type '%c'", typ)}
+		}
+		if err != nil {
+			c.writeError(err)
+			failed = true
+		}
+	}
+}
+
+// startup reads the startup message and authenticates the client. When the
+// user of the startup message is a UhaSQL user, the client logs in as that
+// user, without a password when it's the user of the client certificate.
+// Otherwise the password must be the auth of the server.
+func (c *pgConn) startup() error {
+	var user string
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint32(hdr[:]))
+		if n < 8 || n > 10000 {
+			return &pgError{"08P01", "invalid startup message"}
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(c.rd, msg); err != nil {
+			return err
+		}
+		switch binary.BigEndian.Uint32(msg) {
+		case pgSSLRequest, pgGSSENCRequest:
+			// Encryption is provided by the server TLS settings, which wrap
+			// the entire connection, so there's nothing to negotiate.
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+			continue
+		case pgCancelRequest:
+			return &pgError{"0A000", "cancel requests are not supported"}
+		case pgProtocolVersion:
+			rd := pgReader{b: msg[4:]}
+			for {
+				key := rd.string()
+				if key == "" || rd.err != nil {
+					break
+				}
+				if value := rd.string(); key == "user" {
+					user = value
+				}
+			}
+		default:
+			return &pgError{"0A000", "unsupported frontend protocol"}
+		}
+		break
+	}
+	if user != "" && user == certName(c.conn.RemoteAddr().String()) {
+		if c.user, c.token = certUser(user); c.user != "" {
+			return nil
+		}
+	}
+	if userExists(user) {
+		password, err := c.password()
+		if err != nil {
+			return err
+		}
+		token, err := login(user, password)
+		if err != nil {
+			return &pgError{"28P01", "password authentication failed"}
+		}
+		c.user, c.token = user, token
+		return nil
+	}
+	if c.s.Auth("") == nil {
+		return nil
+	}
+	password, err := c.password()
+	if err != nil {
+		return err
+	}
+	if c.s.Auth(password) != nil {
+		return &pgError{"28P01", "password authentication failed"}
+	}
+	return nil
+}
+
+// password asks the client for a cleartext password.
+func (c *pgConn) password() (string, error) {
+	c.write('R', pgInt32(nil, 3)) // AuthenticationCleartextPassword
+	if err := c.wr.Flush(); err != nil {
+		return "", err
+	}
+	typ, msg, err := c.read()
+	if err != nil {
+		return "", err
+	}
+	rd := pgReader{b: msg}
+	password := rd.string()
+	if typ != 'p' || rd.err != nil {
+		return "", &pgError{"28P01", "password authentication failed"}
+	}
+	return password, nil
+}
+
+// read reads the next message.
+func (c *pgConn) read() (typ byte, msg []byte, err error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[1:]))
+	if n < 4 || n > pgMaxMessage {
+		return 0, nil, errors.New("invalid message length")
+	}
+	msg = make([]byte, n-4)
+	if _, err := io.ReadFull(c.rd, msg); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], msg, nil
+}
+
+// write writes a message. Errors are returned by the next flush.
+func (c *pgConn) write(typ byte, msg []byte) {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)+4))
+	c.wr.Write(hdr[:])
+	c.wr.Write(msg)
+}
+
+func (c *pgConn) ready() {
+	// Each request is its own transaction, so the connection is always idle.
+	c.write('Z', []byte{'I'})
+}
+
+func (c *pgConn) writeError(err error) {
+	perr, ok := err.(*pgError)
+	if !ok {
+		perr = pgConvertError(err)
+	}
+	var msg []byte
+	msg = pgString(append(msg, 'S'), "ERROR")
+	msg = pgString(append(msg, 'V'), "ERROR")
+	msg = pgString(append(msg, 'C'), perr.code)
+	msg = pgString(append(msg, 'M'), perr.msg)
+	c.write('E', append(msg, 0))
+}
+
+// pgConvertError converts an error from the service into an error with the
+// closest matching SQLSTATE code.
+func pgConvertError(err error) *pgError {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "TRY ") {
+		parts := strings.Split(msg, " ")
+		return &pgError{"25006", "this server is not the leader, " +
+			"connect to the leader at " + parts[len(parts)-1]}
+	}
+	for _, e := range [][2]string{
+		{"CLUSTERDOWN", "57P03"},
+		{"no such table", "42P01"},
+		{"no such column", "42703"},
+		{"syntax error", "42601"},
+		{"UNIQUE constraint failed", "23505"},
+		{"NOT NULL constraint failed", "23502"},
+		{"FOREIGN KEY constraint failed", "23503"},
+		{"CHECK constraint failed", "23514"},
+	} {
+		if strings.Contains(msg, e[0]) {
+			return &pgError{e[1], msg}
+		}
+	}
+	return &pgError{"XX000", msg}
+}
+
+// query handles a simple query, which may have multiple statements.
+func (c *pgConn) query(sql string) error {
+	stmts, readonly, err := sqlStatements(sql)
+	if err != nil {
+		return err
+	}
+	if len(stmts) == 0 {
+		c.write('I', nil) // EmptyQueryResponse
+		return nil
+	}
+	data, _ := json.Marshal(stmts)
+	results, err := c.run(string(data), readonly)
+	if err != nil {
+		return err
+	}
+	for i, rs := range results {
+		rs.sql = stmts[i]
+		oids := make([]uint32, len(rs.names))
+		for j := range oids {
+			oids[j] = pgTypeOID(rs.types[j], rs.rows, j)
+		}
+		if len(rs.names) > 0 {
+			c.writeRowDescription(rs.names, oids, nil)
+		}
+		if err := c.writeRows(rs, oids, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run sends the statements to the service and returns the resultsets.
+func (c *pgConn) run(sqlJSON string, readonly bool) ([]pgResult, error) {
+	args := []string{"$QUERY", sqlJSON, "withtypes"}
+	if !readonly {
+		args = []string{"$EXEC", sqlJSON, "withinfo", "withtypes"}
+	}
+	args = c.ctx.options(args...)
+	var res interface{}
+	for {
+		var err error
+		res, _, err = c.s.Send(args, &c.opts).Recv()
+		if err != nil {
+			return nil, err
+		}
+		fargs, ok := res.(uhaha.FilterArgs)
+		if !ok {
+			break
+		}
+		args = fargs
+	}
+	vals, _ := res.([]interface{})
+	if !readonly && len(vals) == 4 {
+		vals, _ = vals[3].([]interface{})
+	}
+	var results []pgResult
+	for _, val := range vals {
+		var rs pgResult
+		if info, ok := val.([]interface{}); ok {
+			// with info: "rows", rows, "changes", n, ...
+			for i := 0; i+1 < len(info); i += 2 {
+				switch info[i] {
+				case "rows":
+					val = info[i+1]
+				case "changes":
+					rs.changes, _ = info[i+1].(int64)
+				}
+			}
+		}
+		rows, _ := val.([][]interface{})
+		if len(rows) < 2 {
+			return nil, errors.New("invalid response")
+		}
+		for i := range rows[0] {
+			name, _ := rows[0][i].(string)
+			typ, _ := rows[1][i].(string)
+			rs.names = append(rs.names, name)
+			rs.types = append(rs.types, typ)
+		}
+		rs.rows = rows[2:]
+		results = append(results, rs)
+	}
+	return results, nil
+}
+
+// parse handles a Parse message, which prepares a single statement.
+func (c *pgConn) parse(msg []byte) error {
+	rd := pgReader{b: msg}
+	name := rd.string()
+	sql := rd.string()
+	stmt := new(pgStmt)
+	nparams := rd.count()
+	for i := 0; i < nparams; i++ {
+		stmt.paramOIDs = append(stmt.paramOIDs, uint32(rd.int32()))
+	}
+	if rd.err != nil {
+		return rd.err
+	}
+	stmts, readonly, err := sqlStatements(sql)
+	if err != nil {
+		return err
+	}
+	if len(stmts) > 1 {
+		return &pgError{"42601",
+			"cannot insert multiple commands into a prepared statement"}
+	}
+	if len(stmts) == 1 {
+		stmt.sql = pgRewriteParams(stmts[0])
+		stmt.readonly = readonly
+		var types []string
+		stmt.names, types, stmt.nparams, err = pgDescribe(c.ctx, stmt.sql)
+		if err != nil {
+			return err
+		}
+		for _, typ := range types {
+			stmt.oids = append(stmt.oids, pgTypeOID(typ, nil, 0))
+		}
+	}
+	c.stmts[name] = stmt
+	c.write('1', nil) // ParseComplete
+	return nil
+}
+
+// pgDescribe prepares the statement using a reader database. The statement
+// is authorized for the user of the connection.
+func pgDescribe(ctx *connContext, sql string) (names, types []string,
+	nparams int, err error,
+) {
+	user, err := authenticate(ctx.user, ctx.token)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	db, err := takeReaderDB()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer releaseReaderDB(db)
+	rlockDB()
+	defer dbmu.RUnlock()
+	db.sandbox(user)
+	defer db.endSandbox()
+	return db.describe(sql)
+}
+
+// bind handles a Bind message, which binds parameters to a statement.
+func (c *pgConn) bind(msg []byte) error {
+	rd := pgReader{b: msg}
+	portalName := rd.string()
+	stmtName := rd.string()
+	pformats := make([]int16, rd.count())
+	for i := range pformats {
+		pformats[i] = rd.int16()
+	}
+	params := make([]interface{}, rd.count())
+	if rd.err != nil {
+		return rd.err
+	}
+	stmt, ok := c.stmts[stmtName]
+	if !ok {
+		return &pgError{"26000",
+			fmt.Sprintf("prepared statement \"%s\" does not exist", stmtName)}
+	}
+	if len(params) != stmt.nparams {
+		return &pgError{"08P01", fmt.Sprintf("bind message supplies %d "+
+			"parameters, but prepared statement requires %d",
+			len(params), stmt.nparams)}
+	}
+	for i := range params {
+		n := int(rd.int32())
+		if n < 0 {
+			continue
+		}
+		data := rd.bytes(n)
+		if rd.err != nil {
+			return rd.err
+		}
+		var oid uint32
+		if i < len(stmt.paramOIDs) {
+			oid = stmt.paramOIDs[i]
+		}
+		var err error
+		params[i], err = pgDecodeParam(data, oid, pgFormat(pformats, i))
+		if err != nil {
+			return err
+		}
+	}
+	portal := &pgPortal{stmt: stmt, params: params}
+	portal.formats = make([]int16, rd.count())
+	for i := range portal.formats {
+		portal.formats[i] = rd.int16()
+	}
+	if rd.err != nil {
+		return rd.err
+	}
+	c.portals[portalName] = portal
+	c.write('2', nil) // BindComplete
+	return nil
+}
+
+// describe handles a Describe message for a statement or portal.
+func (c *pgConn) describe(msg []byte) error {
+	rd := pgReader{b: msg}
+	kind := rd.byte()
+	name := rd.string()
+	if rd.err != nil {
+		return rd.err
+	}
+	var stmt *pgStmt
+	var formats []int16
+	if kind == 'S' {
+		var ok bool
+		stmt, ok = c.stmts[name]
+		if !ok {
+			return &pgError{"26000",
+				fmt.Sprintf("prepared statement \"%s\" does not exist", name)}
+		}
+		params := pgInt16(nil, int16(stmt.nparams))
+		for i := 0; i < stmt.nparams; i++ {
+			var oid uint32
+			if i < len(stmt.paramOIDs) {
+				oid = stmt.paramOIDs[i]
+			}
+			params = pgInt32(params, int32(oid))
+		}
+		c.write('t', params) // ParameterDescription
+	} else {
+		portal, ok := c.portals[name]
+		if !ok {
+			return &pgError{"34000",
+				fmt.Sprintf("portal \"%s\" does not exist", name)}
+		}
+		stmt, formats = portal.stmt, portal.formats
+	}
+	if len(stmt.names) == 0 {
+		c.write('n', nil) // NoData
+	} else {
+		c.writeRowDescription(stmt.names, stmt.oids, formats)
+	}
+	return nil
+}
+
+// execute handles an Execute message, which runs the statement of a portal.
+func (c *pgConn) execute(msg []byte) error {
+	rd := pgReader{b: msg}
+	name := rd.string()
+	if rd.err != nil {
+		return rd.err
+	}
+	portal, ok := c.portals[name]
+	if !ok {
+		return &pgError{"34000",
+			fmt.Sprintf("portal \"%s\" does not exist", name)}
+	}
+	if portal.stmt.sql == "" {
+		c.write('I', nil) // EmptyQueryResponse
+		return nil
+	}
+	vals := []interface{}{portal.stmt.sql}
+	for _, param := range portal.params {
+		if data, ok := param.([]byte); ok {
+			param = map[string]string{
+				"blob": base64.StdEncoding.EncodeToString(data),
+			}
+		}
+		vals = append(vals, param)
+	}
+	data, err := json.Marshal([]interface{}{vals})
+	if err != nil {
+		return err
+	}
+	results, err := c.run(string(data), portal.stmt.readonly)
+	if err != nil {
+		return err
+	}
+	rs := results[0]
+	rs.sql = portal.stmt.sql
+	return c.writeRows(rs, portal.stmt.oids, portal.formats)
+}
+
+// close handles a Close message for a statement or portal.
+func (c *pgConn) close(msg []byte) error {
+	rd := pgReader{b: msg}
+	kind := rd.byte()
+	name := rd.string()
+	if rd.err != nil {
+		return rd.err
+	}
+	if kind == 'S' {
+		delete(c.stmts, name)
+	} else {
+		delete(c.portals, name)
+	}
+	c.write('3', nil) // CloseComplete
+	return nil
+}
+
+func (c *pgConn) writeRowDescription(names []string, oids []uint32,
+	formats []int16,
+) {
+	msg := pgInt16(nil, int16(len(names)))
+	for i, name := range names {
+		msg = pgString(msg, name)
+		msg = pgInt32(msg, 0) // table oid
+		msg = pgInt16(msg, 0) // column number
+		msg = pgInt32(msg, int32(oids[i]))
+		switch oids[i] {
+		case pgBool:
+			msg = pgInt16(msg, 1)
+		case pgInt8, pgFloat8:
+			msg = pgInt16(msg, 8)
+		default:
+			msg = pgInt16(msg, -1)
+		}
+		msg = pgInt32(msg, -1) // type modifier
+		msg = pgInt16(msg, pgFormat(formats, i))
+	}
+	c.write('T', msg)
+}
+
+// writeRows writes the DataRow messages and the CommandComplete message.
+func (c *pgConn) writeRows(rs pgResult, oids []uint32, formats []int16,
+) error {
+	for _, row := range rs.rows {
+		msg := pgInt16(nil, int16(len(row)))
+		for i, val := range row {
+			var oid uint32 = pgText
+			if i < len(oids) {
+				oid = oids[i]
+			}
+			data, err := pgEncodeValue(val, oid, pgFormat(formats, i))
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				msg = pgInt32(msg, -1)
+			} else {
+				msg = append(pgInt32(msg, int32(len(data))), data...)
+			}
+		}
+		c.write('D', msg)
+	}
+	c.write('C', pgString(nil, pgCommandTag(rs)))
+	return nil
+}
+
+// pgCommandTag returns the tag for the CommandComplete message.
+func pgCommandTag(rs pgResult) string {
+	cmd := sqlCommand(rs.sql)
+	switch cmd {
+	case "select":
+		return fmt.Sprintf("SELECT %d", len(rs.rows))
+	case "insert", "replace", "upsert":
+		return fmt.Sprintf("INSERT 0 %d", rs.changes)
+	case "update", "delete":
+		return fmt.Sprintf("%s %d", strings.ToUpper(cmd), rs.changes)
+	case "create", "drop", "alter":
+		for _, word := range strings.Fields(strings.ToLower(rs.sql)) {
+			switch word {
+			case "table", "index", "view", "trigger":
+				return strings.ToUpper(cmd + " " + word)
+			}
+		}
+	}
+	return strings.ToUpper(cmd)
+}
+
+// pgTypeOID returns the type oid for a declared column type, using the same
+// rules that Sqlite uses for determining column affinity. Columns without a
+// declared type, such as expressions, use the type of the first non-null
+// value in the rows, or text when there are no rows.
+func pgTypeOID(decltype string, rows [][]interface{}, col int) uint32 {
+	typ := strings.ToUpper(decltype)
+	switch {
+	case typ == "":
+		for _, row := range rows {
+			switch row[col].(type) {
+			case int64:
+				return pgInt8
+			case float64:
+				return pgFloat8
+			case []byte:
+				return pgBytea
+			case string:
+				return pgText
+			}
+		}
+		return pgText
+	case strings.Contains(typ, "BOOL"):
+		return pgBool
+	case strings.Contains(typ, "INT"):
+		return pgInt8
+	case strings.Contains(typ, "CHAR"), strings.Contains(typ, "CLOB"),
+		strings.Contains(typ, "TEXT"):
+		return pgText
+	case strings.Contains(typ, "BLOB"):
+		return pgBytea
+	case strings.Contains(typ, "REAL"), strings.Contains(typ, "FLOA"),
+		strings.Contains(typ, "DOUB"), strings.Contains(typ, "NUMERIC"),
+		strings.Contains(typ, "DECIMAL"):
+		return pgFloat8
+	}
+	// Dates, times, and other types are returned as text.
+	return pgText
+}
+
+// pgEncodeValue encodes a Sqlite value for a DataRow message. Returns nil for
+// NULL.
+func pgEncodeValue(val interface{}, oid uint32, format int16,
+) ([]byte, error) {
+	if val == nil {
+		return nil, nil
+	}
+	var text string
+	switch v := val.(type) {
+	case int64:
+		text = strconv.FormatInt(v, 10)
+	case float64:
+		text = strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		text = v
+	case []byte:
+		if oid == pgBytea && format == 0 {
+			return []byte(`\x` + hex.EncodeToString(v)), nil
+		}
+		text = string(v)
+	}
+	switch oid {
+	case pgBool:
+		truthy := text != "" && text != "0" && strings.ToLower(text) != "f" &&
+			strings.ToLower(text) != "false"
+		if format != 0 {
+			if truthy {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		}
+		if truthy {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case pgInt8:
+		if format != 0 {
+			n, ok := val.(int64)
+			if !ok {
+				f, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, &pgError{"22P02", fmt.Sprintf(
+						"invalid input syntax for type bigint: \"%s\"", text)}
+				}
+				n = int64(f)
+			}
+			return pgInt64(nil, n), nil
+		}
+	case pgFloat8:
+		if format != 0 {
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, &pgError{"22P02", fmt.Sprintf(
+					"invalid input syntax for type double precision: \"%s\"",
+					text)}
+			}
+			return pgInt64(nil, int64(math.Float64bits(f))), nil
+		}
+	}
+	return []byte(text), nil
+}
+
+// pgDecodeParam decodes a parameter from a Bind message into a value that
+// can be bound to a Sqlite statement.
+func pgDecodeParam(data []byte, oid uint32, format int16,
+) (interface{}, error) {
+	if format != 0 {
+		switch {
+		case oid == pgBool && len(data) == 1:
+			return int64(data[0]), nil
+		case oid == pgInt2 && len(data) == 2:
+			return int64(int16(binary.BigEndian.Uint16(data))), nil
+		case oid == pgInt4 && len(data) == 4:
+			return int64(int32(binary.BigEndian.Uint32(data))), nil
+		case oid == pgInt8 && len(data) == 8:
+			return int64(binary.BigEndian.Uint64(data)), nil
+		case oid == pgFloat4 && len(data) == 4:
+			return float64(math.Float32frombits(
+				binary.BigEndian.Uint32(data))), nil
+		case oid == pgFloat8 && len(data) == 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+		case oid == pgText:
+			return string(data), nil
+		}
+		return data, nil
+	}
+	text := string(data)
+	switch oid {
+	case pgBool:
+		switch strings.ToLower(text) {
+		case "t", "true", "1", "y", "yes", "on":
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case pgInt2, pgInt4, pgInt8:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, &pgError{"22P02", fmt.Sprintf(
+				"invalid input syntax for type bigint: \"%s\"", text)}
+		}
+		return n, nil
+	case pgFloat4, pgFloat8:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, &pgError{"22P02", fmt.Sprintf(
+				"invalid input syntax for type double precision: \"%s\"",
+				text)}
+		}
+		return f, nil
+	case pgBytea:
+		if strings.HasPrefix(text, `\x`) {
+			data, err := hex.DecodeString(text[2:])
+			if err != nil {
+				return nil, &pgError{"22P02",
+					"invalid input syntax for type bytea"}
+			}
+			return data, nil
+		}
+		return data, nil
+	}
+	return text, nil
+}
+
+// pgRewriteParams converts the PostgreSQL $1 style parameters into the
+// equivalent Sqlite ?1 parameters.
+func pgRewriteParams(sql string) string {
+	b := []byte(sql)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\'', '"', '`':
+			q := b[i]
+			for i++; i < len(b) && b[i] != q; i++ {
+			}
+		case '[':
+			for i++; i < len(b) && b[i] != ']'; i++ {
+			}
+		case '$':
+			if i+1 < len(b) && b[i+1] >= '0' && b[i+1] <= '9' {
+				b[i] = '?'
+			}
+		}
+	}
+	return string(b)
+}
+
+// pgFormat returns the format code for the column or parameter at index i.
+func pgFormat(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+func pgString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+func pgInt16(b []byte, n int16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func pgInt32(b []byte, n int32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func pgInt64(b []byte, n int64) []byte {
+	return pgInt32(pgInt32(b, int32(n>>32)), int32(n))
+}
+
+// pgReader reads the fields of a message. The first error is kept and all
+// reads after an error return zero values.
+type pgReader struct {
+	b   []byte
+	err error
+}
+
+var errPGShortMessage = &pgError{"08P01", "invalid message format"}
+
+func (rd *pgReader) bytes(n int) []byte {
+	if rd.err != nil || n < 0 || n > len(rd.b) {
+		rd.err = errPGShortMessage
+		return nil
+	}
+	data := rd.b[:n]
+	rd.b = rd.b[n:]
+	return data
+}
+
+func (rd *pgReader) byte() byte {
+	if data := rd.bytes(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (rd *pgReader) int16() int16 {
+	if data := rd.bytes(2); data != nil {
+		return int16(binary.BigEndian.Uint16(data))
+	}
+	return 0
+}
+
+func (rd *pgReader) int32() int32 {
+	if data := rd.bytes(4); data != nil {
+		return int32(binary.BigEndian.Uint32(data))
+	}
+	return 0
+}
+
+func (rd *pgReader) count() int {
+	return int(uint16(rd.int16()))
+}
+
+func (rd *pgReader) string() string {
+	for i := 0; rd.err == nil && i < len(rd.b); i++ {
+		if rd.b[i] == 0 {
+			s := string(rd.b[:i])
+			rd.b = rd.b[i+1:]
+			return s
+		}
+	}
+	rd.err = errPGShortMessage
+	return ""
+}
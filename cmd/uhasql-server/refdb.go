@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// refDB is a read-only reference database that is attached to the
+// connections of the default database.
+type refDB struct {
+	name string
+	path string
+}
+
+// refdbs are the reference databases that have been verified on this server.
+// The refdbsVersion is changed each time the list changes, which allows for
+// pooled readers to know that they are out of date.
+var refdbsMu sync.Mutex
+var refdbs []refDB
+var refdbsVersion int
+
+// attachedRefDBs are the names of the reference databases that are attached
+// to the writer. Protected by the dbmu lock.
+var attachedRefDBs []string
+
+// unavailableRefDBs are the names of the reference databases that are missing
+// or have the wrong checksum on this server, which are not attached. Each one
+// is a local fault. Protected by the dbmu lock.
+var unavailableRefDBs []string
+
+func (db *sqlDatabase) ensureRefDBSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __refdb__ (
+			name       TEXT PRIMARY KEY,
+			path       TEXT,
+			sha256     TEXT
+		);
+	`, nil)
+}
+
+// fileSHA256 returns the sha256 checksum of a file as a hex string.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyRefDB checks that the file exists on this server and that it has the
+// provided checksum.
+func verifyRefDB(path, sum string) error {
+	actual, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if actual != strings.ToLower(sum) {
+		return fmt.Errorf("checksum mismatch for '%s'", path)
+	}
+	return nil
+}
+
+// attachRefDB attaches a reference database to the connection. The file is
+// opened in read-only mode, so writes to it fail.
+func (db *sqlDatabase) attachRefDB(ref refDB) error {
+	uri := (&url.URL{Scheme: "file", Path: ref.path}).String() +
+		"?mode=ro&immutable=1"
+	return db.execArgs(`attach database ? as `+quoteIdent(ref.name),
+		[]interface{}{uri}, nil)
+}
+
+// attachRefDBs attaches all of the reference databases to a reader.
+func (db *sqlDatabase) attachRefDBs() error {
+	refdbsMu.Lock()
+	list := refdbs
+	db.refs = refdbsVersion
+	refdbsMu.Unlock()
+	for _, ref := range list {
+		if err := db.attachRefDB(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRefDBs verifies the reference databases that are registered in the
+// __refdb__ table and attaches them to the writer. A file that is missing or
+// has the wrong checksum is not attached and is recorded as a local fault,
+// so the statements that read from it fail on this server rather than return
+// results that differ from the other servers. The pooled readers are closed,
+// so the new readers get the new list. The dbmu lock must be held.
+func loadRefDBs() error {
+	var rows [][]string
+	err := wdb.exec(`select name, path, sha256 from __refdb__ order by name`,
+		func(row []string) bool {
+			rows = append(rows, row)
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	for len(attachedRefDBs) > 0 {
+		name := attachedRefDBs[len(attachedRefDBs)-1]
+		if err := wdb.exec(`detach database `+quoteIdent(name),
+			nil); err != nil {
+			return err
+		}
+		attachedRefDBs = attachedRefDBs[:len(attachedRefDBs)-1]
+	}
+	for _, name := range unavailableRefDBs {
+		setLocalFault(refdbFault(name), nil)
+	}
+	unavailableRefDBs = nil
+	var list []refDB
+	for _, row := range rows[1:] {
+		ref := refDB{name: row[0], path: row[1]}
+		err := verifyRefDB(ref.path, row[2])
+		if err == nil {
+			err = wdb.attachRefDB(ref)
+		}
+		if err != nil {
+			setLocalFault(refdbFault(ref.name), err)
+			unavailableRefDBs = append(unavailableRefDBs, ref.name)
+			continue
+		}
+		list = append(list, ref)
+		attachedRefDBs = append(attachedRefDBs, ref.name)
+	}
+	refdbsMu.Lock()
+	refdbs = list
+	refdbsVersion++
+	refdbsMu.Unlock()
+	closeReaderDBs()
+	return nil
+}
+
+// refdbFault returns what has the local fault of a reference database.
+func refdbFault(name string) string {
+	return "reference database '" + name + "'"
+}
+
+// REFDB SET name path sha256
+// help: registers a read-only Sqlite file as a reference database. The file
+// must already exist on every server using the same path and contents. It's
+// attached using the provided name, allowing for statements to read from its
+// tables, such as "select * from name.table".
+func cmdREFDB(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	if len(args) >= 2 && strings.ToLower(args[1]) == "set" {
+		if len(args) != 5 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try REFDB HELP")
+		}
+		name := strings.ToLower(args[2])
+		if !validDBName(name) || name == "main" || name == "temp" {
+			return nil, fmt.Errorf("invalid reference database name '%s'",
+				args[2])
+		}
+		path, err := filepath.Abs(args[3])
+		if err != nil {
+			return nil, err
+		}
+		// Check the file on this server before it's sent to the cluster.
+		if err := verifyRefDB(path, args[4]); err != nil {
+			return nil, err
+		}
+		sdb, err := openSQLFile(path, true)
+		if err != nil {
+			return nil, err
+		}
+		err = sdb.exec("select count(*) from sqlite_master", nil)
+		sdb.close()
+		if err != nil {
+			return nil, err
+		}
+		args = []string{args[0], args[1], name, path, args[4]}
+	}
+	return uhaha.FilterArgs(userArgs(m, "$REFDB", args)), nil
+}
+
+// refdbWriteCommand wraps the $REFDB command. The reference databases are
+// reloaded after the command, because databases can't be attached or detached
+// inside of a transaction.
+func refdbWriteCommand(
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	write := writeCommand(fn)
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		res, err := write(m, args)
+		// The subcommand follows the user, token, and address.
+		if err != nil || len(args) < 5 || strings.ToLower(args[4]) == "list" {
+			return res, err
+		}
+		lockDB()
+		defer dbmu.Unlock()
+		if err := loadRefDBs(); err != nil {
+			logger.Warningf("reference databases: %s", err)
+		}
+		return res, nil
+	}
+}
+
+// REFDB SET name path sha256  -- registers a reference database
+// REFDB DEL name              -- removes a reference database
+// REFDB LIST                  -- returns all reference databases
+func cmdREFDBWRITE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try REFDB HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "set":
+		if len(args) != 5 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try REFDB HELP")
+		}
+		// The file is verified by each server when it's attached.
+		err := wdb.execArgs(`replace into __refdb__ (name, path, sha256)
+			values (?, ?, ?)`,
+			[]interface{}{args[2], args[3], strings.ToLower(args[4])}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString("OK"), nil
+	case "del", "delete":
+		if len(args) != 3 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try REFDB HELP")
+		}
+		err := wdb.execArgs(`delete from __refdb__ where name = ?`,
+			[]interface{}{args[2]}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString("OK"), nil
+	case "list":
+		if len(args) != 2 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try REFDB HELP")
+		}
+		return refdbList()
+	case "help":
+		return []string{
+			"REFDB SET name path sha256",
+			"REFDB DEL name",
+			"REFDB LIST",
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown refdb command '%s %s', "+
+			"try REFDB HELP", args[0], args[1],
+		)
+	}
+}
+
+// refdbList returns the registered reference databases, whether each one is
+// attached on this server, and why it's not.
+func refdbList() (interface{}, error) {
+	attached := make(map[string]bool)
+	for _, name := range attachedRefDBs {
+		attached[name] = true
+	}
+	var list [][]interface{}
+	err := wdb.exec(`select name, path, sha256 from __refdb__ order by name`,
+		func(row []string) bool {
+			var fault string
+			if err := localFault(refdbFault(row[0])); err != nil {
+				fault = err.Error()
+			}
+			list = append(list, []interface{}{
+				"name", row[0],
+				"path", row[1],
+				"sha256", row[2],
+				"attached", attached[row[0]],
+				"error", fault,
+			})
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return list[1:], nil
+}
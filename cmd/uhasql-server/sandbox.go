@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+// extern int uhasqlAuthorize(void *ctx, int action, char *arg1, char *arg2,
+//     char *arg3, char *arg4);
+import "C"
+
+// sandbox is the state of a connection while it runs statements from a
+// client or a proc. Statements from UhaSQL itself are not sandboxed.
+type sandbox struct {
+	user   *userInfo // user of the statements, nil for every privilege
+	write  bool      // statements are run by the writer
+	denied string    // reason for the last denied action
+}
+
+var sandboxMu sync.Mutex
+var sandboxes = make(map[*C.sqlite3]*sandbox)
+
+// deniedFunctions can't be used by any statement.
+var deniedFunctions = map[string]bool{
+	"load_extension": true,
+	"readfile":       true,
+	"writefile":      true,
+	"edit":           true,
+	"fts3_tokenizer": true,
+}
+
+// nondeterministicFunctions may return a different result on each server,
+// so they can't be used by writes. The random and time functions are not
+// included, because they use the machine seed and time.
+var nondeterministicFunctions = map[string]bool{
+	"changes":                   true,
+	"total_changes":             true,
+	"sqlite_version":            true,
+	"sqlite_source_id":          true,
+	"sqlite_compileoption_get":  true,
+	"sqlite_compileoption_used": true,
+	"sqlite_offset":             true,
+}
+
+// safePragmas are the pragmas that only read the schema, which can be used
+// as table-valued functions, such as pragma_table_info('name').
+var safePragmas = map[string]bool{
+	"table_info":        true,
+	"table_xinfo":       true,
+	"index_list":        true,
+	"index_info":        true,
+	"index_xinfo":       true,
+	"foreign_key_list":  true,
+	"foreign_key_check": true,
+	"collation_list":    true,
+	"function_list":     true,
+	"module_list":       true,
+	"pragma_list":       true,
+	"compile_options":   true,
+	"integrity_check":   true,
+	"quick_check":       true,
+}
+
+// enableAuthorizer installs the authorizer, which checks the statements that
+// are prepared while the connection is sandboxed.
+func (db *sqlDatabase) enableAuthorizer() error {
+	rc := C.sqlite3_set_authorizer(db.db,
+		(*[0]byte)(unsafe.Pointer(C.uhasqlAuthorize)),
+		unsafe.Pointer(db.db))
+	if rc != C.SQLITE_OK {
+		return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+	}
+	return nil
+}
+
+// sandbox starts sandboxing the statements of the connection, which are
+// authorized for the user. A nil user has every privilege.
+func (db *sqlDatabase) sandbox(u *userInfo) {
+	sandboxMu.Lock()
+	sandboxes[db.db] = &sandbox{user: u, write: !db.readonly}
+	sandboxMu.Unlock()
+}
+
+// endSandbox stops sandboxing the statements of the connection.
+func (db *sqlDatabase) endSandbox() {
+	sandboxMu.Lock()
+	delete(sandboxes, db.db)
+	sandboxMu.Unlock()
+}
+
+// lastError returns the error from the last failed call on the connection.
+// When a statement was denied by the authorizer, the error is the reason.
+func (db *sqlDatabase) lastError() error {
+	if C.sqlite3_errcode(db.db) == C.SQLITE_AUTH {
+		sandboxMu.Lock()
+		sb := sandboxes[db.db]
+		sandboxMu.Unlock()
+		if sb != nil && sb.denied != "" {
+			return errors.New(sb.denied)
+		}
+	}
+	return errors.New(C.GoString(C.sqlite3_errmsg(db.db)))
+}
+
+//export uhasqlAuthorize
+func uhasqlAuthorize(ctx unsafe.Pointer, action C.int,
+	arg1, arg2, arg3, arg4 *C.char,
+) C.int {
+	sandboxMu.Lock()
+	sb := sandboxes[(*C.sqlite3)(ctx)]
+	sandboxMu.Unlock()
+	if sb == nil {
+		return C.SQLITE_OK
+	}
+	reason := sb.check(action, C.GoString(arg1), C.GoString(arg2))
+	if reason != "" {
+		sb.denied = reason
+		return C.SQLITE_DENY
+	}
+	return C.SQLITE_OK
+}
+
+// check returns the reason that an action is denied, or an empty string when
+// the action is allowed.
+func (sb *sandbox) check(action C.int, arg1, arg2 string) string {
+	var privilege, table string
+	switch action {
+	case C.SQLITE_SELECT, C.SQLITE_TRANSACTION, C.SQLITE_SAVEPOINT,
+		C.SQLITE_RECURSIVE:
+		return ""
+	case C.SQLITE_FUNCTION:
+		name := strings.ToLower(arg2)
+		if deniedFunctions[name] {
+			return fmt.Sprintf("function %s() is not allowed", name)
+		}
+		if sb.write && nondeterministicFunctions[name] {
+			return fmt.Sprintf("function %s() is not allowed in writes, "+
+				"because it's not deterministic", name)
+		}
+		return ""
+	case C.SQLITE_PRAGMA:
+		if !safePragmas[strings.ToLower(arg1)] {
+			return fmt.Sprintf("pragma %s is not allowed", arg1)
+		}
+		return ""
+	case C.SQLITE_ATTACH:
+		return "attach is not allowed, try REFDB"
+	case C.SQLITE_DETACH:
+		return "detach is not allowed, try REFDB"
+	case C.SQLITE_READ:
+		privilege, table = "select", arg1
+	case C.SQLITE_INSERT:
+		privilege, table = "insert", arg1
+	case C.SQLITE_UPDATE:
+		privilege, table = "update", arg1
+	case C.SQLITE_DELETE:
+		privilege, table = "delete", arg1
+	case C.SQLITE_CREATE_TABLE, C.SQLITE_CREATE_TEMP_TABLE,
+		C.SQLITE_DROP_TABLE, C.SQLITE_DROP_TEMP_TABLE,
+		C.SQLITE_CREATE_VIEW, C.SQLITE_CREATE_TEMP_VIEW,
+		C.SQLITE_DROP_VIEW, C.SQLITE_DROP_TEMP_VIEW,
+		C.SQLITE_CREATE_VTABLE, C.SQLITE_DROP_VTABLE, C.SQLITE_ANALYZE:
+		privilege, table = "ddl", arg1
+	case C.SQLITE_CREATE_INDEX, C.SQLITE_CREATE_TEMP_INDEX,
+		C.SQLITE_DROP_INDEX, C.SQLITE_DROP_TEMP_INDEX,
+		C.SQLITE_CREATE_TRIGGER, C.SQLITE_CREATE_TEMP_TRIGGER,
+		C.SQLITE_DROP_TRIGGER, C.SQLITE_DROP_TEMP_TRIGGER,
+		C.SQLITE_ALTER_TABLE:
+		// The second argument is the table.
+		privilege, table = "ddl", arg2
+	default:
+		// Such as reindex.
+		if !isAdmin(sb.user) {
+			return errNotAdmin.Error()
+		}
+		return ""
+	}
+	table = strings.ToLower(table)
+	if strings.HasPrefix(table, "sqlite_") {
+		// The schema tables are changed by the DDL statements, which are
+		// checked separately.
+		return ""
+	}
+	if internalTable(table) && privilege != "select" {
+		return fmt.Sprintf("table '%s' can only be changed by its commands",
+			table)
+	}
+	if !tableAllowed(sb.user, privilege, table) {
+		return fmt.Sprintf("permission denied: %s on table '%s'", privilege,
+			table)
+	}
+	return ""
+}
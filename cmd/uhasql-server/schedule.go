@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// #include <stdint.h>
+// extern int64_t uhaha_ts;
+import "C"
+
+// scheduleBatchSize is the max number of jobs that are run on each tick.
+const scheduleBatchSize = 10
+
+func (db *sqlDatabase) ensureScheduleSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __schedule__ (
+			name       TEXT PRIMARY KEY,
+			cron       TEXT,
+			proc       TEXT,
+			args       TEXT,
+			last_run   INTEGER,
+			next_run   INTEGER,
+			last_error TEXT
+		);
+	`, nil)
+}
+
+// machineTime returns the time of the last tick.
+func machineTime() time.Time {
+	return time.Unix(0, int64(C.uhaha_ts)).UTC()
+}
+
+// SCHEDULE SET name cron proc [arg ...]  -- runs a proc on a cron schedule
+// SCHEDULE DEL name                     -- deletes a scheduled job
+// SCHEDULE LIST                         -- returns all scheduled jobs
+func cmdSCHEDULE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, " +
+			"try SCHEDULE HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "set":
+		return cmdSCHEDULESET(m, args)
+	case "del", "delete":
+		return cmdSCHEDULEDEL(m, args)
+	case "list":
+		return cmdSCHEDULELIST(m, args)
+	case "help":
+		return cmdSCHEDULEHELP(m, args)
+	default:
+		return nil, fmt.Errorf("unknown schedule command '%s %s', "+
+			"try SCHEDULE HELP", args[0], args[1],
+		)
+	}
+}
+
+func cmdSCHEDULESET(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, errors.New("wrong number of arguments, " +
+			"try SCHEDULE HELP")
+	}
+	sched, err := parseCron(args[3])
+	if err != nil {
+		return nil, err
+	}
+	next := sched.next(machineTime())
+	if next.IsZero() {
+		return nil, fmt.Errorf("cron expression '%s' never runs", args[3])
+	}
+	data, _ := json.Marshal(args[5:])
+	err = wdb.execArgs(`replace into __schedule__
+		(name, cron, proc, args, last_run, next_run, last_error)
+		values (?, ?, ?, ?, null, ?, null)`,
+		[]interface{}{args[2], args[3], args[4], string(data),
+			next.Unix()}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdSCHEDULEDEL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments, " +
+			"try SCHEDULE HELP")
+	}
+	err := wdb.execArgs(`delete from __schedule__ where name = ?`,
+		[]interface{}{args[2]}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdSCHEDULELIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, " +
+			"try SCHEDULE HELP")
+	}
+	var list [][]interface{}
+	var header bool
+	err := wdb.exec(`select name, cron, proc, args, last_run, next_run,
+		last_error from __schedule__ order by name`, func(row []string) bool {
+		if !header {
+			header = true
+			return true
+		}
+		list = append(list, []interface{}{
+			"name", row[0],
+			"cron", row[1],
+			"proc", row[2],
+			"args", row[3],
+			"last_run", scheduleTime(row[4]),
+			"next_run", scheduleTime(row[5]),
+			"last_error", row[6],
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// scheduleTime formats a unix time from the __schedule__ table, or returns
+// nil when the time is not set.
+func scheduleTime(s string) interface{} {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return time.Unix(secs, 0).UTC().Format(time.RFC3339)
+}
+
+func cmdSCHEDULEHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, " +
+			"try SCHEDULE HELP")
+	}
+	return []string{
+		"SCHEDULE SET name cron proc [arg ...]",
+		"SCHEDULE DEL name",
+		"SCHEDULE LIST",
+	}, nil
+}
+
+// runSchedules runs the jobs that are due at the machine time. Each job runs
+// its proc in a savepoint, which is rolled back when the proc fails. The
+// error is recorded as the last error of the job, and each run is audited.
+// Returns true if any jobs were run.
+func (db *sqlDatabase) runSchedules() (bool, error) {
+	now := machineTime()
+	var jobs [][]string
+	err := db.execArgs(`select name, cron, proc, args from __schedule__
+		where next_run <= ? order by next_run, name limit ?`,
+		[]interface{}{now.Unix(), int64(scheduleBatchSize)},
+		func(row []string) bool {
+			jobs = append(jobs, row)
+			return true
+		})
+	if err != nil || len(jobs) < 2 {
+		return false, err
+	}
+	for _, job := range jobs[1:] {
+		name, cron, proc := job[0], job[1], job[2]
+		var vargs []string
+		json.Unmarshal([]byte(job[3]), &vargs)
+		var lastError interface{}
+		pargs := append([]string{"EXEC", proc}, vargs...)
+		_, err := cmdPROCEXEC(nil, append([]string{"PROC"}, pargs...))
+		if err != nil {
+			lastError = err.Error()
+		}
+		err = db.recordAudit(&auditEntry{command: "PROC",
+			args: auditArgs("PROC", pargs)}, err)
+		if err != nil {
+			return false, err
+		}
+		var next interface{}
+		if sched, err := parseCron(cron); err == nil {
+			if t := sched.next(now); !t.IsZero() {
+				next = t.Unix()
+			}
+		}
+		err = db.execArgs(`update __schedule__
+			set last_run = ?, next_run = ?, last_error = ? where name = ?`,
+			[]interface{}{now.Unix(), next, lastError, name}, nil)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard cron expression with the minute, hour, day of
+// month, month, and day of week fields. Each field is a '*' or a list of
+// values and ranges, with an optional step. Days of the week are 0-7, where
+// both 0 and 7 are Sunday. The @hourly, @daily, @weekly, @monthly, and @yearly
+// macros are also allowed.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s'", expr)
+	}
+	var sched cronSchedule
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	bits := [5]*uint64{&sched.minute, &sched.hour, &sched.dom, &sched.month,
+		&sched.dow}
+	for i, field := range fields {
+		var err error
+		*bits[i], err = parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s'", expr)
+		}
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.domAny = fields[2] == "*"
+	sched.dowAny = fields[4] == "*"
+	return &sched, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.New("invalid step")
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			if i := strings.IndexByte(part, '-'); i != -1 {
+				lo, err = strconv.Atoi(part[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(part)
+				hi = lo
+				if step > 1 {
+					hi = max
+				}
+			}
+			if err != nil || lo < min || hi > max || lo > hi {
+				return 0, errors.New("invalid range")
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that matches the schedule, or a zero
+// time if there is no such time in the next five years.
+func (sched *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if sched.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !sched.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				time.UTC)
+			continue
+		}
+		if sched.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if sched.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay returns true if the day of t matches the schedule. Like most cron
+// implementations, when both the day of month and day of week are
+// restricted, a day that matches either one is a match.
+func (sched *cronSchedule) matchDay(t time.Time) bool {
+	dom := sched.dom&(1<<uint(t.Day())) != 0
+	dow := sched.dow&(1<<uint(t.Weekday())) != 0
+	if sched.domAny || sched.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
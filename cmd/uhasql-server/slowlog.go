@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// slowlogMaxSQL is the number of bytes of sql that are kept for an entry.
+const slowlogMaxSQL = 1024
+
+// slowlogThresholdFlag is the threshold in milliseconds that is provided by
+// the --slowlog-threshold flag. Zero turns off the slow log.
+var slowlogThresholdFlag int
+
+// slowlogMaxLenFlag is the number of entries that are kept in memory, which
+// is provided by the --slowlog-max-len flag.
+var slowlogMaxLenFlag int
+
+// slowEntry is a statement that took longer than the threshold.
+type slowEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	sql      string
+	rows     int
+	mode     string // read or write
+	addr     string // remote address of the client, empty for no client
+}
+
+// slowlog are the newest entries, oldest first. Protected by the slowlogMu
+// lock.
+var slowlogMu sync.Mutex
+var slowlog []slowEntry
+var slowlogID int64
+
+func checkSlowlogFlags() error {
+	if slowlogThresholdFlag < 0 {
+		return errors.New("invalid --slowlog-threshold, must not be negative")
+	}
+	if slowlogMaxLenFlag < 1 {
+		return errors.New("invalid --slowlog-max-len, must be at least 1")
+	}
+	return nil
+}
+
+// slowStart returns the start time of a statement, or zero when the slow
+// log is turned off.
+func slowStart() time.Time {
+	if slowlogThresholdFlag == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// logSlow logs the statement when it took longer than the threshold, and
+// adds it to the slow log.
+func logSlow(start time.Time, sql string, rows int, mode, addr string) {
+	if start.IsZero() {
+		return
+	}
+	dur := time.Since(start)
+	if dur < time.Duration(slowlogThresholdFlag)*time.Millisecond {
+		return
+	}
+	if len(sql) > slowlogMaxSQL {
+		sql = fmt.Sprintf("%s... (%d more bytes)", sql[:slowlogMaxSQL],
+			len(sql)-slowlogMaxSQL)
+	}
+	logger.Warningf("slow statement: duration=%s rows=%d mode=%s addr=%s "+
+		"sql=%s", dur, rows, mode, addr, sql)
+	slowlogMu.Lock()
+	slowlog = append(slowlog, slowEntry{id: slowlogID, time: start,
+		duration: dur, sql: sql, rows: rows, mode: mode, addr: addr})
+	slowlogID++
+	if len(slowlog) > slowlogMaxLenFlag {
+		slowlog = append(slowlog[:0], slowlog[len(slowlog)-
+			slowlogMaxLenFlag:]...)
+	}
+	slowlogMu.Unlock()
+}
+
+// SLOWLOG GET [n]
+// help: returns the newest n entries of the slow log of this server, which
+// is 10 by default. Each entry is the id, the unix time, the duration in
+// microseconds, the sql, the number of rows, the read or write mode, and the
+// address of the client.
+//
+// SLOWLOG LEN
+// help: returns the number of entries in the slow log.
+//
+// SLOWLOG RESET
+// help: removes every entry from the slow log.
+func cmdSLOWLOG(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try SLOWLOG HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdSLOWLOGHELP(m, args)
+	}
+	if err := connAdmin(m); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(args[1]) {
+	case "get":
+		return cmdSLOWLOGGET(m, args)
+	case "len":
+		if len(args) != 2 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try SLOWLOG HELP")
+		}
+		slowlogMu.Lock()
+		defer slowlogMu.Unlock()
+		return len(slowlog), nil
+	case "reset":
+		if len(args) != 2 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try SLOWLOG HELP")
+		}
+		slowlogMu.Lock()
+		slowlog = nil
+		slowlogMu.Unlock()
+		return redcon.SimpleString("OK"), nil
+	default:
+		return nil, fmt.Errorf("unknown slowlog command '%s %s', "+
+			"try SLOWLOG HELP", args[0], args[1])
+	}
+}
+
+func cmdSLOWLOGGET(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) > 3 {
+		return nil, errors.New("wrong number of arguments, try SLOWLOG HELP")
+	}
+	n := 10
+	if len(args) == 3 {
+		var err error
+		n, err = strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid count '%s'", args[2])
+		}
+	}
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+	res := []interface{}{}
+	for i := len(slowlog) - 1; i >= 0 && len(res) < n; i-- {
+		e := slowlog[i]
+		res = append(res, []interface{}{e.id, e.time.Unix(),
+			e.duration.Microseconds(), e.sql, e.rows, e.mode, e.addr})
+	}
+	return res, nil
+}
+
+func cmdSLOWLOGHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try SLOWLOG HELP")
+	}
+	return []string{
+		"SLOWLOG GET [n]",
+		"SLOWLOG LEN",
+		"SLOWLOG RESET",
+	}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// tlsClientCAFlag is the CA certificate file that is provided by the
+// --tls-client-ca flag.
+var tlsClientCAFlag string
+
+// tlsClientCAs verify the client certificates. Nil when client certificates
+// are not required.
+var tlsClientCAs *x509.CertPool
+
+// certNames are the common names of the verified client certificates, by the
+// remote address of the connection. A name is recorded when a client service
+// sniffs the connection, and taken when the connection is opened.
+var certNamesMu sync.Mutex
+var certNames = make(map[string]string)
+
+// pendingCert is the common name of the client certificate of the last TLS
+// handshake, which is moved to certNames by acceptCert. The server does the
+// handshake and sniffs each connection, one at a time, and the Raft transport
+// sniffs first. So a name that is still pending when the next handshake is
+// done is from a connection of the Raft transport, and is never recorded.
+// Protected by the certNamesMu lock.
+var pendingCert struct{ addr, name string }
+
+// checkTLSFlags reads the client CA certificates.
+func checkTLSFlags() error {
+	if tlsClientCAFlag == "" {
+		return nil
+	}
+	if f := flag.Lookup("tls-cert"); f == nil || f.Value.String() == "" {
+		return errors.New(
+			"flag --tls-client-ca cannot be used without --tls-cert flag")
+	}
+	data, err := ioutil.ReadFile(tlsClientCAFlag)
+	if err != nil {
+		return err
+	}
+	tlsClientCAs = x509.NewCertPool()
+	if !tlsClientCAs.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in %s", tlsClientCAFlag)
+	}
+	return nil
+}
+
+// requireClientCerts requires every connection to present a client
+// certificate that is signed by the client CA. The common name of the
+// certificate is recorded for the connection. The servers use the same
+// config to connect to each other, so their certificates must also be signed
+// by the client CA.
+func requireClientCerts(tlscfg *tls.Config) {
+	if tlsClientCAs == nil {
+		return
+	}
+	tlscfg.ClientCAs = tlsClientCAs
+	tlscfg.ClientAuth = tls.RequireAndVerifyClientCert
+	tlscfg.GetConfigForClient = func(hello *tls.ClientHelloInfo,
+	) (*tls.Config, error) {
+		addr := hello.Conn.RemoteAddr().String()
+		cfg := tlscfg.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) > 0 {
+				certNamesMu.Lock()
+				pendingCert.addr = addr
+				pendingCert.name = cs.PeerCertificates[0].Subject.CommonName
+				certNamesMu.Unlock()
+			}
+			return nil
+		}
+		return cfg, nil
+	}
+}
+
+// acceptCert records the pending common name for the connection that is
+// being sniffed, which is not a connection of the Raft transport. It's called
+// by metricsSniff, which is the first sniff of the client services.
+func acceptCert(rd io.Reader) {
+	c, ok := rd.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return
+	}
+	addr := c.RemoteAddr().String()
+	certNamesMu.Lock()
+	if pendingCert.addr == addr {
+		certNames[addr] = pendingCert.name
+	}
+	pendingCert.addr, pendingCert.name = "", ""
+	certNamesMu.Unlock()
+}
+
+// forgetCert forgets the common name of a connection that is closed before
+// it's opened, such as a PostgreSQL connection that fails its startup.
+func forgetCert(addr string) {
+	certNamesMu.Lock()
+	delete(certNames, addr)
+	certNamesMu.Unlock()
+}
+
+// certName returns the common name of the client certificate of the
+// connection, or empty if there is none.
+func certName(addr string) string {
+	certNamesMu.Lock()
+	defer certNamesMu.Unlock()
+	return certNames[addr]
+}
+
+// takeCertUser returns the user and token of the client certificate of the
+// connection, which is the user with the same name as the common name. The
+// name is forgotten. Returns empty when there is no such user.
+func takeCertUser(addr string) (user, token string) {
+	certNamesMu.Lock()
+	name := certNames[addr]
+	delete(certNames, addr)
+	certNamesMu.Unlock()
+	return certUser(name)
+}
+
+// certUser returns the user and token for the common name of a client
+// certificate. Returns empty when there is no such user.
+func certUser(name string) (user, token string) {
+	if name == "" {
+		return "", ""
+	}
+	usersMu.RLock()
+	u := users[name]
+	usersMu.RUnlock()
+	if u == nil {
+		return "", ""
+	}
+	return u.name, userToken(u)
+}
+
+// certLogin is the user and token of the client certificate of an HTTP
+// connection, which is stored in the context of each request.
+type certLogin struct {
+	user  string
+	token string
+}
+
+type certLoginKey struct{}
+
+// httpConnContext takes the user of the client certificate when an HTTP
+// connection is accepted, which is used by each request on the connection.
+func httpConnContext(ctx context.Context, c net.Conn) context.Context {
+	user, token := takeCertUser(c.RemoteAddr().String())
+	return context.WithValue(ctx, certLoginKey{}, certLogin{user, token})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// #include <stdint.h>
+// extern int64_t uhaha_ts;
+import "C"
+
+// ttlBatchSize is the max number of expired rows that are deleted from a
+// table on each tick.
+const ttlBatchSize = 1000
+
+func (db *sqlDatabase) ensureTTLSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __ttl__ (
+			tbl        TEXT PRIMARY KEY,
+			col        TEXT
+		);
+	`, nil)
+}
+
+// quoteIdent returns the name as a quoted SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// TTL SET table column     -- expires rows using a unix time column
+// TTL DEL table            -- stops expiring rows
+// TTL LIST                 -- returns the table and column of each ttl
+func cmdTTL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try TTL HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "set":
+		return cmdTTLSET(m, args)
+	case "del", "delete":
+		return cmdTTLDEL(m, args)
+	case "list":
+		return cmdTTLLIST(m, args)
+	case "help":
+		return cmdTTLHELP(m, args)
+	default:
+		return nil, fmt.Errorf("unknown ttl command '%s %s', try TTL HELP",
+			args[0], args[1],
+		)
+	}
+}
+
+func cmdTTLSET(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, errors.New("wrong number of arguments, try TTL HELP")
+	}
+	table, column := args[2], args[3]
+	if internalTable(table) {
+		return nil, fmt.Errorf("table '%s' cannot expire", table)
+	}
+	var found bool
+	err := wdb.execArgs(`select 1 from pragma_table_info(?) where name = ?`,
+		[]interface{}{table, column}, func(row []string) bool {
+			found = true
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no such column: %s.%s", table, column)
+	}
+	// The sweep deletes rows by rowid.
+	_, _, _, err = wdb.describe(`select rowid from ` + quoteIdent(table))
+	if err != nil {
+		return nil, fmt.Errorf("table '%s' must have a rowid", table)
+	}
+	err = wdb.execArgs(`replace into __ttl__ (tbl, col) values (?, ?)`,
+		[]interface{}{table, column}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdTTLDEL(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments, try TTL HELP")
+	}
+	err := wdb.execArgs(`delete from __ttl__ where tbl = ?`,
+		[]interface{}{args[2]}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdTTLLIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try TTL HELP")
+	}
+	var list [][]string
+	err := wdb.exec("select tbl, col from __ttl__ order by tbl",
+		func(row []string) bool {
+			list = append(list, row)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return list[1:], nil
+}
+
+func cmdTTLHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try TTL HELP")
+	}
+	return []string{
+		"TTL SET table column",
+		"TTL DEL table",
+		"TTL LIST",
+	}, nil
+}
+
+// ttlSweep deletes a batch of expired rows from each table that has a ttl.
+// A row is expired when the unix time, in seconds, in its ttl column is at or
+// before the machine time. Registrations for tables or columns that no longer
+// exist are ignored. The number of rows that are deleted from each table is
+// audited. Returns true if any rows were deleted.
+func (db *sqlDatabase) ttlSweep() (bool, error) {
+	var ttls [][]string
+	err := db.exec(`select t.tbl, t.col from __ttl__ t
+		join pragma_table_info(t.tbl) p on p.name = t.col
+		order by t.tbl`, func(row []string) bool {
+		ttls = append(ttls, row)
+		return true
+	})
+	if err != nil || len(ttls) < 2 {
+		return false, err
+	}
+	now := int64(C.uhaha_ts) / 1e9
+	var changed bool
+	for _, ttl := range ttls[1:] {
+		table, column := quoteIdent(ttl[0]), quoteIdent(ttl[1])
+		err := db.execArgs(`delete from `+table+` where rowid in (
+			select rowid from `+table+` where `+column+` <= ? limit ?)`,
+			[]interface{}{now, int64(ttlBatchSize)}, nil)
+		if err != nil {
+			return false, err
+		}
+		if n := db.changes(); n > 0 {
+			changed = true
+			err := db.recordAudit(&auditEntry{command: "TTL",
+				args: auditArgs("TTL", []string{"EXPIRE", ttl[0],
+					strconv.FormatInt(n, 10)})}, nil)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/uhaha"
+)
+
+// passwordIterations is the number of PBKDF2 iterations for password hashes.
+const passwordIterations = 10000
+
+// commandTokenTTL is how long a command token is valid. The expiry is checked
+// against the machine time when the command is applied, so the result is the
+// same on every server and when the Raft log is replayed.
+const commandTokenTTL = time.Minute
+
+// clusterSecret is the key of the session tokens, which is derived from the
+// cluster auth that every server shares. Unlike the password hashes, it's
+// never in the Raft log, the database, or the snapshots.
+var clusterSecret []byte
+
+// userInfo is a user that was created with USER CREATE.
+type userInfo struct {
+	name   string
+	salt   string
+	hash   string
+	admin  bool
+	grants map[string]bool // "privilege object"
+}
+
+// anonymousUser is used for connections that have not logged in. It has no
+// privileges once any users exist.
+var anonymousUser = &userInfo{}
+
+// users are loaded from the __users__ and __grants__ tables. When there are
+// no users, every connection has every privilege.
+var usersMu sync.RWMutex
+var users = make(map[string]*userInfo)
+
+// cmdUser is the user of the write command that is running, or nil when the
+// write is not from a client, such as from a tick. Protected by the dbmu lock.
+var cmdUser *userInfo
+
+// cmdAddr is the address of the client of the write command that is running,
+// or empty when the write is not from a client. Protected by the dbmu lock.
+var cmdAddr string
+
+var errInvalidLogin = errors.New("invalid username or password")
+var errInvalidUser = errors.New("invalid user, try LOGIN")
+var errTokenExpired = errors.New("user token expired, try again")
+var errNotAdmin = errors.New("permission denied, requires an admin user")
+
+var tablePrivileges = []string{"select", "insert", "update", "delete", "ddl"}
+
+func (db *sqlDatabase) ensureUserSpace() error {
+	return db.exec(`
+		CREATE TABLE IF NOT EXISTS __users__ (
+			name       TEXT PRIMARY KEY,
+			salt       TEXT,
+			hash       TEXT,
+			role       TEXT
+		);
+		CREATE TABLE IF NOT EXISTS __grants__ (
+			name       TEXT,
+			privilege  TEXT,
+			object     TEXT,
+			PRIMARY KEY (name, privilege, object)
+		);
+	`, nil)
+}
+
+// loadUsers loads the users and their grants. The dbmu lock must be held.
+func loadUsers() error {
+	list := make(map[string]*userInfo)
+	var header bool
+	err := wdb.exec(`select name, salt, hash, role from __users__`,
+		func(row []string) bool {
+			if !header {
+				header = true
+				return true
+			}
+			list[row[0]] = &userInfo{name: row[0], salt: row[1],
+				hash: row[2], admin: row[3] == "admin",
+				grants: make(map[string]bool)}
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	header = false
+	err = wdb.exec(`select name, privilege, object from __grants__`,
+		func(row []string) bool {
+			if !header {
+				header = true
+				return true
+			}
+			if u := list[row[0]]; u != nil {
+				u.grants[row[1]+" "+row[2]] = true
+			}
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	usersMu.Lock()
+	users = list
+	usersMu.Unlock()
+	return nil
+}
+
+// passwordHash derives the hash of a password using PBKDF2 with HMAC-SHA256.
+func passwordHash(password, salt string) string {
+	prf := hmac.New(sha256.New, []byte(password))
+	prf.Write([]byte(salt))
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	sum := append([]byte(nil), u...)
+	for i := 1; i < passwordIterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range sum {
+			sum[j] ^= u[j]
+		}
+	}
+	return hex.EncodeToString(sum)
+}
+
+// setClusterSecret derives the cluster secret from the --auth flag.
+func setClusterSecret() {
+	var auth string
+	if f := flag.Lookup("auth"); f != nil {
+		auth = f.Value.String()
+	}
+	clusterSecret = deriveKey([]byte(auth), "uhasql session tokens")
+}
+
+// userToken returns the session token of a user, which is kept by the
+// connection that logged in. It's keyed by the cluster secret, and changes
+// when the password and salt of the user change. It's never sent to the
+// cluster, see commandToken.
+func userToken(u *userInfo) string {
+	mac := hmac.New(sha256.New, clusterSecret)
+	mac.Write([]byte(u.name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(u.salt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// login checks the password of a user and returns the user token.
+func login(name, password string) (token string, err error) {
+	usersMu.RLock()
+	u := users[name]
+	usersMu.RUnlock()
+	if u == nil || !hmac.Equal([]byte(passwordHash(password, u.salt)),
+		[]byte(u.hash)) {
+		return "", errInvalidLogin
+	}
+	return userToken(u), nil
+}
+
+// userExists returns true if there is a user with the name.
+func userExists(name string) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return users[name] != nil
+}
+
+// authenticate returns the user for the name and session token of a
+// connection, or the anonymous user when no name is provided.
+func authenticate(name, token string) (*userInfo, error) {
+	if name == "" {
+		return anonymousUser, nil
+	}
+	usersMu.RLock()
+	u := users[name]
+	usersMu.RUnlock()
+	if u == nil || !hmac.Equal([]byte(userToken(u)), []byte(token)) {
+		return nil, errInvalidUser
+	}
+	return u, nil
+}
+
+// commandToken returns the token that is sent to the cluster with a command
+// in place of the session token, because the args of write commands are
+// stored in the Raft log. The token is "expires.mac", where the mac is keyed
+// by the session token, and it's only valid for commandTokenTTL.
+func commandToken(name, session string, now time.Time) string {
+	if name == "" {
+		return ""
+	}
+	expires := strconv.FormatInt(now.Add(commandTokenTTL).UnixNano(), 10)
+	return expires + "." + commandMAC(session, expires)
+}
+
+func commandMAC(session, expires string) string {
+	mac := hmac.New(sha256.New, []byte(session))
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// commandUser returns the user for the name and command token that were
+// provided to an internal command, or the anonymous user when no name is
+// provided. The token must not be expired at the provided time.
+func commandUser(name, token string, now time.Time) (*userInfo, error) {
+	if name == "" {
+		return anonymousUser, nil
+	}
+	usersMu.RLock()
+	u := users[name]
+	usersMu.RUnlock()
+	i := strings.IndexByte(token, '.')
+	if u == nil || i < 0 {
+		return nil, errInvalidUser
+	}
+	expires, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || !hmac.Equal([]byte(commandMAC(userToken(u), token[:i])),
+		[]byte(token[i+1:])) {
+		return nil, errInvalidUser
+	}
+	if now.UnixNano() > expires {
+		return nil, errTokenExpired
+	}
+	return u, nil
+}
+
+// isAdmin returns true if the user is an admin, or when there are no users.
+// A nil user is the server itself.
+func isAdmin(u *userInfo) bool {
+	if u == nil {
+		return true
+	}
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return len(users) == 0 || u.admin
+}
+
+// allowed returns true if the user has the privilege for the object, which is
+// a table or a proc.
+func allowed(u *userInfo, privilege, object string) bool {
+	if isAdmin(u) {
+		return true
+	}
+	return u.grants[privilege+" "+object] || u.grants[privilege+" *"]
+}
+
+// tableAllowed returns true if the user has the privilege for the table. Only
+// admins can use the internal tables.
+func tableAllowed(u *userInfo, privilege, table string) bool {
+	if internalTable(table) {
+		return isAdmin(u)
+	}
+	return allowed(u, privilege, table)
+}
+
+// requireAdmin returns an error when the user of the running write command is
+// not an admin.
+func requireAdmin() error {
+	if !isAdmin(cmdUser) {
+		return errNotAdmin
+	}
+	return nil
+}
+
+// connUser returns the user that is logged in on the connection.
+func connUser(m uhaha.Machine) (*userInfo, error) {
+	ctx := conn(m)
+	return authenticate(ctx.user, ctx.token)
+}
+
+// connAdmin returns an error when the user of the connection is not an admin.
+func connAdmin(m uhaha.Machine) error {
+	u, err := connUser(m)
+	if err != nil {
+		return err
+	}
+	if !isAdmin(u) {
+		return errNotAdmin
+	}
+	return nil
+}
+
+// userArgs returns the args for an internal write command, which runs as the
+// user of the connection. The user name, command token, and address of the
+// connection follow the command name.
+func userArgs(m uhaha.Machine, name string, args []string) []string {
+	ctx := conn(m)
+	return append([]string{name, ctx.user, ctx.commandToken(), ctx.addr},
+		args[1:]...)
+}
+
+// userForward returns an intermediate command that forwards the command to
+// the internal write command with the user of the connection.
+func userForward(name string,
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		// PASSIVE
+		return uhaha.FilterArgs(userArgs(m, name, args)), nil
+	}
+}
+
+// userCommand wraps an internal write command that was created by userArgs.
+// The user is authenticated at the machine time and is available as cmdUser
+// while the command runs. The command receives the original args, and it's
+// audited.
+func userCommand(
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		if len(args) < 4 {
+			return nil, uhaha.ErrWrongNumArgs
+		}
+		args = append([]string{args[0][1:]}, args[1:]...)
+		cmdAudit = &auditEntry{addr: args[3], user: args[1],
+			command: args[0], args: auditArgs(args[0], args[4:])}
+		u, err := commandUser(args[1], args[2], machineTime())
+		if err != nil {
+			return nil, err
+		}
+		cmdUser, cmdAddr = u, args[3]
+		defer func() { cmdUser, cmdAddr = nil, "" }()
+		return fn(m, append([]string{args[0]}, args[4:]...))
+	}
+}
+
+// adminCommand is a userCommand that requires an admin user.
+func adminCommand(
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	return userCommand(func(m uhaha.Machine, args []string) (interface{},
+		error) {
+		if err := requireAdmin(); err != nil {
+			return nil, err
+		}
+		return fn(m, args)
+	})
+}
+
+// LOGIN name password [command [arg ...]]
+// help: logs in as a user that was created with USER CREATE. The statements
+// and commands that are sent on this connection are authorized for the user.
+// A command that follows the password runs after the login, as part of the
+// same request. This allows for clients that may reconnect to another
+// server, such as the leader, to log in with each command.
+func cmdLOGIN(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+	ctx, ok := m.Context().(*connContext)
+	if !ok {
+		return nil, errors.New("LOGIN is not available for this connection")
+	}
+	token, err := login(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	ctx.user, ctx.token = args[1], token
+	if len(args) > 3 {
+		return uhaha.FilterArgs(args[3:]), nil
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// USER CREATE name password [ADMIN]
+// help: manages the users. The password is hashed by this server before it's
+// sent to the cluster. Once a user exists, a connection must LOGIN and it
+// only has the privileges that are granted to its user, unless it's an admin.
+// The first user must be an admin. USER LIST and USER HELP are answered by
+// this server.
+func cmdUSER(m uhaha.Machine, args []string) (interface{}, error) {
+	// PASSIVE
+	if len(args) >= 2 {
+		switch strings.ToLower(args[1]) {
+		case "list":
+			if err := connAdmin(m); err != nil {
+				return nil, err
+			}
+			return cmdUSERLIST(m, args)
+		case "help":
+			return cmdUSERHELP(m, args)
+		}
+	}
+	if len(args) >= 2 && strings.ToLower(args[1]) == "create" {
+		if len(args) != 4 && len(args) != 5 {
+			return nil, errors.New("wrong number of arguments, " +
+				"try USER HELP")
+		}
+		role := "user"
+		if len(args) == 5 {
+			if strings.ToLower(args[4]) != "admin" {
+				return nil, fmt.Errorf("invalid role '%s'", args[4])
+			}
+			role = "admin"
+		}
+		var salt [16]byte
+		if _, err := rand.Read(salt[:]); err != nil {
+			return nil, err
+		}
+		hsalt := hex.EncodeToString(salt[:])
+		args = []string{args[0], args[1], args[2], hsalt,
+			passwordHash(args[3], hsalt), role}
+	}
+	return uhaha.FilterArgs(userArgs(m, "$USER", args)), nil
+}
+
+// usersWriteCommand wraps the $USER command. The users are reloaded after
+// the command.
+func usersWriteCommand(
+	fn func(m uhaha.Machine, args []string) (interface{}, error),
+) func(m uhaha.Machine, args []string) (interface{}, error) {
+	write := writeCommand(fn)
+	return func(m uhaha.Machine, args []string) (interface{}, error) {
+		res, err := write(m, args)
+		lockDB()
+		defer dbmu.Unlock()
+		if err := loadUsers(); err != nil {
+			logger.Warningf("users: %s", err)
+		}
+		return res, err
+	}
+}
+
+// USER CREATE name salt hash role     -- creates a user
+// USER DROP name                      -- drops a user
+// USER GRANT name privilege object    -- grants a privilege to a user
+// USER REVOKE name privilege object   -- revokes a privilege from a user
+func cmdUSERWRITE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	switch strings.ToLower(args[1]) {
+	case "create":
+		return cmdUSERCREATE(m, args)
+	case "drop":
+		return cmdUSERDROP(m, args)
+	case "grant", "revoke":
+		return cmdUSERGRANT(m, args)
+	default:
+		return nil, fmt.Errorf("unknown user command '%s %s', "+
+			"try USER HELP", args[0], args[1],
+		)
+	}
+}
+
+func cmdUSERCREATE(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 6 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	name, role := args[2], args[5]
+	if name == "" {
+		return nil, errors.New("invalid user name")
+	}
+	usersMu.RLock()
+	exists, first := users[name] != nil, len(users) == 0
+	usersMu.RUnlock()
+	if exists {
+		return nil, fmt.Errorf("user '%s' already exists", name)
+	}
+	if first && role != "admin" {
+		return nil, errors.New("the first user must be an admin")
+	}
+	err := wdb.execArgs(`insert into __users__ (name, salt, hash, role)
+		values (?, ?, ?, ?)`,
+		[]interface{}{name, args[3], args[4], role}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdUSERDROP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	name := args[2]
+	usersMu.RLock()
+	u := users[name]
+	var admins int
+	for _, u := range users {
+		if u.admin {
+			admins++
+		}
+	}
+	others := len(users) - 1
+	usersMu.RUnlock()
+	if u == nil {
+		return nil, fmt.Errorf("user '%s' not found", name)
+	}
+	if u.admin && admins == 1 && others > 0 {
+		return nil, errors.New("the last admin can only be dropped " +
+			"after the other users")
+	}
+	err := wdb.execArgs(`delete from __users__ where name = ?`,
+		[]interface{}{name}, nil)
+	if err == nil {
+		err = wdb.execArgs(`delete from __grants__ where name = ?`,
+			[]interface{}{name}, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// cmdUSERGRANT grants or revokes a privilege. The ALL privilege is every
+// table privilege. Table names are case-insensitive, while proc names are
+// not.
+func cmdUSERGRANT(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 5 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	name, object := args[2], args[4]
+	if !userExists(name) {
+		return nil, fmt.Errorf("user '%s' not found", name)
+	}
+	var privileges []string
+	switch privilege := strings.ToLower(args[3]); privilege {
+	case "all":
+		privileges = tablePrivileges
+	case "select", "insert", "update", "delete", "ddl", "exec":
+		privileges = []string{privilege}
+	default:
+		return nil, fmt.Errorf("invalid privilege '%s'", args[3])
+	}
+	if privileges[0] != "exec" {
+		object = strings.ToLower(object)
+	}
+	sql := `replace into __grants__ (name, privilege, object)
+		values (?, ?, ?)`
+	if strings.ToLower(args[1]) == "revoke" {
+		sql = `delete from __grants__
+			where name = ? and privilege = ? and object = ?`
+	}
+	for _, privilege := range privileges {
+		err := wdb.execArgs(sql, []interface{}{name, privilege, object}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+func cmdUSERLIST(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	var names []string
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := [][]interface{}{}
+	for _, name := range names {
+		u := users[name]
+		role := "user"
+		if u.admin {
+			role = "admin"
+		}
+		grants := []string{}
+		for grant := range u.grants {
+			grants = append(grants, grant)
+		}
+		sort.Strings(grants)
+		list = append(list, []interface{}{
+			"name", u.name,
+			"role", role,
+			"grants", grants,
+		})
+	}
+	return list, nil
+}
+
+func cmdUSERHELP(m uhaha.Machine, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("wrong number of arguments, try USER HELP")
+	}
+	return []string{
+		"USER CREATE name password [ADMIN]",
+		"USER DROP name",
+		"USER GRANT name privilege object",
+		"USER REVOKE name privilege object",
+		"USER LIST",
+	}, nil
+}
@@ -0,0 +1,892 @@
+package main
+
+import "errors"
+
+// The encrypting VFS is a shim over the default VFS. Each encrypted file
+// starts with a header, which has the id of its key, a random nonce, and the
+// block size, followed by the blocks of the file. The block size of a
+// database file is its page size. Each block is sealed using AES-GCM with a
+// new random nonce on every write, and the nonce and the tag are stored after
+// the block, so a block that was changed or moved fails to read. The pages of
+// a WAL file are sealed the same way, along with the number of their frame.
+// A file that doesn't start with a header is not encrypted, and is read and
+// written as is. A new file gets a header on its first write, which is
+// protected by the Sqlite locks.
+
+// #include "../../sqlite/sqlite.h"
+// #include <stdlib.h>
+// #include <string.h>
+//
+// #define UHASQL_HEADER_SIZE 4096
+// #define UHASQL_HEADER_USED 36
+// #define UHASQL_EXTRA 28
+// #define UHASQL_WAL_HEADER 32
+// #define UHASQL_FRAME_HEADER 24
+// #define UHASQL_UNKNOWN 0
+// #define UHASQL_PLAIN 1
+// #define UHASQL_ENCRYPTED 2
+//
+// extern int uhasqlNewHeader(void *hdr);
+// extern int uhasqlReadHeader(void *hdr, int n);
+// extern int uhasqlSeal(int key, void *aad, int naad, void *buf, int n);
+// extern int uhasqlUnseal(int key, void *aad, int naad, void *buf, int n);
+//
+// typedef struct uhasql_file {
+//     sqlite3_file base;
+//     sqlite3_file *real;
+//     int state;
+//     int key;
+//     int wal;   // the file is a WAL file
+//     int bsize; // block size, or the page size of a WAL file, 0 if unknown
+//     unsigned char hdr[UHASQL_HEADER_USED];
+// } uhasql_file;
+//
+// static sqlite3_vfs *uhasql_root;
+// static sqlite3_vfs uhasql_vfs;
+// static sqlite3_io_methods uhasql_io;
+//
+// static int uhasql_page_size(sqlite3_int64 n) {
+//     return n >= 512 && n <= 65536 && (n & (n - 1)) == 0;
+// }
+//
+// // uhasql_wal_bsize returns the page size of a WAL header, which is a 32-bit
+// // big-endian number at offset 8.
+// static int uhasql_wal_bsize(const unsigned char *hdr) {
+//     unsigned int n = ((unsigned int)hdr[8] << 24) |
+//         ((unsigned int)hdr[9] << 16) | ((unsigned int)hdr[10] << 8) |
+//         hdr[11];
+//     return uhasql_page_size(n) ? (int)n : 0;
+// }
+//
+// static void uhasql_put64(unsigned char *b, sqlite3_int64 v) {
+//     int i;
+//     for (i = 7; i >= 0; i--) {
+//         b[i] = (unsigned char)v;
+//         v >>= 8;
+//     }
+// }
+//
+// // uhasql_resolve reads the header of the file, or writes a new header to
+// // an empty file when writing. The block size of a new file that isn't a WAL
+// // file is the size of the first write when it's a page, otherwise 4096.
+// static int uhasql_resolve(uhasql_file *p, int writing, int n,
+//     sqlite3_int64 off)
+// {
+//     sqlite3_int64 size;
+//     unsigned char buf[UHASQL_HEADER_USED];
+//     int rc, bsize;
+//     if (p->state != UHASQL_UNKNOWN) {
+//         return SQLITE_OK;
+//     }
+//     rc = p->real->pMethods->xFileSize(p->real, &size);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     if (size == 0) {
+//         unsigned char *page;
+//         if (!writing) {
+//             return SQLITE_OK;
+//         }
+//         page = sqlite3_malloc(UHASQL_HEADER_SIZE);
+//         if (!page) {
+//             return SQLITE_NOMEM;
+//         }
+//         memset(page, 0, UHASQL_HEADER_SIZE);
+//         p->key = uhasqlNewHeader(page);
+//         bsize = 0;
+//         if (!p->wal) {
+//             bsize = uhasql_page_size(n) && off % n == 0 ? n : 4096;
+//             page[32] = (unsigned char)(bsize >> 24);
+//             page[33] = (unsigned char)(bsize >> 16);
+//             page[34] = (unsigned char)(bsize >> 8);
+//             page[35] = (unsigned char)bsize;
+//         }
+//         memcpy(p->hdr, page, UHASQL_HEADER_USED);
+//         rc = p->real->pMethods->xWrite(p->real, page, UHASQL_HEADER_SIZE,
+//             0);
+//         sqlite3_free(page);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//         p->bsize = bsize;
+//         p->state = UHASQL_ENCRYPTED;
+//         return SQLITE_OK;
+//     }
+//     n = size < UHASQL_HEADER_USED ? (int)size : UHASQL_HEADER_USED;
+//     rc = p->real->pMethods->xRead(p->real, buf, n, 0);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     p->key = uhasqlReadHeader(buf, n);
+//     if (p->key == -2) {
+//         p->state = UHASQL_PLAIN;
+//         return SQLITE_OK;
+//     }
+//     if (p->key == -1) {
+//         return SQLITE_NOTADB;
+//     }
+//     bsize = (buf[32] << 24) | (buf[33] << 16) | (buf[34] << 8) | buf[35];
+//     if (!p->wal && !uhasql_page_size(bsize) && bsize != 4096) {
+//         return SQLITE_NOTADB;
+//     }
+//     memcpy(p->hdr, buf, UHASQL_HEADER_USED);
+//     p->bsize = p->wal ? 0 : bsize;
+//     p->state = UHASQL_ENCRYPTED;
+//     return SQLITE_OK;
+// }
+//
+// // Files, other than WAL files, are a series of blocks. Each block is stored
+// // as the ciphertext followed by the nonce and the tag. Only the last block
+// // may be shorter than the block size.
+//
+// static sqlite3_int64 uhasql_block_off(uhasql_file *p, sqlite3_int64 blk) {
+//     return UHASQL_HEADER_SIZE + blk * (p->bsize + UHASQL_EXTRA);
+// }
+//
+// // uhasql_block_aad is the file nonce and the block number, which prevents
+// // blocks from being moved within a file or to another file.
+// static void uhasql_block_aad(uhasql_file *p, sqlite3_int64 blk,
+//     unsigned char *aad)
+// {
+//     memcpy(aad, p->hdr + 24, 8);
+//     uhasql_put64(aad + 8, blk);
+// }
+//
+// // uhasql_logical_size returns the size of the decrypted file for the size
+// // of the real file. Also returns the number of full blocks and the length of
+// // the last block, which is 0 when all blocks are full.
+// static sqlite3_int64 uhasql_logical_size(uhasql_file *p, sqlite3_int64 size,
+//     sqlite3_int64 *full, int *last)
+// {
+//     sqlite3_int64 rem;
+//     *full = 0;
+//     *last = 0;
+//     if (size <= UHASQL_HEADER_SIZE) {
+//         return 0;
+//     }
+//     size -= UHASQL_HEADER_SIZE;
+//     *full = size / (p->bsize + UHASQL_EXTRA);
+//     rem = size % (p->bsize + UHASQL_EXTRA);
+//     if (rem > UHASQL_EXTRA) {
+//         *last = (int)(rem - UHASQL_EXTRA);
+//     }
+//     return *full * p->bsize + *last;
+// }
+//
+// // uhasql_read_block reads and decrypts a block into buf, which has room for
+// // the block size plus UHASQL_EXTRA bytes. The bytes after the length of the
+// // block are zeros. A block past the end of the file has a length of zero.
+// // Every other block is authenticated, because the file never has holes.
+// static int uhasql_read_block(uhasql_file *p, sqlite3_int64 blk,
+//     unsigned char *buf, int *len)
+// {
+//     sqlite3_int64 off = uhasql_block_off(p, blk), size;
+//     unsigned char aad[16];
+//     int n = p->bsize, rc;
+//     *len = 0;
+//     rc = p->real->pMethods->xRead(p->real, buf, n + UHASQL_EXTRA, off);
+//     if (rc == SQLITE_IOERR_SHORT_READ) {
+//         rc = p->real->pMethods->xFileSize(p->real, &size);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//         if (size <= off) {
+//             memset(buf, 0, p->bsize);
+//             return SQLITE_OK;
+//         }
+//         if (size - off <= UHASQL_EXTRA) {
+//             return SQLITE_IOERR_DATA;
+//         }
+//         n = (int)(size - off) - UHASQL_EXTRA;
+//     } else if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     uhasql_block_aad(p, blk, aad);
+//     if (uhasqlUnseal(p->key, aad, sizeof(aad), buf, n) != 0) {
+//         return SQLITE_IOERR_DATA;
+//     }
+//     memset(buf + n, 0, p->bsize + UHASQL_EXTRA - n);
+//     *len = n;
+//     return SQLITE_OK;
+// }
+//
+// // uhasql_write_block encrypts the first n bytes of buf, which has room for
+// // UHASQL_EXTRA more bytes, using a new nonce, and writes the block.
+// static int uhasql_write_block(uhasql_file *p, sqlite3_int64 blk,
+//     unsigned char *buf, int n)
+// {
+//     unsigned char aad[16];
+//     uhasql_block_aad(p, blk, aad);
+//     if (uhasqlSeal(p->key, aad, sizeof(aad), buf, n) != 0) {
+//         return SQLITE_IOERR_WRITE;
+//     }
+//     return p->real->pMethods->xWrite(p->real, buf, n + UHASQL_EXTRA,
+//         uhasql_block_off(p, blk));
+// }
+//
+// // uhasql_fill_last makes every block before blk full when blk is past the
+// // last block, so that every block but the last one is full. A short last
+// // block is filled with zeros, and the blocks between it and blk are written
+// // as sealed zeros, which leaves no holes in the real file.
+// static int uhasql_fill_last(uhasql_file *p, sqlite3_int64 blk,
+//     unsigned char *buf)
+// {
+//     sqlite3_int64 size, full;
+//     int last, len, rc;
+//     rc = p->real->pMethods->xFileSize(p->real, &size);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     uhasql_logical_size(p, size, &full, &last);
+//     if (last > 0 && blk > full) {
+//         rc = uhasql_read_block(p, full, buf, &len);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//         rc = uhasql_write_block(p, full, buf, p->bsize);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//         full++;
+//     }
+//     for (; full < blk; full++) {
+//         memset(buf, 0, p->bsize);
+//         rc = uhasql_write_block(p, full, buf, p->bsize);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//     }
+//     return SQLITE_OK;
+// }
+//
+// static int uhasql_block_read(uhasql_file *p, unsigned char *buf, int n,
+//     sqlite3_int64 off)
+// {
+//     unsigned char *data;
+//     int rc = SQLITE_OK, short_read = 0;
+//     data = sqlite3_malloc(p->bsize + UHASQL_EXTRA);
+//     if (!data) {
+//         return SQLITE_NOMEM;
+//     }
+//     while (n > 0) {
+//         sqlite3_int64 blk = off / p->bsize;
+//         int boff = (int)(off % p->bsize), len;
+//         int m = p->bsize - boff < n ? p->bsize - boff : n;
+//         rc = uhasql_read_block(p, blk, data, &len);
+//         if (rc != SQLITE_OK) {
+//             break;
+//         }
+//         memcpy(buf, data + boff, m);
+//         if (boff + m > len) {
+//             short_read = 1;
+//         }
+//         buf += m;
+//         off += m;
+//         n -= m;
+//     }
+//     sqlite3_free(data);
+//     if (rc == SQLITE_OK && short_read) {
+//         rc = SQLITE_IOERR_SHORT_READ;
+//     }
+//     return rc;
+// }
+//
+// static int uhasql_block_write(uhasql_file *p, const unsigned char *buf,
+//     int n, sqlite3_int64 off)
+// {
+//     unsigned char *data;
+//     int rc;
+//     data = sqlite3_malloc(p->bsize + UHASQL_EXTRA);
+//     if (!data) {
+//         return SQLITE_NOMEM;
+//     }
+//     rc = uhasql_fill_last(p, off / p->bsize, data);
+//     while (rc == SQLITE_OK && n > 0) {
+//         sqlite3_int64 blk = off / p->bsize;
+//         int boff = (int)(off % p->bsize), len = p->bsize;
+//         int m = p->bsize - boff < n ? p->bsize - boff : n;
+//         if (m < p->bsize) {
+//             rc = uhasql_read_block(p, blk, data, &len);
+//             if (rc != SQLITE_OK) {
+//                 break;
+//             }
+//             if (boff + m > len) {
+//                 len = boff + m;
+//             }
+//         }
+//         memcpy(data + boff, buf, m);
+//         rc = uhasql_write_block(p, blk, data, len);
+//         buf += m;
+//         off += m;
+//         n -= m;
+//     }
+//     sqlite3_free(data);
+//     return rc;
+// }
+//
+// // uhasql_block_real_size returns the size of the real file for the size of
+// // the decrypted file.
+// static sqlite3_int64 uhasql_block_real_size(uhasql_file *p,
+//     sqlite3_int64 size)
+// {
+//     sqlite3_int64 rem = size % p->bsize;
+//     return uhasql_block_off(p, size / p->bsize) +
+//         (rem > 0 ? rem + UHASQL_EXTRA : 0);
+// }
+//
+// static int uhasql_block_truncate(uhasql_file *p, sqlite3_int64 size) {
+//     sqlite3_int64 blk = size / p->bsize;
+//     int rem = (int)(size % p->bsize), len, rc;
+//     unsigned char *data;
+//     data = sqlite3_malloc(p->bsize + UHASQL_EXTRA);
+//     if (!data) {
+//         return SQLITE_NOMEM;
+//     }
+//     rc = uhasql_fill_last(p, blk, data);
+//     if (rc == SQLITE_OK && rem > 0) {
+//         // The new last block is shorter, so it's encrypted again.
+//         rc = uhasql_read_block(p, blk, data, &len);
+//         if (rc == SQLITE_OK) {
+//             rc = uhasql_write_block(p, blk, data, rem);
+//         }
+//     }
+//     sqlite3_free(data);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     return p->real->pMethods->xTruncate(p->real,
+//         uhasql_block_real_size(p, size));
+// }
+//
+// // A WAL file keeps its layout, which is the WAL header followed by the
+// // frames. The page of each frame is followed by the nonce and the tag, while
+// // the WAL header and the frame headers are not encrypted. The page size is
+// // read from the WAL header.
+//
+// static int uhasql_wal_page_size(uhasql_file *p) {
+//     unsigned char buf[UHASQL_WAL_HEADER];
+//     int rc;
+//     if (p->bsize != 0) {
+//         return SQLITE_OK;
+//     }
+//     rc = p->real->pMethods->xRead(p->real, buf, sizeof(buf),
+//         UHASQL_HEADER_SIZE);
+//     if (rc == SQLITE_IOERR_SHORT_READ) {
+//         return SQLITE_OK;
+//     }
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     p->bsize = uhasql_wal_bsize(buf);
+//     return SQLITE_OK;
+// }
+//
+// static sqlite3_int64 uhasql_frame_off(uhasql_file *p, sqlite3_int64 frame) {
+//     return UHASQL_HEADER_SIZE + UHASQL_WAL_HEADER +
+//         frame * (UHASQL_FRAME_HEADER + p->bsize + UHASQL_EXTRA);
+// }
+//
+// // uhasql_wal_real_size returns the size of the real WAL file for the size
+// // of the decrypted file.
+// static sqlite3_int64 uhasql_wal_real_size(uhasql_file *p,
+//     sqlite3_int64 size)
+// {
+//     sqlite3_int64 frame, rem;
+//     if (p->bsize == 0 || size <= UHASQL_WAL_HEADER) {
+//         return UHASQL_HEADER_SIZE + size;
+//     }
+//     frame = (size - UHASQL_WAL_HEADER) / (UHASQL_FRAME_HEADER + p->bsize);
+//     rem = (size - UHASQL_WAL_HEADER) % (UHASQL_FRAME_HEADER + p->bsize);
+//     if (rem > UHASQL_FRAME_HEADER) {
+//         rem += UHASQL_EXTRA;
+//     }
+//     return uhasql_frame_off(p, frame) + rem;
+// }
+//
+// // uhasql_wal_size returns the size of the decrypted WAL file for the size
+// // of the real file.
+// static sqlite3_int64 uhasql_wal_size(uhasql_file *p, sqlite3_int64 size) {
+//     sqlite3_int64 frame, rem;
+//     size -= UHASQL_HEADER_SIZE;
+//     if (p->bsize == 0 || size <= UHASQL_WAL_HEADER) {
+//         return size < 0 ? 0 : size;
+//     }
+//     frame = (size - UHASQL_WAL_HEADER) /
+//         (UHASQL_FRAME_HEADER + p->bsize + UHASQL_EXTRA);
+//     rem = (size - UHASQL_WAL_HEADER) %
+//         (UHASQL_FRAME_HEADER + p->bsize + UHASQL_EXTRA);
+//     if (rem > UHASQL_FRAME_HEADER) {
+//         rem -= UHASQL_EXTRA;
+//         if (rem < UHASQL_FRAME_HEADER) {
+//             rem = UHASQL_FRAME_HEADER;
+//         }
+//     }
+//     return UHASQL_WAL_HEADER +
+//         frame * (UHASQL_FRAME_HEADER + p->bsize) + rem;
+// }
+//
+// // uhasql_frame_aad is the file nonce and the frame number. The frame header
+// // isn't included, because Sqlite rewrites it apart from the page.
+// static void uhasql_frame_aad(uhasql_file *p, sqlite3_int64 frame,
+//     unsigned char *aad)
+// {
+//     memcpy(aad, p->hdr + 24, 8);
+//     uhasql_put64(aad + 8, frame);
+// }
+//
+// // uhasql_read_page reads and decrypts the page of a frame into buf, which
+// // has room for the frame header, the page, and UHASQL_EXTRA bytes. The page
+// // starts after the frame header. A missing page is zeros.
+// static int uhasql_read_page(uhasql_file *p, sqlite3_int64 frame,
+//     unsigned char *buf, int *missing)
+// {
+//     int n = UHASQL_FRAME_HEADER + p->bsize + UHASQL_EXTRA, rc;
+//     unsigned char aad[16];
+//     *missing = 0;
+//     rc = p->real->pMethods->xRead(p->real, buf, n,
+//         uhasql_frame_off(p, frame));
+//     if (rc == SQLITE_IOERR_SHORT_READ) {
+//         memset(buf + UHASQL_FRAME_HEADER, 0, p->bsize);
+//         *missing = 1;
+//         return SQLITE_OK;
+//     }
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     uhasql_frame_aad(p, frame, aad);
+//     if (uhasqlUnseal(p->key, aad, sizeof(aad), buf + UHASQL_FRAME_HEADER,
+//         p->bsize) != 0)
+//     {
+//         return SQLITE_IOERR_DATA;
+//     }
+//     return SQLITE_OK;
+// }
+//
+// static int uhasql_wal_read(uhasql_file *p, unsigned char *buf, int n,
+//     sqlite3_int64 off)
+// {
+//     unsigned char *data = 0;
+//     int rc = SQLITE_OK, short_read = 0, whole, missing;
+//     sqlite3_int64 fsize;
+//     rc = uhasql_wal_page_size(p);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     fsize = UHASQL_FRAME_HEADER + p->bsize;
+//     // Sqlite reads whole frames when it recovers the WAL. A page that can't
+//     // be decrypted, such as a partly written frame, is returned as zeros,
+//     // which fails the checksum of the frame and ends the recovery.
+//     whole = p->bsize != 0 && n == fsize && off >= UHASQL_WAL_HEADER &&
+//         (off - UHASQL_WAL_HEADER) % fsize == 0;
+//     while (rc == SQLITE_OK && n > 0) {
+//         sqlite3_int64 frame = 0, rem = 0;
+//         int m;
+//         if (off < UHASQL_WAL_HEADER || p->bsize == 0) {
+//             m = n;
+//             if (p->bsize != 0 && UHASQL_WAL_HEADER - off < n) {
+//                 m = (int)(UHASQL_WAL_HEADER - off);
+//             }
+//         } else {
+//             frame = (off - UHASQL_WAL_HEADER) / fsize;
+//             rem = (off - UHASQL_WAL_HEADER) % fsize;
+//             m = (int)(rem < UHASQL_FRAME_HEADER ?
+//                 UHASQL_FRAME_HEADER - rem : fsize - rem);
+//             m = m < n ? m : n;
+//         }
+//         if (off < UHASQL_WAL_HEADER || p->bsize == 0 ||
+//             rem < UHASQL_FRAME_HEADER)
+//         {
+//             rc = p->real->pMethods->xRead(p->real, buf, m,
+//                 off < UHASQL_WAL_HEADER || p->bsize == 0 ?
+//                 UHASQL_HEADER_SIZE + off : uhasql_frame_off(p, frame) + rem);
+//             if (rc == SQLITE_IOERR_SHORT_READ) {
+//                 short_read = 1;
+//                 rc = SQLITE_OK;
+//             }
+//         } else {
+//             if (!data) {
+//                 data = sqlite3_malloc(fsize + UHASQL_EXTRA);
+//                 if (!data) {
+//                     return SQLITE_NOMEM;
+//                 }
+//             }
+//             rc = uhasql_read_page(p, frame, data, &missing);
+//             if (rc == SQLITE_IOERR_DATA && whole) {
+//                 memset(data + UHASQL_FRAME_HEADER, 0, p->bsize);
+//                 rc = SQLITE_OK;
+//             }
+//             if (missing) {
+//                 short_read = 1;
+//             }
+//             memcpy(buf, data + rem, m);
+//         }
+//         buf += m;
+//         off += m;
+//         n -= m;
+//     }
+//     sqlite3_free(data);
+//     if (rc == SQLITE_OK && short_read) {
+//         rc = SQLITE_IOERR_SHORT_READ;
+//     }
+//     return rc;
+// }
+//
+// static int uhasql_wal_write(uhasql_file *p, const unsigned char *buf, int n,
+//     sqlite3_int64 off)
+// {
+//     unsigned char *data = 0, aad[16];
+//     int rc = SQLITE_OK, missing;
+//     sqlite3_int64 fsize;
+//     if (off == 0 && n >= UHASQL_WAL_HEADER) {
+//         p->bsize = uhasql_wal_bsize(buf);
+//     }
+//     rc = uhasql_wal_page_size(p);
+//     fsize = UHASQL_FRAME_HEADER + p->bsize;
+//     while (rc == SQLITE_OK && n > 0) {
+//         sqlite3_int64 frame = 0, rem = 0;
+//         int m;
+//         if (off < UHASQL_WAL_HEADER || p->bsize == 0) {
+//             m = n;
+//             if (p->bsize != 0 && UHASQL_WAL_HEADER - off < n) {
+//                 m = (int)(UHASQL_WAL_HEADER - off);
+//             }
+//         } else {
+//             frame = (off - UHASQL_WAL_HEADER) / fsize;
+//             rem = (off - UHASQL_WAL_HEADER) % fsize;
+//             m = (int)(rem < UHASQL_FRAME_HEADER ?
+//                 UHASQL_FRAME_HEADER - rem : fsize - rem);
+//             m = m < n ? m : n;
+//         }
+//         if (p->bsize == 0 && off + m > UHASQL_WAL_HEADER) {
+//             // A frame can't be written before the WAL header.
+//             rc = SQLITE_IOERR_WRITE;
+//         } else if (off < UHASQL_WAL_HEADER || p->bsize == 0 ||
+//             rem < UHASQL_FRAME_HEADER)
+//         {
+//             rc = p->real->pMethods->xWrite(p->real, buf, m,
+//                 off < UHASQL_WAL_HEADER || p->bsize == 0 ?
+//                 UHASQL_HEADER_SIZE + off : uhasql_frame_off(p, frame) + rem);
+//         } else {
+//             if (!data) {
+//                 data = sqlite3_malloc(fsize + UHASQL_EXTRA);
+//                 if (!data) {
+//                     return SQLITE_NOMEM;
+//                 }
+//             }
+//             if (m < p->bsize) {
+//                 // A part of a page, which Sqlite doesn't write.
+//                 rc = uhasql_read_page(p, frame, data, &missing);
+//                 if (rc == SQLITE_IOERR_DATA) {
+//                     memset(data + UHASQL_FRAME_HEADER, 0, p->bsize);
+//                     rc = SQLITE_OK;
+//                 }
+//             }
+//             if (rc != SQLITE_OK) {
+//                 break;
+//             }
+//             memcpy(data + rem, buf, m);
+//             uhasql_frame_aad(p, frame, aad);
+//             if (uhasqlSeal(p->key, aad, sizeof(aad),
+//                 data + UHASQL_FRAME_HEADER, p->bsize) != 0)
+//             {
+//                 rc = SQLITE_IOERR_WRITE;
+//                 break;
+//             }
+//             rc = p->real->pMethods->xWrite(p->real,
+//                 data + UHASQL_FRAME_HEADER, p->bsize + UHASQL_EXTRA,
+//                 uhasql_frame_off(p, frame) + UHASQL_FRAME_HEADER);
+//         }
+//         buf += m;
+//         off += m;
+//         n -= m;
+//     }
+//     sqlite3_free(data);
+//     return rc;
+// }
+//
+// static int uhasql_close(sqlite3_file *file) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xClose(p->real);
+// }
+//
+// static int uhasql_read(sqlite3_file *file, void *buf, int n,
+//     sqlite3_int64 off)
+// {
+//     uhasql_file *p = (uhasql_file*)file;
+//     int rc = uhasql_resolve(p, 0, n, off);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     if (p->state != UHASQL_ENCRYPTED) {
+//         return p->real->pMethods->xRead(p->real, buf, n, off);
+//     }
+//     if (p->wal) {
+//         return uhasql_wal_read(p, buf, n, off);
+//     }
+//     return uhasql_block_read(p, buf, n, off);
+// }
+//
+// static int uhasql_write(sqlite3_file *file, const void *buf, int n,
+//     sqlite3_int64 off)
+// {
+//     uhasql_file *p = (uhasql_file*)file;
+//     int rc = uhasql_resolve(p, 1, n, off);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     if (p->state != UHASQL_ENCRYPTED) {
+//         return p->real->pMethods->xWrite(p->real, buf, n, off);
+//     }
+//     if (p->wal) {
+//         return uhasql_wal_write(p, buf, n, off);
+//     }
+//     return uhasql_block_write(p, buf, n, off);
+// }
+//
+// static int uhasql_truncate(sqlite3_file *file, sqlite3_int64 size) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     int rc = uhasql_resolve(p, 0, 0, 0);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     if (p->state != UHASQL_ENCRYPTED) {
+//         return p->real->pMethods->xTruncate(p->real, size);
+//     }
+//     if (p->wal) {
+//         rc = uhasql_wal_page_size(p);
+//         if (rc != SQLITE_OK) {
+//             return rc;
+//         }
+//         return p->real->pMethods->xTruncate(p->real,
+//             uhasql_wal_real_size(p, size));
+//     }
+//     return uhasql_block_truncate(p, size);
+// }
+//
+// static int uhasql_sync(sqlite3_file *file, int flags) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xSync(p->real, flags);
+// }
+//
+// static int uhasql_file_size(sqlite3_file *file, sqlite3_int64 *size) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     sqlite3_int64 full;
+//     int last;
+//     int rc = uhasql_resolve(p, 0, 0, 0);
+//     if (rc != SQLITE_OK) {
+//         return rc;
+//     }
+//     rc = p->real->pMethods->xFileSize(p->real, size);
+//     if (rc != SQLITE_OK || p->state != UHASQL_ENCRYPTED) {
+//         return rc;
+//     }
+//     if (p->wal) {
+//         rc = uhasql_wal_page_size(p);
+//         *size = uhasql_wal_size(p, *size);
+//         return rc;
+//     }
+//     *size = uhasql_logical_size(p, *size, &full, &last);
+//     return SQLITE_OK;
+// }
+//
+// static int uhasql_lock(sqlite3_file *file, int lock) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xLock(p->real, lock);
+// }
+//
+// static int uhasql_unlock(sqlite3_file *file, int lock) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xUnlock(p->real, lock);
+// }
+//
+// static int uhasql_check_reserved_lock(sqlite3_file *file, int *out) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xCheckReservedLock(p->real, out);
+// }
+//
+// static int uhasql_file_control(sqlite3_file *file, int op, void *arg) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     if (op == SQLITE_FCNTL_SIZE_HINT && p->state == UHASQL_ENCRYPTED) {
+//         sqlite3_int64 size = *(sqlite3_int64*)arg;
+//         if (p->wal) {
+//             size = uhasql_wal_real_size(p, size);
+//         } else {
+//             size = uhasql_block_real_size(p, size);
+//         }
+//         return p->real->pMethods->xFileControl(p->real, op, &size);
+//     }
+//     return p->real->pMethods->xFileControl(p->real, op, arg);
+// }
+//
+// static int uhasql_sector_size(sqlite3_file *file) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xSectorSize(p->real);
+// }
+//
+// // uhasql_device_characteristics doesn't report atomic writes, because the
+// // blocks are larger than the writes of Sqlite.
+// static int uhasql_device_characteristics(sqlite3_file *file) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     return p->real->pMethods->xDeviceCharacteristics(p->real) &
+//         ~(SQLITE_IOCAP_ATOMIC | SQLITE_IOCAP_ATOMIC512 |
+//         SQLITE_IOCAP_ATOMIC1K | SQLITE_IOCAP_ATOMIC2K |
+//         SQLITE_IOCAP_ATOMIC4K | SQLITE_IOCAP_ATOMIC8K |
+//         SQLITE_IOCAP_ATOMIC16K | SQLITE_IOCAP_ATOMIC32K |
+//         SQLITE_IOCAP_ATOMIC64K | SQLITE_IOCAP_BATCH_ATOMIC);
+// }
+//
+// static int uhasql_shm_map(sqlite3_file *file, int pg, int pgsz, int extend,
+//     void volatile **pp)
+// {
+//     uhasql_file *p = (uhasql_file*)file;
+//     if (p->real->pMethods->iVersion < 2) {
+//         return SQLITE_IOERR_SHMMAP;
+//     }
+//     return p->real->pMethods->xShmMap(p->real, pg, pgsz, extend, pp);
+// }
+//
+// static int uhasql_shm_lock(sqlite3_file *file, int off, int n, int flags) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     if (p->real->pMethods->iVersion < 2) {
+//         return SQLITE_IOERR_SHMLOCK;
+//     }
+//     return p->real->pMethods->xShmLock(p->real, off, n, flags);
+// }
+//
+// static void uhasql_shm_barrier(sqlite3_file *file) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     if (p->real->pMethods->iVersion >= 2) {
+//         p->real->pMethods->xShmBarrier(p->real);
+//     }
+// }
+//
+// static int uhasql_shm_unmap(sqlite3_file *file, int del) {
+//     uhasql_file *p = (uhasql_file*)file;
+//     if (p->real->pMethods->iVersion < 2) {
+//         return SQLITE_OK;
+//     }
+//     return p->real->pMethods->xShmUnmap(p->real, del);
+// }
+//
+// static int uhasql_open(sqlite3_vfs *vfs, const char *name,
+//     sqlite3_file *file, int flags, int *out)
+// {
+//     uhasql_file *p = (uhasql_file*)file;
+//     int rc;
+//     memset(p, 0, sizeof(uhasql_file));
+//     p->real = (sqlite3_file*)&p[1];
+//     p->wal = (flags & SQLITE_OPEN_WAL) != 0;
+//     rc = uhasql_root->xOpen(uhasql_root, name, p->real, flags, out);
+//     if (p->real->pMethods) {
+//         p->base.pMethods = &uhasql_io;
+//     }
+//     return rc;
+// }
+//
+// static int uhasql_delete(sqlite3_vfs *vfs, const char *name, int sync) {
+//     return uhasql_root->xDelete(uhasql_root, name, sync);
+// }
+//
+// static int uhasql_access(sqlite3_vfs *vfs, const char *name, int flags,
+//     int *out)
+// {
+//     return uhasql_root->xAccess(uhasql_root, name, flags, out);
+// }
+//
+// static int uhasql_full_pathname(sqlite3_vfs *vfs, const char *name, int n,
+//     char *out)
+// {
+//     return uhasql_root->xFullPathname(uhasql_root, name, n, out);
+// }
+//
+// static void *uhasql_dl_open(sqlite3_vfs *vfs, const char *path) {
+//     return uhasql_root->xDlOpen(uhasql_root, path);
+// }
+//
+// static void uhasql_dl_error(sqlite3_vfs *vfs, int n, char *msg) {
+//     uhasql_root->xDlError(uhasql_root, n, msg);
+// }
+//
+// typedef void (*uhasql_sym)(void);
+//
+// static uhasql_sym uhasql_dl_sym(sqlite3_vfs *vfs, void *h, const char *sym) {
+//     return uhasql_root->xDlSym(uhasql_root, h, sym);
+// }
+//
+// static void uhasql_dl_close(sqlite3_vfs *vfs, void *h) {
+//     uhasql_root->xDlClose(uhasql_root, h);
+// }
+//
+// static int uhasql_randomness(sqlite3_vfs *vfs, int n, char *out) {
+//     return uhasql_root->xRandomness(uhasql_root, n, out);
+// }
+//
+// static int uhasql_sleep(sqlite3_vfs *vfs, int micros) {
+//     return uhasql_root->xSleep(uhasql_root, micros);
+// }
+//
+// static int uhasql_current_time(sqlite3_vfs *vfs, double *out) {
+//     return uhasql_root->xCurrentTime(uhasql_root, out);
+// }
+//
+// static int uhasql_get_last_error(sqlite3_vfs *vfs, int n, char *out) {
+//     return uhasql_root->xGetLastError(uhasql_root, n, out);
+// }
+//
+// static int uhasql_current_time_int64(sqlite3_vfs *vfs, sqlite3_int64 *out) {
+//     return uhasql_root->xCurrentTimeInt64(uhasql_root, out);
+// }
+//
+// static int uhasql_register_vfs(void) {
+//     uhasql_root = sqlite3_vfs_find(0);
+//     if (!uhasql_root || uhasql_root->iVersion < 2) {
+//         return SQLITE_ERROR;
+//     }
+//     // Version 2 of the io methods doesn't have xFetch, so the pages are
+//     // never memory-mapped and are always decrypted by xRead.
+//     uhasql_io.iVersion = 2;
+//     uhasql_io.xClose = uhasql_close;
+//     uhasql_io.xRead = uhasql_read;
+//     uhasql_io.xWrite = uhasql_write;
+//     uhasql_io.xTruncate = uhasql_truncate;
+//     uhasql_io.xSync = uhasql_sync;
+//     uhasql_io.xFileSize = uhasql_file_size;
+//     uhasql_io.xLock = uhasql_lock;
+//     uhasql_io.xUnlock = uhasql_unlock;
+//     uhasql_io.xCheckReservedLock = uhasql_check_reserved_lock;
+//     uhasql_io.xFileControl = uhasql_file_control;
+//     uhasql_io.xSectorSize = uhasql_sector_size;
+//     uhasql_io.xDeviceCharacteristics = uhasql_device_characteristics;
+//     uhasql_io.xShmMap = uhasql_shm_map;
+//     uhasql_io.xShmLock = uhasql_shm_lock;
+//     uhasql_io.xShmBarrier = uhasql_shm_barrier;
+//     uhasql_io.xShmUnmap = uhasql_shm_unmap;
+//     uhasql_vfs.iVersion = 2;
+//     uhasql_vfs.szOsFile = sizeof(uhasql_file) + uhasql_root->szOsFile;
+//     uhasql_vfs.mxPathname = uhasql_root->mxPathname;
+//     uhasql_vfs.zName = "uhasql";
+//     uhasql_vfs.xOpen = uhasql_open;
+//     uhasql_vfs.xDelete = uhasql_delete;
+//     uhasql_vfs.xAccess = uhasql_access;
+//     uhasql_vfs.xFullPathname = uhasql_full_pathname;
+//     uhasql_vfs.xDlOpen = uhasql_dl_open;
+//     uhasql_vfs.xDlError = uhasql_dl_error;
+//     uhasql_vfs.xDlSym = uhasql_dl_sym;
+//     uhasql_vfs.xDlClose = uhasql_dl_close;
+//     uhasql_vfs.xRandomness = uhasql_randomness;
+//     uhasql_vfs.xSleep = uhasql_sleep;
+//     uhasql_vfs.xCurrentTime = uhasql_current_time;
+//     uhasql_vfs.xGetLastError = uhasql_get_last_error;
+//     uhasql_vfs.xCurrentTimeInt64 = uhasql_current_time_int64;
+//     return sqlite3_vfs_register(&uhasql_vfs, 1);
+// }
+import "C"
+
+// registerVFS makes the encrypting VFS the default VFS. It must be called
+// before any database is opened.
+func registerVFS() error {
+	if C.uhasql_register_vfs() != C.SQLITE_OK {
+		return errors.New("encryption: failed to register the vfs")
+	}
+	return nil
+}
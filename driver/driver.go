@@ -0,0 +1,678 @@
+// Package driver is a database/sql driver for UhaSQL.
+//
+// The driver is registered with the name "uhasql". The data source name is a
+// comma-delimited list of server addresses, with optional parameters.
+//
+//	db, err := sql.Open("uhasql", "10.0.0.1:11001,10.0.0.2:11001?auth=pass")
+//
+// The parameters are:
+//
+//	auth         the auth password
+//	user         log in as the user
+//	password     the password of the user
+//	tls          use TLS, "true" or "false"
+//	tlsinsecure  use TLS without verifying the server certificate
+//	cacert       path to the CA certificate for verifying the server
+//	servername   server name for verifying the server certificate
+//
+// With a user, each request logs in as the user, which allows for the
+// connection to move to a new leader without losing the user.
+//
+// Each Query and Exec is a single request to the cluster. Multiple statements
+// in a request, which are separated by semicolons, run as a transaction. A
+// transaction from Begin buffers all of the Exec statements and sends them as
+// one request on Commit. The results of those statements are available after
+// the commit. Queries are not allowed in a transaction.
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/uhatools"
+)
+
+func init() {
+	sql.Register("uhasql", &Driver{})
+}
+
+// timeFormat is the format for time.Time args.
+const timeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+var errTxPending = errors.New("uhasql: result is not available until the " +
+	"transaction is committed")
+var errQueryInTx = errors.New("uhasql: queries are not allowed in a " +
+	"transaction")
+var errTxDone = errors.New("uhasql: transaction has already been committed " +
+	"or rolled back")
+var errNoStatements = errors.New("uhasql: no statements")
+
+// Driver is the UhaSQL database/sql driver.
+type Driver struct{}
+
+// Open returns a new connection to the cluster. Prefer using the sql package
+// which uses OpenConnector for sharing a connection pool.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	opts, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c, err := uhatools.Dial(strings.Join(opts.InitialServers, ","),
+		&opts.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c: c, user: opts.User, password: opts.Password}, nil
+}
+
+// OpenConnector returns a connector for the data source name.
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	opts, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnector(opts), nil
+}
+
+// Options are the options for NewConnector.
+type Options struct {
+	uhatools.ClusterOptions
+	User     string // log in as the user, optional
+	Password string // password of the user
+}
+
+// NewConnector returns a connector for use with sql.OpenDB.
+func NewConnector(opts Options) driver.Connector {
+	return &connector{cl: uhatools.OpenCluster(opts.ClusterOptions),
+		user: opts.User, password: opts.Password}
+}
+
+type connector struct {
+	cl       *uhatools.Cluster
+	user     string
+	password string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{c: c.cl.Get(), user: c.user, password: c.password}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+// Close closes the cluster connection pool. It's called by sql.DB.Close.
+func (c *connector) Close() error {
+	return c.cl.Close()
+}
+
+// parseDSN parses a data source name into connector options.
+func parseDSN(dsn string) (opts Options, err error) {
+	dsn = strings.TrimPrefix(dsn, "uhasql://")
+	var query string
+	if i := strings.IndexByte(dsn, '?'); i != -1 {
+		dsn, query = dsn[:i], dsn[i+1:]
+	}
+	for _, addr := range strings.Split(dsn, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			opts.InitialServers = append(opts.InitialServers, addr)
+		}
+	}
+	if len(opts.InitialServers) == 0 {
+		return opts, errors.New("uhasql: no server addresses")
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, fmt.Errorf("uhasql: invalid parameters: %v", err)
+	}
+	opts.Auth = params.Get("auth")
+	opts.User = params.Get("user")
+	opts.Password = params.Get("password")
+	var useTLS, insecure bool
+	for _, name := range []string{"tls", "tlsinsecure"} {
+		if params.Get(name) == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(params.Get(name))
+		if err != nil {
+			return opts, fmt.Errorf("uhasql: invalid %s parameter", name)
+		}
+		if name == "tls" {
+			useTLS = v
+		} else {
+			insecure = v
+		}
+	}
+	cacert := params.Get("cacert")
+	if useTLS || insecure || cacert != "" {
+		opts.TLSConfig = &tls.Config{
+			ServerName:         params.Get("servername"),
+			InsecureSkipVerify: insecure,
+		}
+		if cacert != "" {
+			data, err := ioutil.ReadFile(cacert)
+			if err != nil {
+				return opts, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return opts, errors.New("uhasql: invalid cacert")
+			}
+			opts.TLSConfig.RootCAs = pool
+		}
+	}
+	return opts, nil
+}
+
+// redisConn is a connection to the cluster, which is a *uhatools.Conn.
+type redisConn interface {
+	Do(cmd string, args ...interface{}) (interface{}, error)
+	Close() error
+}
+
+type conn struct {
+	c        redisConn
+	user     string
+	password string
+	tx       *tx
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{c: c, query: query}, nil
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string,
+) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+
+func (c *conn) Close() error {
+	c.tx = nil
+	return c.c.Close()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions,
+) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("uhasql: transaction already in progress")
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) &&
+		opts.Isolation != driver.IsolationLevel(sql.LevelSerializable) {
+		return nil, errors.New("uhasql: unsupported isolation level")
+	}
+	c.tx = &tx{c: c}
+	return c.tx, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "PING")
+	return err
+}
+
+// CheckNamedValue converts the args into values that can be bound to a
+// statement.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nv.Name != "" {
+		return errors.New("uhasql: named args are not supported")
+	}
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case bool:
+		if x {
+			v = int64(1)
+		} else {
+			v = int64(0)
+		}
+	case time.Time:
+		v = x.Format(timeFormat)
+	}
+	nv.Value = v
+	return nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue,
+) (driver.Result, error) {
+	stmts, err := statements(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if c.tx != nil {
+		c.tx.stmts = append(c.tx.stmts, stmts...)
+		r := &result{tx: c.tx}
+		c.tx.results = append(c.tx.results, r)
+		c.tx.ends = append(c.tx.ends, len(c.tx.stmts)-1)
+		return r, nil
+	}
+	results, err := c.exec(ctx, stmts)
+	if err != nil {
+		return nil, err
+	}
+	return results[len(results)-1], nil
+}
+
+// exec sends the statements as a write and returns a result for each
+// statement.
+func (c *conn) exec(ctx context.Context, stmts []interface{},
+) ([]*result, error) {
+	data, _ := json.Marshal(stmts)
+	info, err := uhatools.ValueMap(c.run(ctx, "exec", "withinfo", "json",
+		string(data)))
+	if err != nil {
+		return nil, err
+	}
+	vals, err := uhatools.Values(info["results"], nil)
+	if err != nil {
+		return nil, err
+	}
+	var results []*result
+	for _, val := range vals {
+		m, err := uhatools.ValueMap(val, nil)
+		if err != nil {
+			return nil, err
+		}
+		r := new(result)
+		if r.n, err = uhatools.Int64(m["changes"], nil); err != nil {
+			return nil, err
+		}
+		if r.id, err = uhatools.Int64(m["last_insert_rowid"], nil); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if len(results) != len(stmts) {
+		return nil, errors.New("uhasql: invalid response")
+	}
+	return results, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue,
+) (driver.Rows, error) {
+	if c.tx != nil {
+		return nil, errQueryInTx
+	}
+	stmts, err := statements(query, args)
+	if err != nil {
+		return nil, err
+	}
+	// The server only allows for reading statements with QUERY.
+	cmd := "query"
+	for _, stmt := range stmts {
+		sql, ok := stmt.(string)
+		if !ok {
+			sql = stmt.([]interface{})[0].(string)
+		}
+		switch command(sql) {
+		case "select", "explain":
+		default:
+			cmd = "exec"
+		}
+	}
+	data, _ := json.Marshal(stmts)
+	vals, err := uhatools.Values(c.run(ctx, cmd, "withtypes", "json",
+		string(data)))
+	if err != nil {
+		return nil, err
+	}
+	rows := new(rows)
+	for _, val := range vals {
+		rs, err := resultset(val)
+		if err != nil {
+			return nil, err
+		}
+		rows.sets = append(rows.sets, rs)
+	}
+	if len(rows.sets) == 0 {
+		return nil, errors.New("uhasql: invalid response")
+	}
+	return rows, nil
+}
+
+func (c *conn) do(ctx context.Context, cmd string, args ...interface{},
+) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.c.Do(cmd, args...)
+}
+
+// run sends a command that runs as the user. The login is sent with the
+// command, because the connection may be moved to another server at any time.
+func (c *conn) run(ctx context.Context, cmd string, args ...interface{},
+) (interface{}, error) {
+	if c.user == "" {
+		return c.do(ctx, cmd, args...)
+	}
+	return c.do(ctx, "login",
+		append([]interface{}{c.user, c.password, cmd}, args...)...)
+}
+
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput returns -1 because the number of parameters is not known until
+// the statement is executed on the server.
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue,
+) (driver.Result, error) {
+	return s.c.ExecContext(ctx, s.query, args)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue,
+) (driver.Rows, error) {
+	return s.c.QueryContext(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	nargs := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		nargs[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return nargs
+}
+
+// tx buffers the statements of a transaction.
+type tx struct {
+	c       *conn
+	stmts   []interface{}
+	results []*result
+	ends    []int // index of the last statement for each result
+	done    bool
+}
+
+func (tx *tx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.c.tx = nil
+	if len(tx.stmts) == 0 {
+		return nil
+	}
+	results, err := tx.c.exec(context.Background(), tx.stmts)
+	if err != nil {
+		for _, r := range tx.results {
+			r.tx, r.err = nil, err
+		}
+		return err
+	}
+	for i, r := range tx.results {
+		r.tx, r.id, r.n = nil, results[tx.ends[i]].id, results[tx.ends[i]].n
+	}
+	return nil
+}
+
+func (tx *tx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.c.tx = nil
+	for _, r := range tx.results {
+		r.tx, r.err = nil, errTxDone
+	}
+	return nil
+}
+
+// result is the result of an Exec. When there are multiple statements, the
+// result is for the last statement.
+type result struct {
+	tx  *tx // pending transaction
+	id  int64
+	n   int64
+	err error
+}
+
+func (r *result) LastInsertId() (int64, error) {
+	if r.tx != nil {
+		return 0, errTxPending
+	}
+	return r.id, r.err
+}
+
+func (r *result) RowsAffected() (int64, error) {
+	if r.tx != nil {
+		return 0, errTxPending
+	}
+	return r.n, r.err
+}
+
+type resultSet struct {
+	names []string
+	types []string
+	rows  [][]interface{}
+}
+
+// resultset converts a resultset from the server. The first row is the column
+// names, the second row is the declared column types, and the other rows are
+// the values.
+func resultset(reply interface{}) (*resultSet, error) {
+	vals, err := uhatools.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) < 2 {
+		return nil, errors.New("uhasql: invalid response")
+	}
+	rs := new(resultSet)
+	if rs.names, err = uhatools.Strings(vals[0], nil); err != nil {
+		return nil, err
+	}
+	if rs.types, err = uhatools.Strings(vals[1], nil); err != nil {
+		return nil, err
+	}
+	for _, val := range vals[2:] {
+		row, err := uhatools.Values(val, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(row) != len(rs.names) {
+			return nil, errors.New("uhasql: invalid response")
+		}
+		for i := range row {
+			row[i] = convertValue(row[i], rs.types[i])
+		}
+		rs.rows = append(rs.rows, row)
+	}
+	return rs, nil
+}
+
+// convertValue converts a value from the server into a Go value using the
+// declared column type, following the Sqlite rules for column affinity.
+func convertValue(v interface{}, decltype string) interface{} {
+	data, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	typ := strings.ToUpper(decltype)
+	switch {
+	case strings.Contains(typ, "INT"):
+		if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			return n
+		}
+	case strings.Contains(typ, "BOOL"):
+		if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			return n != 0
+		}
+	case strings.Contains(typ, "REAL"), strings.Contains(typ, "FLOA"),
+		strings.Contains(typ, "DOUB"):
+		if f, err := strconv.ParseFloat(string(data), 64); err == nil {
+			return f
+		}
+	case strings.Contains(typ, "BLOB"):
+		return data
+	}
+	return string(data)
+}
+
+type rows struct {
+	sets []*resultSet
+	set  int
+	row  int
+}
+
+func (r *rows) Columns() []string {
+	return r.sets[r.set].names
+}
+
+func (r *rows) Close() error {
+	r.set = len(r.sets) - 1
+	r.row = len(r.sets[r.set].rows)
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	rs := r.sets[r.set]
+	if r.row == len(rs.rows) {
+		return io.EOF
+	}
+	for i, v := range rs.rows[r.row] {
+		dest[i] = v
+	}
+	r.row++
+	return nil
+}
+
+func (r *rows) HasNextResultSet() bool {
+	return r.set < len(r.sets)-1
+}
+
+func (r *rows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	r.set++
+	r.row = 0
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(r.sets[r.set].types[index])
+}
+
+// statements splits the query into statements and binds the args. Returns
+// the statements in the JSON format used by the EXEC and QUERY commands.
+func statements(query string, args []driver.NamedValue,
+) ([]interface{}, error) {
+	sqls := split(query)
+	if len(sqls) == 0 {
+		return nil, errNoStatements
+	}
+	if len(args) == 0 {
+		stmts := make([]interface{}, len(sqls))
+		for i, sql := range sqls {
+			stmts[i] = sql
+		}
+		return stmts, nil
+	}
+	if len(sqls) > 1 {
+		return nil, errors.New("uhasql: args are not allowed with " +
+			"multiple statements")
+	}
+	vals := []interface{}{sqls[0]}
+	for _, arg := range args {
+		v := arg.Value
+		if data, ok := v.([]byte); ok {
+			v = map[string]string{
+				"blob": base64.StdEncoding.EncodeToString(data),
+			}
+		}
+		vals = append(vals, v)
+	}
+	return []interface{}{vals}, nil
+}
+
+// split splits a query into statements. Comments are removed.
+func split(query string) []string {
+	var sqls []string
+	var sql []byte
+	add := func() {
+		if s := strings.TrimSpace(string(sql)); s != "" {
+			sqls = append(sqls, s)
+		}
+		sql = sql[:0]
+	}
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '-' && strings.HasPrefix(query[i:], "--"):
+			for ; i < len(query) && query[i] != '\n'; i++ {
+			}
+			sql = append(sql, ' ')
+		case query[i] == '/' && strings.HasPrefix(query[i:], "/*"):
+			if j := strings.Index(query[i+2:], "*/"); j != -1 {
+				i += j + 3
+			} else {
+				i = len(query)
+			}
+			sql = append(sql, ' ')
+		case query[i] == '\'' || query[i] == '"' || query[i] == '`' ||
+			query[i] == '[':
+			q := query[i]
+			if q == '[' {
+				q = ']'
+			}
+			j := i + 1
+			for ; j < len(query) && query[j] != q; j++ {
+			}
+			if j == len(query) {
+				j--
+			}
+			sql = append(sql, query[i:j+1]...)
+			i = j
+		case query[i] == ';':
+			add()
+		default:
+			sql = append(sql, query[i])
+		}
+	}
+	add()
+	return sqls
+}
+
+// command returns the first keyword of a statement in lowercase.
+func command(sql string) string {
+	for i := 0; i < len(sql); i++ {
+		if (sql[i] < 'A' || sql[i] > 'Z') && (sql[i] < 'a' || sql[i] > 'z') {
+			return strings.ToLower(sql[:i])
+		}
+	}
+	return strings.ToLower(sql)
+}
@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseDSN(t *testing.T) {
+	opts, err := parseDSN("uhasql://10.0.0.1:11001, 10.0.0.2:11001," +
+		"?auth=pass&user=app&password=secret&tls=true&servername=db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []string{"10.0.0.1:11001", "10.0.0.2:11001"}
+	if !reflect.DeepEqual(opts.InitialServers, servers) {
+		t.Fatalf("expected %v, got %v", servers, opts.InitialServers)
+	}
+	if opts.Auth != "pass" || opts.User != "app" ||
+		opts.Password != "secret" {
+		t.Fatalf("unexpected auth, user, or password: %q %q %q",
+			opts.Auth, opts.User, opts.Password)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.ServerName != "db" ||
+		opts.TLSConfig.InsecureSkipVerify {
+		t.Fatalf("unexpected tls config: %+v", opts.TLSConfig)
+	}
+
+	opts, err = parseDSN("127.0.0.1:11001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig != nil || opts.User != "" {
+		t.Fatal("expected no tls and no user")
+	}
+	opts, err = parseDSN("127.0.0.1:11001?tlsinsecure=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || !opts.TLSConfig.InsecureSkipVerify {
+		t.Fatal("expected insecure tls")
+	}
+
+	for _, dsn := range []string{
+		"",
+		" , ",
+		"?auth=pass",
+		"127.0.0.1:11001?tls=maybe",
+		"127.0.0.1:11001?tlsinsecure=maybe",
+		"127.0.0.1:11001?cacert=/no/such/file.pem",
+		"127.0.0.1:11001?auth=%zz",
+	} {
+		if _, err := parseDSN(dsn); err == nil {
+			t.Fatalf("expected an error for %q", dsn)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		query string
+		sqls  []string
+	}{
+		{"", nil},
+		{" ; ;", nil},
+		{"select 1", []string{"select 1"}},
+		{"select 1; select 2;", []string{"select 1", "select 2"}},
+		{"select ';' ; select \"a;b\"", []string{"select ';'",
+			"select \"a;b\""}},
+		{"select [a;b], `c;d` from t", []string{"select [a;b], `c;d` from t"}},
+		{"select 1 -- one; two\n; select 2",
+			[]string{"select 1", "select 2"}},
+		{"select /* a; b */ 1", []string{"select   1"}},
+		{"select 1 /* unterminated; comment", []string{"select 1"}},
+		{"select 'unterminated;", []string{"select 'unterminated;"}},
+	}
+	for _, tt := range tests {
+		sqls := split(tt.query)
+		if !reflect.DeepEqual(sqls, tt.sqls) {
+			t.Fatalf("split(%q): expected %q, got %q", tt.query, tt.sqls,
+				sqls)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	stmts, err := statements("insert into t values (?, ?)", []driver.NamedValue{
+		{Ordinal: 1, Value: int64(1)},
+		{Ordinal: 2, Value: []byte("hi")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(stmts)
+	expect := `[["insert into t values (?, ?)",1,{"blob":"aGk="}]]`
+	if string(data) != expect {
+		t.Fatalf("expected %s, got %s", expect, data)
+	}
+	_, err = statements("select 1; select ?", []driver.NamedValue{
+		{Ordinal: 1, Value: int64(1)},
+	})
+	if err == nil {
+		t.Fatal("expected an error for args with multiple statements")
+	}
+	if _, err := statements(" ; ", nil); err != errNoStatements {
+		t.Fatalf("expected %v, got %v", errNoStatements, err)
+	}
+}
+
+// fakeConn records the commands and returns the same reply to each.
+type fakeConn struct {
+	cmds  [][]interface{}
+	reply interface{}
+	err   error
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{},
+	error,
+) {
+	c.cmds = append(c.cmds, append([]interface{}{cmd}, args...))
+	return c.reply, c.err
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// execReply returns the reply of EXEC WITHINFO with a result for each of the
+// changes and last insert rowid pairs.
+func execReply(results ...[2]int64) interface{} {
+	var vals []interface{}
+	for _, r := range results {
+		vals = append(vals, []interface{}{
+			[]byte("rows"), []interface{}{},
+			[]byte("changes"), r[0],
+			[]byte("total_changes"), r[0],
+			[]byte("last_insert_rowid"), r[1],
+		})
+	}
+	return []interface{}{
+		[]byte("applied"), int64(10),
+		[]byte("results"), vals,
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	ctx := context.Background()
+	fc := &fakeConn{reply: execReply([2]int64{1, 5}, [2]int64{1, 6},
+		[2]int64{3, 6})}
+	c := &conn{c: fc, user: "app", password: "secret"}
+	tx, err := c.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.BeginTx(ctx, driver.TxOptions{}); err == nil {
+		t.Fatal("expected an error for a nested transaction")
+	}
+	r1, err := c.ExecContext(ctx, "insert into t values (?)",
+		[]driver.NamedValue{{Ordinal: 1, Value: int64(5)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := c.ExecContext(ctx,
+		"insert into t values (6); update t set x = 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r1.LastInsertId(); err != errTxPending {
+		t.Fatalf("expected %v, got %v", errTxPending, err)
+	}
+	if _, err := c.QueryContext(ctx, "select 1", nil); err != errQueryInTx {
+		t.Fatalf("expected %v, got %v", errQueryInTx, err)
+	}
+	if len(fc.cmds) != 0 {
+		t.Fatalf("expected no commands before the commit, got %v", fc.cmds)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.cmds) != 1 {
+		t.Fatalf("expected one command, got %v", fc.cmds)
+	}
+	expect := []interface{}{"login", "app", "secret", "exec", "withinfo",
+		"json", `[["insert into t values (?)",5],` +
+			`"insert into t values (6)","update t set x = 1"]`}
+	if !reflect.DeepEqual(fc.cmds[0], expect) {
+		t.Fatalf("expected %q, got %q", expect, fc.cmds[0])
+	}
+	if id, err := r1.LastInsertId(); err != nil || id != 5 {
+		t.Fatalf("expected 5, got %d, %v", id, err)
+	}
+	if n, err := r2.RowsAffected(); err != nil || n != 3 {
+		t.Fatalf("expected 3, got %d, %v", n, err)
+	}
+	if err := tx.Commit(); err != errTxDone {
+		t.Fatalf("expected %v, got %v", errTxDone, err)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	ctx := context.Background()
+	fc := &fakeConn{}
+	c := &conn{c: fc}
+	tx, err := c.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.ExecContext(ctx, "insert into t values (1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.cmds) != 0 {
+		t.Fatalf("expected no commands, got %v", fc.cmds)
+	}
+	if _, err := r.RowsAffected(); err != errTxDone {
+		t.Fatalf("expected %v, got %v", errTxDone, err)
+	}
+	if err := tx.Rollback(); err != errTxDone {
+		t.Fatalf("expected %v, got %v", errTxDone, err)
+	}
+	// The connection is usable after the rollback.
+	fc.reply = execReply([2]int64{1, 1})
+	_, err = c.ExecContext(ctx, "insert into t values (1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []interface{}{"exec", "withinfo", "json",
+		`["insert into t values (1)"]`}
+	if !reflect.DeepEqual(fc.cmds[0], expect) {
+		t.Fatalf("expected %q, got %q", expect, fc.cmds[0])
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	ctx := context.Background()
+	fc := &fakeConn{reply: []interface{}{
+		[]interface{}{
+			[]interface{}{[]byte("x")},
+			[]interface{}{[]byte("integer")},
+			[]interface{}{[]byte("1")},
+		},
+	}}
+	c := &conn{c: fc}
+	rows, err := c.QueryContext(ctx, "select x from t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil || dest[0] != int64(1) {
+		t.Fatalf("expected 1, got %v, %v", dest[0], err)
+	}
+	// Only select and explain are sent with QUERY, which only allows for
+	// reading statements.
+	for _, tt := range []struct{ query, cmd string }{
+		{"select 1", "query"},
+		{"explain select 1", "query"},
+		{"with a as (select 1) select * from a", "exec"},
+		{"insert into t values (1) returning x", "exec"},
+	} {
+		fc.cmds = nil
+		c.QueryContext(ctx, tt.query, nil)
+		if fc.cmds[0][0] != tt.cmd {
+			t.Fatalf("expected %s for %q, got %v", tt.cmd, tt.query,
+				fc.cmds[0])
+		}
+	}
+}
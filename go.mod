@@ -3,6 +3,7 @@ module github.com/tidwall/uhasql
 go 1.15
 
 require (
+	github.com/hashicorp/raft v1.2.0
 	github.com/peterh/liner v1.2.0
 	github.com/robertkrimen/otto v0.0.0-20200922221731-ef014fd054ac
 	github.com/tidwall/gjson v1.6.3
@@ -10,7 +10,7 @@ if [[ "$1" == "uhasql-server" ]]; then
     CGO_ENABLED=1 go build -ldflags "\
         -X main.buildVersion=$GITVERS \
         -X main.buildGitSHA=$GITSHA \
-    " -o ../../uhasql-server main.go
+    " -o ../../uhasql-server .
 elif [[ "$1" == "uhasql-cli" ]]; then
     cd cmd/uhasql-cli
     go build -o ../../uhasql-cli main.go